@@ -0,0 +1,210 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Didstopia/shoelaces/internal/utils"
+)
+
+// Role is the level of access granted to an authenticated client.
+type Role int
+
+const (
+	// RoleNone is the role of unauthenticated clients.
+	RoleNone Role = iota
+	// RoleViewer can browse the UI and read from the API.
+	RoleViewer
+	// RoleOperator can also choose targets for booting servers.
+	RoleOperator
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleOperator:
+		return "operator"
+	default:
+		return "none"
+	}
+}
+
+// ParseRole returns the Role matching the given name.
+func ParseRole(name string) (Role, error) {
+	switch name {
+	case "viewer":
+		return RoleViewer, nil
+	case "operator":
+		return RoleOperator, nil
+	default:
+		return RoleNone, fmt.Errorf("unknown role %q", name)
+	}
+}
+
+// Identity describes an authenticated client.
+type Identity struct {
+	Name   string
+	Role   Role
+	Method string
+}
+
+// Config holds the paths and settings used to build an Authenticator.
+type Config struct {
+	TokensFile   string
+	HtpasswdFile string
+	ClientCAFile string
+	Operators    []string
+}
+
+type token struct {
+	value []byte
+	role  Role
+}
+
+// Authenticator checks the credentials of HTTP requests. Clients can
+// authenticate with a static bearer token, HTTP basic authentication
+// against an htpasswd file, or a client certificate verified by TLS.
+type Authenticator struct {
+	tokens    []token
+	users     map[string]string
+	operators []string
+	// ClientCAs holds the CAs trusted for client certificates, if any.
+	ClientCAs *x509.CertPool
+}
+
+// New builds an Authenticator from the given Config. It returns nil when
+// no authentication method is configured.
+func New(c Config) (*Authenticator, error) {
+	if c.TokensFile == "" && c.HtpasswdFile == "" && c.ClientCAFile == "" {
+		return nil, nil
+	}
+
+	a := &Authenticator{operators: c.Operators}
+
+	if c.TokensFile != "" {
+		tokens, err := parseTokens(c.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		a.tokens = tokens
+	}
+
+	if c.HtpasswdFile != "" {
+		users, err := parseHtpasswd(c.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		a.users = users
+	}
+
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		a.ClientCAs = x509.NewCertPool()
+		if !a.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+		}
+	}
+
+	return a, nil
+}
+
+// Authenticate returns the identity of the client that sent the request.
+// It returns false when the request carries no valid credentials.
+func (a *Authenticator) Authenticate(r *http.Request) (Identity, bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && a.ClientCAs != nil {
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		return Identity{Name: name, Role: a.roleFor(name), Method: "certificate"}, true
+	}
+
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		value := []byte(strings.TrimPrefix(header, "Bearer "))
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare(t.value, value) == 1 {
+				return Identity{Name: "token", Role: t.role, Method: "token"}, true
+			}
+		}
+		return Identity{}, false
+	}
+
+	if user, password, ok := r.BasicAuth(); ok {
+		if hash, found := a.users[user]; found && checkPassword(hash, password) {
+			return Identity{Name: user, Role: a.roleFor(user), Method: "basic"}, true
+		}
+	}
+
+	return Identity{}, false
+}
+
+// UsesBasicAuth returns whether HTTP basic authentication is configured,
+// so clients can be challenged for a user and password.
+func (a *Authenticator) UsesBasicAuth() bool {
+	return len(a.users) > 0
+}
+
+func (a *Authenticator) roleFor(name string) Role {
+	if utils.StringInSlice(name, a.operators) {
+		return RoleOperator
+	}
+	return RoleViewer
+}
+
+// parseTokens reads a file with one "<role> <token>" pair per line.
+func parseTokens(path string) ([]token, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	tokens := make([]token, 0)
+	scanner := bufio.NewScanner(fh)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<role> <token>\"", path, n)
+		}
+		role, err := ParseRole(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		tokens = append(tokens, token{value: []byte(fields[1]), role: role})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("no tokens found in " + path)
+	}
+
+	return tokens, nil
+}
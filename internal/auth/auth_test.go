@@ -0,0 +1,87 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckPassword(t *testing.T) {
+	hashes := map[string]string{
+		"$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/": "secret",
+		"$apr1$xy$q/TPHhf1FfQqXeFUwZC/b/":       "p",
+		"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=":     "secret",
+	}
+	for hash, password := range hashes {
+		if !checkPassword(hash, password) {
+			t.Errorf("Expected %s to match %s", password, hash)
+		}
+		if checkPassword(hash, password+"x") {
+			t.Errorf("Expected %sx not to match %s", password, hash)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a, err := New(Config{
+		TokensFile:   writeFile(t, "tokens", "# comment\nviewer view-token\noperator op-token\n"),
+		HtpasswdFile: writeFile(t, "htpasswd", "alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"),
+		Operators:    []string{"alice"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		setup func(r *http.Request)
+		ok    bool
+		role  Role
+	}{
+		{func(r *http.Request) {}, false, RoleNone},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer view-token") }, true, RoleViewer},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer op-token") }, true, RoleOperator},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer bad-token") }, false, RoleNone},
+		{func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, true, RoleOperator},
+		{func(r *http.Request) { r.SetBasicAuth("bob", "secret") }, true, RoleViewer},
+		{func(r *http.Request) { r.SetBasicAuth("bob", "wrong") }, false, RoleNone},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		test.setup(r)
+		identity, ok := a.Authenticate(r)
+		if ok != test.ok || identity.Role != test.role {
+			t.Errorf("Case %d: expected %v/%s\nGot: %v/%s", i, test.ok, test.role, ok, identity.Role)
+		}
+	}
+}
+
+func TestNewDisabled(t *testing.T) {
+	a, err := New(Config{})
+	if a != nil || err != nil {
+		t.Error("Expected no Authenticator when nothing is configured")
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certs
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"sync"
+)
+
+// Certificate holds a TLS key pair loaded from disk. It can be reloaded
+// while serving, so renewed certificates are picked up without a restart.
+type Certificate struct {
+	sync.RWMutex
+	certFile string
+	keyFile  string
+	keyPair  *tls.Certificate
+}
+
+// Load reads the key pair from the given PEM files.
+func Load(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: filepath.Clean(certFile), keyFile: filepath.Clean(keyFile)}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the key pair again. The previous one is kept if the files
+// can't be loaded, e.g. while they are being replaced.
+func (c *Certificate) Reload() error {
+	keyPair, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.keyPair = &keyPair
+	c.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current key pair. It's meant to be used as
+// tls.Config.GetCertificate.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.keyPair, nil
+}
+
+// IsFile returns whether path is the certificate or the key file.
+func (c *Certificate) IsFile(path string) bool {
+	path = filepath.Clean(path)
+	return path == c.certFile || path == c.keyFile
+}
+
+// Dirs returns the directories holding the certificate and key files.
+// Watching the directories instead of the files catches renewals that
+// replace the files instead of writing them in place.
+func (c *Certificate) Dirs() []string {
+	certDir, keyDir := filepath.Dir(c.certFile), filepath.Dir(c.keyFile)
+	if certDir == keyDir {
+		return []string{certDir}
+	}
+	return []string{certDir, keyDir}
+}
@@ -0,0 +1,303 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dhcp implements a ProxyDHCP responder as described in the PXE
+// specification. It never hands out addresses: it only tells PXE clients
+// which file to boot, leaving address assignment to the main DHCP server.
+package dhcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/Didstopia/shoelaces/internal/log"
+)
+
+const (
+	serverPort = 67
+	clientPort = 68
+	maxPacket  = 1500
+
+	pxeClass = "PXEClient"
+	ipxeUser = "iPXE"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to
+// Shutdown.
+var ErrServerClosed = errors.New("dhcp: Server closed")
+
+// Arch is a client system architecture type, as sent in option 93
+// (RFC 4578).
+type Arch uint16
+
+// Client architectures that can be mapped to a boot file.
+const (
+	ArchBIOS     Arch = 0
+	ArchEFIIA32  Arch = 6
+	ArchEFIBC    Arch = 7
+	ArchEFIx8664 Arch = 9
+	ArchEFIARM32 Arch = 10
+	ArchEFIARM64 Arch = 11
+)
+
+func (a Arch) String() string {
+	switch a {
+	case ArchBIOS:
+		return "bios"
+	case ArchEFIIA32:
+		return "efi-ia32"
+	case ArchEFIBC:
+		return "efi-bc"
+	case ArchEFIx8664:
+		return "efi-x86_64"
+	case ArchEFIARM32:
+		return "efi-arm32"
+	case ArchEFIARM64:
+		return "efi-arm64"
+	default:
+		return fmt.Sprintf("arch-%d", uint16(a))
+	}
+}
+
+// Server answers PXE clients with the file they have to boot. Plain PXE
+// ROMs get the iPXE binary matching their architecture from BootFiles,
+// while clients already running iPXE get IPXEScript, so they don't
+// chainload iPXE over and over.
+type Server struct {
+	ServerIP   net.IP
+	BootFiles  map[Arch]string
+	IPXEScript string
+	Logger     log.Logger
+
+	// Where replies to clients without an address are sent. They are
+	// only changed by tests.
+	broadcast  net.IP
+	clientPort int
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.PacketConn]struct{}
+}
+
+// New returns a Server announcing serverIP as the TFTP server.
+func New(logger log.Logger, serverIP net.IP, bootFiles map[Arch]string, ipxeScript string) *Server {
+	return &Server{
+		ServerIP:   serverIP.To4(),
+		BootFiles:  bootFiles,
+		IPXEScript: ipxeScript,
+		Logger:     logger,
+		broadcast:  net.IPv4bcast,
+		clientPort: clientPort,
+	}
+}
+
+// ListenAndServe listens on the UDP address addr, usually port 67 or
+// 4011, and answers requests until the listener fails.
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return err
+	}
+	s.Logger.Info("component", "dhcp", "addr", conn.LocalAddr(), "msg", "Listening for ProxyDHCP requests")
+	return s.Serve(conn)
+}
+
+// Serve reads requests from conn and answers the ones coming from PXE
+// clients.
+func (s *Server) Serve(conn net.PacketConn) error {
+	if !s.track(conn) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(conn)
+
+	// Anything but the DHCP port is handled as the PXE boot server port,
+	// 4011, where requests are meant for Shoelaces alone
+	bootServer := true
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.Port == serverPort {
+		bootServer = false
+	}
+
+	buf := make([]byte, maxPacket)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		req, err := ParsePacket(buf[:n])
+		if err != nil {
+			s.Logger.Debug("component", "dhcp", "msg", "Ignoring invalid packet", "src", addr, "err", err)
+			continue
+		}
+
+		resp, err := s.Reply(req, bootServer)
+		if err != nil {
+			s.Logger.Info("component", "dhcp", "msg", "Not answering PXE client", "mac", req.CHAddr, "err", err)
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+
+		data, err := resp.Marshal()
+		if err != nil {
+			s.Logger.Error("component", "dhcp", "msg", "Failed to encode reply", "mac", req.CHAddr, "err", err)
+			continue
+		}
+		if _, err := conn.WriteTo(data, s.destination(req, addr)); err != nil {
+			s.Logger.Error("component", "dhcp", "msg", "Failed to send reply", "mac", req.CHAddr, "err", err)
+		}
+	}
+}
+
+// Shutdown stops answering requests. Replies are sent right away, so
+// there's nothing to wait for.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for conn := range s.listeners {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) track(conn net.PacketConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.PacketConn]struct{})
+	}
+	s.listeners[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.PacketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.listeners, conn)
+	conn.Close()
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Reply builds the answer to a request, received on the PXE boot server
+// port when bootServer is true, or on the DHCP port otherwise. It returns
+// nil without error for requests that don't come from PXE clients, which
+// are the main DHCP server's business. On the DHCP port, only DISCOVERs
+// and the REQUESTs naming Shoelaces as server are answered, so the ACKs
+// of the main DHCP server aren't raced.
+func (s *Server) Reply(req *Packet, bootServer bool) (*Packet, error) {
+	if req.Op != opRequest || !bytes.HasPrefix(req.Options[optClassID], []byte(pxeClass)) {
+		return nil, nil
+	}
+
+	var respType byte
+	switch req.MessageType() {
+	case msgDiscover:
+		respType = msgOffer
+	case msgRequest:
+		if !bootServer && !net.IP(req.Options[optServerID]).Equal(s.ServerIP) {
+			return nil, nil
+		}
+		respType = msgAck
+	case msgInform:
+		if !bootServer {
+			return nil, nil
+		}
+		respType = msgAck
+	default:
+		return nil, nil
+	}
+
+	arch := ArchBIOS
+	if v := req.Options[optClientArch]; len(v) >= 2 {
+		arch = Arch(binary.BigEndian.Uint16(v))
+	}
+	ipxe := bytes.Contains(req.Options[optUserClass], []byte(ipxeUser))
+
+	file := s.IPXEScript
+	if !ipxe {
+		file = s.BootFiles[arch]
+	}
+	if file == "" {
+		return nil, fmt.Errorf("no boot file for architecture %s", arch)
+	}
+
+	resp := &Packet{
+		Op:     opReply,
+		HType:  req.HType,
+		HLen:   req.HLen,
+		XID:    req.XID,
+		Flags:  req.Flags,
+		CIAddr: req.CIAddr,
+		YIAddr: net.IPv4zero,
+		SIAddr: s.ServerIP,
+		GIAddr: req.GIAddr,
+		CHAddr: req.CHAddr,
+		Options: map[byte][]byte{
+			optMessageType: {respType},
+			optServerID:    s.ServerIP,
+			optClassID:     []byte(pxeClass),
+			optBootFile:    []byte(file),
+		},
+	}
+	if len(file) < fileSize {
+		resp.File = file
+	}
+	if uuid, ok := req.Options[optClientUUID]; ok {
+		resp.Options[optClientUUID] = uuid
+	}
+	if !ipxe {
+		resp.Options[optTFTPServer] = []byte(s.ServerIP.String())
+		// PXE_DISCOVERY_CONTROL: skip boot server discovery and download
+		// the boot file straight away.
+		resp.Options[optVendor] = []byte{6, 1, 8, optEnd}
+	}
+
+	s.Logger.Info("component", "dhcp", "msg", "Answering PXE client", "mac", req.CHAddr, "arch", arch, "ipxe", ipxe, "file", file)
+	return resp, nil
+}
+
+// destination returns where the reply to a request must be sent,
+// following RFC 2131: through the relay agent if there's one, straight to
+// the client if it already has an address, and broadcast otherwise.
+func (s *Server) destination(req *Packet, src net.Addr) net.Addr {
+	if ip := req.GIAddr.To4(); ip != nil && !ip.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: ip, Port: serverPort}
+	}
+	if ip := req.CIAddr.To4(); ip != nil && !ip.Equal(net.IPv4zero) {
+		return src
+	}
+	return &net.UDPAddr{IP: s.broadcast, Port: s.clientPort}
+}
@@ -0,0 +1,269 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/log"
+)
+
+const ipxeScript = "http://10.0.0.1:8081/poll/1/${netX/mac:hexhyp}"
+
+var testMAC = net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+
+// startServer runs a Server on a loopback socket and returns a socket
+// acting as the PXE client. Broadcast replies are sent to the client
+// socket too. The server doesn't listen on port 67, so it answers like on
+// the boot server port.
+func startServer(t *testing.T) (client *net.UDPConn, server *net.UDPAddr) {
+	t.Helper()
+
+	serverConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		serverConn.Close()
+		client.Close()
+	})
+
+	s := New(log.MakeLogger(ioutil.Discard), net.IPv4(10, 0, 0, 1), map[Arch]string{
+		ArchBIOS:     "undionly.kpxe",
+		ArchEFIBC:    "ipxe.efi",
+		ArchEFIx8664: "ipxe.efi",
+	}, ipxeScript)
+	s.broadcast = net.IPv4(127, 0, 0, 1)
+	s.clientPort = client.LocalAddr().(*net.UDPAddr).Port
+	go s.Serve(serverConn)
+
+	return client, serverConn.LocalAddr().(*net.UDPAddr)
+}
+
+func request(msgType byte, arch Arch, userClass string, class string) *Packet {
+	archOpt := make([]byte, 2)
+	binary.BigEndian.PutUint16(archOpt, uint16(arch))
+
+	p := &Packet{
+		Op:     opRequest,
+		HType:  1,
+		HLen:   byte(len(testMAC)),
+		XID:    0xdeadbeef,
+		CIAddr: net.IPv4zero,
+		CHAddr: testMAC,
+		Options: map[byte][]byte{
+			optMessageType: {msgType},
+			optClassID:     []byte(class),
+			optClientArch:  archOpt,
+			optClientUUID:  {0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		},
+	}
+	if userClass != "" {
+		p.Options[optUserClass] = []byte(userClass)
+	}
+	return p
+}
+
+func exchange(t *testing.T, client *net.UDPConn, server *net.UDPAddr, req *Packet) *Packet {
+	t.Helper()
+
+	data, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteTo(data, server); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, maxPacket)
+	client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		}
+		t.Fatal(err)
+	}
+	resp, err := ParsePacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestProxyDHCP(t *testing.T) {
+	client, server := startServer(t)
+
+	testCases := []struct {
+		name      string
+		msgType   byte
+		arch      Arch
+		userClass string
+		class     string
+		wantType  byte
+		wantFile  string
+	}{
+		{"bios", msgDiscover, ArchBIOS, "", "PXEClient:Arch:00000:UNDI:002001", msgOffer, "undionly.kpxe"},
+		{"uefi", msgDiscover, ArchEFIx8664, "", "PXEClient:Arch:00009:UNDI:003016", msgOffer, "ipxe.efi"},
+		{"ipxe", msgDiscover, ArchBIOS, "iPXE", "PXEClient:Arch:00000:UNDI:002001", msgOffer, ipxeScript},
+		{"request", msgRequest, ArchEFIBC, "", "PXEClient", msgAck, "ipxe.efi"},
+		{"not pxe", msgDiscover, ArchBIOS, "", "MSFT 5.0", 0, ""},
+		{"unknown arch", msgDiscover, ArchEFIARM64, "", "PXEClient", 0, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := exchange(t, client, server, request(tc.msgType, tc.arch, tc.userClass, tc.class))
+			if tc.wantType == 0 {
+				if resp != nil {
+					t.Fatalf("expected no reply, got %+v", resp)
+				}
+				return
+			}
+			if resp == nil {
+				t.Fatal("expected a reply")
+			}
+
+			if resp.Op != opReply || resp.MessageType() != tc.wantType || resp.XID != 0xdeadbeef {
+				t.Errorf("unexpected reply header: op=%d type=%d xid=%x", resp.Op, resp.MessageType(), resp.XID)
+			}
+			if !bytes.Equal(resp.CHAddr, testMAC) {
+				t.Errorf("expected chaddr %s, got %s", testMAC, resp.CHAddr)
+			}
+			if !resp.YIAddr.Equal(net.IPv4zero) {
+				t.Errorf("ProxyDHCP must not offer an address, got %s", resp.YIAddr)
+			}
+			if !resp.SIAddr.Equal(net.IPv4(10, 0, 0, 1)) {
+				t.Errorf("expected siaddr 10.0.0.1, got %s", resp.SIAddr)
+			}
+			if resp.File != tc.wantFile || string(resp.Options[optBootFile]) != tc.wantFile {
+				t.Errorf("expected boot file %q, got %q / %q", tc.wantFile, resp.File, resp.Options[optBootFile])
+			}
+			if string(resp.Options[optClassID]) != pxeClass {
+				t.Errorf("expected class identifier %q, got %q", pxeClass, resp.Options[optClassID])
+			}
+			if len(resp.Options[optClientUUID]) != 17 {
+				t.Errorf("expected the client UUID to be copied")
+			}
+			_, hasVendor := resp.Options[optVendor]
+			if hasVendor == (tc.userClass == "iPXE") {
+				t.Errorf("vendor options should only be sent to PXE ROMs")
+			}
+		})
+	}
+}
+
+func TestProxyDHCPUnicast(t *testing.T) {
+	client, server := startServer(t)
+
+	// Requests on port 4011 come from clients that already have an
+	// address, and are answered straight to them.
+	req := request(msgRequest, ArchBIOS, "", "PXEClient")
+	req.CIAddr = net.IPv4(127, 0, 0, 1)
+	resp := exchange(t, client, server, req)
+	if resp == nil || resp.MessageType() != msgAck {
+		t.Fatalf("expected an ACK, got %+v", resp)
+	}
+	if resp.File != "undionly.kpxe" {
+		t.Errorf("expected undionly.kpxe, got %q", resp.File)
+	}
+}
+
+func TestProxyDHCPServerPort(t *testing.T) {
+	s := New(log.MakeLogger(ioutil.Discard), net.IPv4(10, 0, 0, 1), map[Arch]string{ArchBIOS: "undionly.kpxe"}, ipxeScript)
+
+	testCases := []struct {
+		name       string
+		msgType    byte
+		serverID   net.IP
+		bootServer bool
+		wantType   byte
+	}{
+		{"discover", msgDiscover, nil, false, msgOffer},
+		{"request for the main server", msgRequest, net.IPv4(10, 0, 0, 254), false, 0},
+		{"request without server", msgRequest, nil, false, 0},
+		{"request for shoelaces", msgRequest, net.IPv4(10, 0, 0, 1), false, msgAck},
+		{"inform", msgInform, nil, false, 0},
+		{"request on 4011", msgRequest, net.IPv4(10, 0, 0, 254), true, msgAck},
+		{"inform on 4011", msgInform, nil, true, msgAck},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := request(tc.msgType, ArchBIOS, "", "PXEClient")
+			if tc.serverID != nil {
+				req.Options[optServerID] = tc.serverID.To4()
+			}
+			resp, err := s.Reply(req, tc.bootServer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantType == 0 {
+				if resp != nil {
+					t.Errorf("expected no reply, got %+v", resp)
+				}
+				return
+			}
+			if resp == nil || resp.MessageType() != tc.wantType {
+				t.Errorf("expected a reply of type %d, got %+v", tc.wantType, resp)
+			}
+		})
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	p := request(msgDiscover, ArchEFIx8664, "iPXE", "PXEClient")
+	p.File = "boot.efi"
+
+	data, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < minPacketSize {
+		t.Errorf("expected at least %d bytes, got %d", minPacketSize, len(data))
+	}
+	if data[headerSize+magicCookieSize] != optMessageType {
+		t.Errorf("expected the message type to be the first option")
+	}
+
+	got, err := ParsePacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.File != p.File || got.XID != p.XID || !bytes.Equal(got.CHAddr, p.CHAddr) {
+		t.Errorf("round trip mismatch: %+v", got)
+	}
+	for code, value := range p.Options {
+		if !bytes.Equal(got.Options[code], value) {
+			t.Errorf("option %d: expected %v, got %v", code, value, got.Options[code])
+		}
+	}
+
+	if _, err := ParsePacket(data[:100]); err == nil {
+		t.Error("expected an error for a truncated packet")
+	}
+	data[headerSize] = 0
+	if _, err := ParsePacket(data); err == nil {
+		t.Error("expected an error for a missing magic cookie")
+	}
+}
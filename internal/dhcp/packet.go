@@ -0,0 +1,210 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+const (
+	opRequest byte = 1
+	opReply   byte = 2
+
+	msgDiscover byte = 1
+	msgOffer    byte = 2
+	msgRequest  byte = 3
+	msgAck      byte = 5
+	msgInform   byte = 8
+
+	optPad         byte = 0
+	optVendor      byte = 43
+	optMessageType byte = 53
+	optServerID    byte = 54
+	optClassID     byte = 60
+	optTFTPServer  byte = 66
+	optBootFile    byte = 67
+	optUserClass   byte = 77
+	optClientArch  byte = 93
+	optClientUUID  byte = 97
+	optEnd         byte = 255
+
+	headerSize      = 236
+	magicCookieSize = 4
+	minPacketSize   = 300
+	sNameSize       = 64
+	fileSize        = 128
+	chAddrFieldSize = 16
+	maxOptionLength = 255
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// Packet is a DHCP message (RFC 2131). Options are indexed by their code.
+type Packet struct {
+	Op      byte
+	HType   byte
+	HLen    byte
+	Hops    byte
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	SName   string
+	File    string
+	Options map[byte][]byte
+}
+
+// MessageType returns the value of the DHCP message type option, or 0 if
+// it's missing.
+func (p *Packet) MessageType() byte {
+	if v := p.Options[optMessageType]; len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+// ParsePacket decodes a DHCP message.
+func ParsePacket(data []byte) (*Packet, error) {
+	if len(data) < headerSize+magicCookieSize {
+		return nil, errors.New("packet too short")
+	}
+	if !bytes.Equal(data[headerSize:headerSize+magicCookieSize], magicCookie) {
+		return nil, errors.New("missing DHCP magic cookie")
+	}
+
+	p := &Packet{
+		Op:      data[0],
+		HType:   data[1],
+		HLen:    data[2],
+		Hops:    data[3],
+		XID:     binary.BigEndian.Uint32(data[4:8]),
+		Secs:    binary.BigEndian.Uint16(data[8:10]),
+		Flags:   binary.BigEndian.Uint16(data[10:12]),
+		CIAddr:  copyIP(data[12:16]),
+		YIAddr:  copyIP(data[16:20]),
+		SIAddr:  copyIP(data[20:24]),
+		GIAddr:  copyIP(data[24:28]),
+		SName:   cString(data[44:108]),
+		File:    cString(data[108:236]),
+		Options: make(map[byte][]byte),
+	}
+	if p.HLen > chAddrFieldSize {
+		return nil, fmt.Errorf("invalid hardware address length %d", p.HLen)
+	}
+	p.CHAddr = net.HardwareAddr(append([]byte(nil), data[28:28+int(p.HLen)]...))
+
+	opts := data[headerSize+magicCookieSize:]
+	for i := 0; i < len(opts); {
+		code := opts[i]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || i+2+int(opts[i+1]) > len(opts) {
+			return nil, fmt.Errorf("option %d overflows the packet", code)
+		}
+		length := int(opts[i+1])
+		// Options split over several instances are concatenated (RFC 3396).
+		p.Options[code] = append(p.Options[code], opts[i+2:i+2+length]...)
+		i += 2 + length
+	}
+
+	return p, nil
+}
+
+// Marshal encodes the packet. The message type option is written first
+// and the rest are sorted by code.
+func (p *Packet) Marshal() ([]byte, error) {
+	if len(p.SName) >= sNameSize || len(p.File) >= fileSize {
+		return nil, errors.New("server name or file name too long")
+	}
+	if len(p.CHAddr) > chAddrFieldSize {
+		return nil, errors.New("hardware address too long")
+	}
+
+	data := make([]byte, headerSize, minPacketSize)
+	data[0] = p.Op
+	data[1] = p.HType
+	data[2] = p.HLen
+	data[3] = p.Hops
+	binary.BigEndian.PutUint32(data[4:8], p.XID)
+	binary.BigEndian.PutUint16(data[8:10], p.Secs)
+	binary.BigEndian.PutUint16(data[10:12], p.Flags)
+	putIP(data[12:16], p.CIAddr)
+	putIP(data[16:20], p.YIAddr)
+	putIP(data[20:24], p.SIAddr)
+	putIP(data[24:28], p.GIAddr)
+	copy(data[28:44], p.CHAddr)
+	copy(data[44:108], p.SName)
+	copy(data[108:236], p.File)
+	data = append(data, magicCookie...)
+
+	codes := make([]int, 0, len(p.Options))
+	for code := range p.Options {
+		if code != optMessageType {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	if _, ok := p.Options[optMessageType]; ok {
+		codes = append([]int{int(optMessageType)}, codes...)
+	}
+
+	for _, code := range codes {
+		value := p.Options[byte(code)]
+		if len(value) > maxOptionLength {
+			return nil, fmt.Errorf("option %d is too long", code)
+		}
+		data = append(data, byte(code), byte(len(value)))
+		data = append(data, value...)
+	}
+	data = append(data, optEnd)
+
+	// Some PXE ROMs drop replies shorter than a BOOTP message.
+	for len(data) < minPacketSize {
+		data = append(data, optPad)
+	}
+
+	return data, nil
+}
+
+func copyIP(b []byte) net.IP {
+	return net.IPv4(b[0], b[1], b[2], b[3]).To4()
+}
+
+func putIP(dst []byte, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(dst, ip4)
+	}
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
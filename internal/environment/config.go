@@ -0,0 +1,294 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package environment
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/mappings"
+	"github.com/Didstopia/shoelaces/internal/metrics"
+	"github.com/Didstopia/shoelaces/internal/polling"
+	"github.com/Didstopia/shoelaces/internal/templates"
+	"github.com/Didstopia/shoelaces/internal/utils"
+)
+
+// Config holds the mappings and templates loaded from the data directory.
+// A Config is never modified once in use: reloads build a new one and
+// swap it, so a request always sees a consistent set.
+type Config struct {
+	MACMaps      []mappings.MACMap
+	HardwareMaps []mappings.HardwareMap
+	HostnameMaps []mappings.HostnameMap
+	NetworkMaps  []mappings.NetworkMap
+	Templates    *templates.ShoelacesTemplates
+	Environments []string // Valid config environments
+	// PollPolicies are looked up before DefaultPollPolicy, the global one.
+	PollPolicies      []polling.PolicyMap
+	DefaultPollPolicy polling.Policy
+}
+
+func emptyConfig() *Config {
+	return &Config{
+		MACMaps:           make([]mappings.MACMap, 0),
+		HardwareMaps:      make([]mappings.HardwareMap, 0),
+		HostnameMaps:      make([]mappings.HostnameMap, 0),
+		NetworkMaps:       make([]mappings.NetworkMap, 0),
+		Templates:         templates.New(),
+		Environments:      make([]string, 0),
+		PollPolicies:      make([]polling.PolicyMap, 0),
+		DefaultPollPolicy: polling.DefaultPolicy,
+	}
+}
+
+// Summary describes the contents of the configuration in a few words.
+func (c *Config) Summary() string {
+	return fmt.Sprintf("%d MAC mappings, %d hardware mappings, %d network mappings, %d hostname mappings, %d poll policies, %d templates, %d environments",
+		len(c.MACMaps), len(c.HardwareMaps), len(c.NetworkMaps), len(c.HostnameMaps), len(c.PollPolicies), c.Templates.Count(), len(c.Environments))
+}
+
+// Config returns the configuration in use. Handlers should call it once
+// per request and stick to the returned value.
+func (env *Environment) Config() *Config {
+	return env.config.Load().(*Config)
+}
+
+// Reload loads the configuration from the data directory and puts it in
+// use if it's valid. Otherwise the previous one is kept. Either way, the
+// outcome is recorded in the event log, with source as the change that
+// triggered the reload.
+func (env *Environment) Reload(source string) error {
+	env.reloadMu.Lock()
+	defer env.reloadMu.Unlock()
+
+	config, err := env.loadConfig()
+	if err != nil {
+		env.Logger.Error("component", "config", "msg", "Failed to reload the configuration, keeping the previous one", "source", source, "err", err)
+		env.EventLog.AddReloadEvent(source, "", err)
+		metrics.ConfigReloads.Inc("failure")
+		return err
+	}
+
+	env.config.Store(config)
+	env.Logger.Info("component", "config", "msg", "Configuration reloaded", "source", source, "summary", config.Summary())
+	env.EventLog.AddReloadEvent(source, config.Summary(), nil)
+	metrics.ConfigReloads.Inc("success")
+	return nil
+}
+
+// loadConfig builds and validates a new Config, without touching the one
+// in use.
+func (env *Environment) loadConfig() (*Config, error) {
+	config := emptyConfig()
+	config.Environments = env.initEnvOverrides()
+	config.DefaultPollPolicy = env.PollPolicy
+
+	if err := env.loadMappings(config, path.Join(env.DataDir, env.MappingsFile)); err != nil {
+		return nil, err
+	}
+
+	if err := config.Templates.ParseTemplates(env.Logger, env.DataDir, env.EnvDir, config.Environments, env.TemplateExtension); err != nil {
+		return nil, err
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadMappings reads the mappings file into config, reporting every invalid
+// MAC, attribute, network and hostname expression at once.
+func (env *Environment) loadMappings(config *Config, mappingsPath string) error {
+	configMappings, err := mappings.ParseYamlMappings(env.Logger, mappingsPath)
+	if err != nil {
+		return err
+	}
+
+	problems := make([]string, 0)
+
+	for _, configMACMap := range configMappings.MACMaps {
+		macRange, err := mappings.ParseMACRange(configMACMap.MAC)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+
+		macMap := mappings.MACMap{MAC: macRange, Script: initScript(configMACMap.Script)}
+		config.MACMaps = append(config.MACMaps, macMap)
+	}
+
+	for i, configHardwareMap := range configMappings.HardwareMaps {
+		if len(configHardwareMap.Match) == 0 {
+			problems = append(problems, fmt.Sprintf("hardware mapping %d: nothing to match", i+1))
+			continue
+		}
+
+		match := make(map[string]*regexp.Regexp)
+		for name, expr := range configHardwareMap.Match {
+			if !utils.StringInSlice(name, mappings.AttributeNames) {
+				problems = append(problems, fmt.Sprintf("hardware mapping %d: unknown attribute %q", i+1, name))
+				continue
+			}
+			regex, err := regexp.Compile(expr)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("hardware mapping %d: %s %q: %v", i+1, name, expr, err))
+				continue
+			}
+			match[name] = regex
+		}
+
+		hardwareMap := mappings.HardwareMap{Match: match, Script: initScript(configHardwareMap.Script)}
+		config.HardwareMaps = append(config.HardwareMaps, hardwareMap)
+	}
+
+	for _, configNetMap := range configMappings.NetworkMaps {
+		_, ipnet, err := net.ParseCIDR(configNetMap.Network)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("network %q: %v", configNetMap.Network, err))
+			continue
+		}
+
+		netMap := mappings.NetworkMap{Network: ipnet, Script: initScript(configNetMap.Script)}
+		config.NetworkMaps = append(config.NetworkMaps, netMap)
+	}
+
+	for _, configHostMap := range configMappings.HostnameMaps {
+		regex, err := regexp.Compile(configHostMap.Hostname)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("hostname %q: %v", configHostMap.Hostname, err))
+			continue
+		}
+
+		hostMap := mappings.HostnameMap{Hostname: regex, Script: initScript(configHostMap.Script)}
+		config.HostnameMaps = append(config.HostnameMaps, hostMap)
+	}
+
+	for i, configPolicy := range configMappings.PollPolicies {
+		policyMap, err := env.initPollPolicyMap(configPolicy)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("poll policy %d: %v", i+1, err))
+			continue
+		}
+		config.PollPolicies = append(config.PollPolicies, policyMap)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %s", mappingsPath, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// initPollPolicyMap builds a PolicyMap from the mappings file, on top of
+// the global policy.
+func (env *Environment) initPollPolicyMap(configPolicy mappings.YamlPollPolicy) (polling.PolicyMap, error) {
+	policyMap := polling.PolicyMap{Environment: configPolicy.Environment, Policy: env.PollPolicy}
+	if configPolicy.Network == "" && configPolicy.Environment == "" {
+		return policyMap, errors.New("missing network or environment")
+	}
+	if configPolicy.Network != "" {
+		_, ipnet, err := net.ParseCIDR(configPolicy.Network)
+		if err != nil {
+			return policyMap, fmt.Errorf("network %q: %v", configPolicy.Network, err)
+		}
+		policyMap.Network = ipnet
+	}
+
+	policy := &policyMap.Policy
+	if configPolicy.MaxRetries != nil {
+		policy.MaxRetries = *configPolicy.MaxRetries
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"promptTimeout", configPolicy.PromptTimeout, &policy.PromptTimeout},
+		{"retryDelay", configPolicy.RetryDelay, &policy.RetryDelay},
+		{"maxRetryDelay", configPolicy.MaxRetryDelay, &policy.MaxRetryDelay},
+	} {
+		if d.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(d.value)
+		if err != nil {
+			return policyMap, fmt.Errorf("%s: %v", d.name, err)
+		}
+		*d.dst = value
+	}
+	if configPolicy.Fallback != "" {
+		policy.Fallback = polling.Fallback(configPolicy.Fallback)
+	}
+	if configPolicy.FallbackScript != nil {
+		policy.FallbackScript = initScript(*configPolicy.FallbackScript)
+	}
+
+	return policyMap, policy.Validate(env.PollExpire)
+}
+
+// validate checks that every mapping has a valid mode and refers to a
+// script that exists in its environment, and so do the fallback scripts
+// of the poll policies.
+func (c *Config) validate() error {
+	problems := make([]string, 0)
+
+	check := func(mapping string, script *mappings.Script) {
+		switch {
+		case !script.Mode.Valid():
+			problems = append(problems, fmt.Sprintf("%s: unknown mode %q", mapping, script.Mode))
+		case script.Mode == mappings.ModeLocalBoot && script.Name == "":
+			// Booting from the local disk doesn't need any script
+		case script.Name == "":
+			problems = append(problems, mapping+": missing script name")
+		case script.Environment != "" && !utils.StringInSlice(script.Environment, c.Environments):
+			problems = append(problems, fmt.Sprintf("%s: unknown environment %q", mapping, script.Environment))
+		case !c.Templates.HasTemplate(script.Name, script.Environment):
+			problems = append(problems, fmt.Sprintf("%s: unknown script %q", mapping, script.Name))
+		}
+	}
+	for _, m := range c.MACMaps {
+		check("mac "+m.MAC.String(), m.Script)
+	}
+	for i, m := range c.HardwareMaps {
+		check(fmt.Sprintf("hardware mapping %d", i+1), m.Script)
+	}
+	for _, m := range c.NetworkMaps {
+		check("network "+m.Network.String(), m.Script)
+	}
+	for _, m := range c.HostnameMaps {
+		check("hostname "+m.Hostname.String(), m.Script)
+	}
+	if c.DefaultPollPolicy.Fallback == polling.FallbackScript {
+		check("poll-fallback-script", c.DefaultPollPolicy.FallbackScript)
+	}
+	for i, m := range c.PollPolicies {
+		if m.Environment != "" && !utils.StringInSlice(m.Environment, c.Environments) {
+			problems = append(problems, fmt.Sprintf("poll policy %d: unknown environment %q", i+1, m.Environment))
+		}
+		if m.Policy.Fallback == polling.FallbackScript {
+			check(fmt.Sprintf("poll policy %d", i+1), m.Policy.FallbackScript)
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid mappings: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package environment
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/log"
+	"github.com/Didstopia/shoelaces/internal/mappings"
+	"github.com/Didstopia/shoelaces/internal/polling"
+)
+
+const validMappings = `macMaps:
+  - mac: 52:54:00
+    script:
+      name: test.ipxe
+  - mac: 52:54:00:aa:bb:cc
+    script:
+      mode: local-boot
+hardwareMaps:
+  - match:
+      manufacturer: ^Dell
+    script:
+      name: test.ipxe
+networkMaps:
+  - network: 10.0.0.0/8
+    script:
+      name: test.ipxe
+hostnameMaps:
+  - hostname: node.*
+    script:
+      name: test.ipxe
+      environment: staging
+`
+
+func testEnvironment(t *testing.T) *Environment {
+	t.Helper()
+
+	env := defaultEnvironment()
+	env.Logger = log.MakeLogger(ioutil.Discard)
+	env.EventLog = event.NewLog(env.Logger, nil)
+	env.DataDir = t.TempDir()
+	env.EnvDir = "env_overrides"
+	env.MappingsFile = "mappings.yaml"
+	env.TemplateExtension = ".slc"
+
+	writeFile(t, filepath.Join(env.DataDir, "ipxe", "test.ipxe.slc"), "{{define \"test.ipxe\" -}}\nboot\n{{end}}\n")
+	if err := os.MkdirAll(filepath.Join(env.DataDir, env.EnvDir, "staging"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(env.DataDir, env.MappingsFile), validMappings)
+
+	return env
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	env := testEnvironment(t)
+	if err := env.Reload("mappings.yaml"); err != nil {
+		t.Fatal(err)
+	}
+
+	config := env.Config()
+	if len(config.NetworkMaps) != 1 || len(config.HostnameMaps) != 1 {
+		t.Fatalf("Expected 1 network and 1 hostname mapping, got %d and %d", len(config.NetworkMaps), len(config.HostnameMaps))
+	}
+	if len(config.MACMaps) != 2 || len(config.HardwareMaps) != 1 {
+		t.Fatalf("Expected 2 MAC and 1 hardware mapping, got %d and %d", len(config.MACMaps), len(config.HardwareMaps))
+	}
+	if config.MACMaps[0].Script.Mode != mappings.ModeAlways || config.MACMaps[1].Script.Mode != mappings.ModeLocalBoot {
+		t.Errorf("Expected the always and local-boot modes, got %q and %q", config.MACMaps[0].Script.Mode, config.MACMaps[1].Script.Mode)
+	}
+	if len(config.Environments) != 1 || config.Environments[0] != "staging" {
+		t.Errorf("Expected the staging environment, got %v", config.Environments)
+	}
+}
+
+func TestReloadPollPolicies(t *testing.T) {
+	env := testEnvironment(t)
+	writeFile(t, filepath.Join(env.DataDir, env.MappingsFile), validMappings+`pollPolicies:
+  - network: 10.1.0.0/16
+    environment: staging
+    maxRetries: 30
+    retryDelay: 10s
+    fallback: script
+    fallbackScript:
+      name: test.ipxe
+      environment: staging
+`)
+	if err := env.Reload("mappings.yaml"); err != nil {
+		t.Fatal(err)
+	}
+
+	config := env.Config()
+	if len(config.PollPolicies) != 1 {
+		t.Fatalf("Expected 1 poll policy, got %d", len(config.PollPolicies))
+	}
+	policy := config.PollPolicies[0].Policy
+	if policy.MaxRetries != 30 || policy.RetryDelay != 10*time.Second || policy.Fallback != polling.FallbackScript {
+		t.Errorf("Expected the policy of the mappings, got %+v", policy)
+	}
+	if policy.PromptTimeout != env.PollPolicy.PromptTimeout || policy.MaxRetryDelay != env.PollPolicy.MaxRetryDelay {
+		t.Errorf("Expected the unset fields to keep the global values, got %+v", policy)
+	}
+}
+
+func TestReloadKeepsLastGood(t *testing.T) {
+	testCases := []struct {
+		name     string
+		mappings string
+		problem  string
+	}{
+		{"bad cidr", "networkMaps:\n  - network: 10.0.0/8\n    script:\n      name: test.ipxe\n", "10.0.0/8"},
+		{"bad regex", "hostnameMaps:\n  - hostname: node(\n    script:\n      name: test.ipxe\n", "node("},
+		{"unknown script", "networkMaps:\n  - network: 10.0.0.0/8\n    script:\n      name: missing.ipxe\n", "missing.ipxe"},
+		{"unknown environment", "networkMaps:\n  - network: 10.0.0.0/8\n    script:\n      name: test.ipxe\n      environment: prod\n", "prod"},
+		{"bad mac", "macMaps:\n  - mac: 52:54:0g\n    script:\n      name: test.ipxe\n", "52:54:0g"},
+		{"unknown attribute", "hardwareMaps:\n  - match:\n      color: red\n    script:\n      name: test.ipxe\n", "color"},
+		{"bad attribute regex", "hardwareMaps:\n  - match:\n      serial: abc(\n    script:\n      name: test.ipxe\n", "abc("},
+		{"empty hardware match", "hardwareMaps:\n  - script:\n      name: test.ipxe\n", "nothing to match"},
+		{"unknown mode", "networkMaps:\n  - network: 10.0.0.0/8\n    script:\n      name: test.ipxe\n      mode: twice\n", "twice"},
+		{"missing script", "networkMaps:\n  - network: 10.0.0.0/8\n    script:\n      mode: once\n", "10.0.0.0/8"},
+		{"poll policy without selector", "pollPolicies:\n  - maxRetries: 3\n", "missing network or environment"},
+		{"poll policy bad duration", "pollPolicies:\n  - network: 10.0.0.0/8\n    retryDelay: soon\n", "retryDelay"},
+		{"poll policy unknown fallback", "pollPolicies:\n  - network: 10.0.0.0/8\n    fallback: reboot\n", "reboot"},
+		{"poll policy unknown script", "pollPolicies:\n  - environment: staging\n    fallback: script\n    fallbackScript:\n      name: missing.ipxe\n", "missing.ipxe"},
+		{"poll policy unknown environment", "pollPolicies:\n  - environment: prod\n", "prod"},
+		{"bad yaml", "networkMaps: [", "mappings.yaml"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			env := testEnvironment(t)
+			if err := env.Reload("startup"); err != nil {
+				t.Fatal(err)
+			}
+			previous := env.Config()
+
+			writeFile(t, filepath.Join(env.DataDir, env.MappingsFile), tc.mappings)
+			err := env.Reload("mappings.yaml")
+			if err == nil || !strings.Contains(err.Error(), tc.problem) {
+				t.Fatalf("Expected an error mentioning %q, got %v", tc.problem, err)
+			}
+			if env.Config() != previous {
+				t.Error("Expected the previous configuration to stay in use")
+			}
+
+			events, _ := env.EventLog.Query(event.Filter{Types: []event.Type{event.ConfigReload}})
+			if len(events) != 2 || events[1].Params["status"] != "failure" {
+				t.Errorf("Expected a failed reload event, got %+v", events)
+			}
+		})
+	}
+}
+
+func TestReloadBrokenTemplate(t *testing.T) {
+	env := testEnvironment(t)
+	if err := env.Reload("startup"); err != nil {
+		t.Fatal(err)
+	}
+	previous := env.Config()
+
+	writeFile(t, filepath.Join(env.DataDir, "ipxe", "test.ipxe.slc"), "{{define \"test.ipxe\" -}}\nboot {{.x\n{{end}}\n")
+	if err := env.Reload("ipxe/test.ipxe.slc"); err == nil {
+		t.Fatal("Expected an error for a broken template")
+	}
+	if env.Config() != previous {
+		t.Error("Expected the previous configuration to stay in use")
+	}
+}
@@ -15,305 +15,579 @@
 package environment
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Didstopia/shoelaces/internal/auth"
+	"github.com/Didstopia/shoelaces/internal/certs"
+	"github.com/Didstopia/shoelaces/internal/dhcp"
 	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/inventory"
 	"github.com/Didstopia/shoelaces/internal/log"
 	"github.com/Didstopia/shoelaces/internal/mappings"
+	"github.com/Didstopia/shoelaces/internal/metrics"
+	"github.com/Didstopia/shoelaces/internal/notify"
+	"github.com/Didstopia/shoelaces/internal/polling"
+	"github.com/Didstopia/shoelaces/internal/proxy"
 	"github.com/Didstopia/shoelaces/internal/server"
-	"github.com/Didstopia/shoelaces/internal/templates"
-	"github.com/fsnotify/fsnotify"
+	"github.com/Didstopia/shoelaces/internal/stream"
+)
+
+const (
+	// eventsFile is the name of the event log file inside StateDir.
+	eventsFile = "events.jsonl"
+	// serversFile is the name of the server states file inside StateDir.
+	serversFile = "servers.json"
+	// inventoryFile is the name of the inventory file inside StateDir.
+	inventoryFile = "inventory.json"
 )
 
 // Environment struct holds the shoelaces instance global data.
 type Environment struct {
 	ConfigFile      string
-	HostnameMaps    []mappings.HostnameMap
-	NetworkMaps     []mappings.NetworkMap
 	ServerStates    *server.States
+	Inventory       *inventory.Inventory
 	EventLog        *event.Log
+	Stream          *stream.Broker // pushes changes to the UI
 	ParamsBlacklist []string
-	Templates       *templates.ShoelacesTemplates // Dynamic slc templates
-	StaticTemplates *template.Template            // Static Templates
-	Environments    []string                      // Valid config environments
+	StaticTemplates *template.Template // Static Templates
 	Logger          log.Logger
-
-	BindAddr          string
-	BaseURL           string
-	DataDir           string
-	StaticDir         string
-	EnvDir            string
-	TemplateExtension string
-	MappingsFile      string
-	Debug             bool
+	Auth            *auth.Authenticator // nil when authentication is disabled
+	Certificate     *certs.Certificate  // nil when HTTPS is disabled
+	ProxyDHCP       *dhcp.Server        // nil when ProxyDHCP is disabled
+	Proxies         proxy.Trusted       // parsed from TrustedProxies
+	Notifier        *notify.Notifier    // nil when no webhook is configured
+	PollPolicy      polling.Policy      // built from the poll flags
+
+	config   atomic.Value // *Config, see Config()
+	reloadMu sync.Mutex
+
+	BindAddr           string
+	TLSBindAddr        string
+	TLSCertFile        string
+	TLSKeyFile         string
+	TFTPAddr           string
+	TFTPDir            string
+	ProxyDHCPIP        string
+	ProxyDHCPAddrs     string
+	ProxyDHCPBIOSFile  string
+	ProxyDHCPEFIFile   string
+	ProxyDHCPARM64File string
+	BaseURL            string
+	BaseScheme         string
+	DataDir            string
+	StaticDir          string
+	EnvDir             string
+	TemplateExtension  string
+	MappingsFile       string
+	StateDir           string
+	EventsMaxPerMAC    int
+	EventsMaxTotal     int
+	AuthTokensFile     string
+	AuthHtpasswdFile   string
+	AuthClientCAFile   string
+	AuthOperators      string
+	WebhooksFile       string
+	TrustedProxies     string
+	ProxyProtocol      bool
+	TrustIPParam       bool
+	ShutdownTimeout    time.Duration
+	PollMaxRetries     int
+	PollPromptTimeout  time.Duration
+	PollRetryDelay     time.Duration
+	PollMaxRetryDelay  time.Duration
+	PollFallback       string
+	PollFallbackScript string
+	PollFallbackEnv    string
+	PollExpire         time.Duration
+	PollCleanInterval  time.Duration
+	LongPollTimeout    time.Duration
+	LogFormat          string
+	LogLevel           string
+	LogFile            string
+	LogMaxSize         int
+	LogMaxBackups      int
+	Debug              bool
 }
 
-// New returns an initialized environment structure
-func New() *Environment {
+// New returns an initialized environment structure. Its background tasks,
+// such as the state cleaner and the file watcher, run until ctx is done.
+func New(ctx context.Context) (*Environment, error) {
 	env := defaultEnvironment()
 	env.setFlags()
-	env.validateFlags()
+	if err := env.validateFlags(); err != nil {
+		return nil, err
+	}
 
-	if env.Debug {
-		env.Logger = log.AllowDebug(env.Logger)
+	if err := env.initLogger(); err != nil {
+		return nil, err
 	}
 
-	if env.BaseURL == "" {
-		env.BaseURL = env.BindAddr
+	if err := env.initTLS(); err != nil {
+		return nil, err
+	}
+	env.initBaseURL()
+
+	if !filepath.IsAbs(env.TFTPDir) {
+		env.TFTPDir = filepath.Join(env.DataDir, env.TFTPDir)
+	}
+
+	if err := env.initProxyDHCP(); err != nil {
+		return nil, err
 	}
 
-	env.Environments = env.initEnvOverrides()
+	if err := env.initAuth(); err != nil {
+		return nil, err
+	}
 
-	env.EventLog = &event.Log{}
+	proxies, err := proxy.ParseTrusted(env.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	env.Proxies = proxies
+	if env.ProxyProtocol && len(env.Proxies) == 0 {
+		return nil, errors.New("proxy-protocol requires trusted-proxies")
+	}
+	if env.TrustIPParam && len(env.Proxies) == 0 {
+		return nil, errors.New("trust-ip-param requires trusted-proxies")
+	}
 
-	env.Logger.Info("component", "environment", "msg", "Override found", "environment", env.Environments)
+	if err := env.initPollPolicy(); err != nil {
+		return nil, err
+	}
 
-	mappingsPath := path.Join(env.DataDir, env.MappingsFile)
-	if err := env.initMappings(mappingsPath); err != nil {
-		panic(err)
+	if err := env.initEventLog(); err != nil {
+		return nil, err
 	}
 
-	env.initStaticTemplates()
-	env.Templates.ParseTemplates(env.Logger, env.DataDir, env.EnvDir, env.Environments, env.TemplateExtension)
-	server.StartStateCleaner(env.Logger, env.ServerStates)
+	if err := env.initServerStates(); err != nil {
+		return nil, err
+	}
 
-	// FIXME: Pass in a context so we can cancel the goroutine and gracefully shut it down!
-	// go server.WatchStuff(env, env.Logger, env.DataDir, env.MappingsFile, env.initMappings)
-	go watchStuff(env)
+	if err := env.initInventory(); err != nil {
+		return nil, err
+	}
 
-	return env
+	env.initStream(ctx)
+	env.initMetrics()
+
+	if err := env.initNotifier(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := env.initStaticTemplates(); err != nil {
+		return nil, err
+	}
+
+	config, err := env.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	env.config.Store(config)
+	env.Logger.Info("component", "environment", "msg", "Configuration loaded", "summary", config.Summary(), "environments", strings.Join(config.Environments, ","))
+
+	server.StartStateCleaner(ctx, env.Logger, env.ServerStates, env.PollExpire, env.PollCleanInterval)
+	// Held polls go back to the retry loop when shutting down
+	go func() {
+		<-ctx.Done()
+		env.ServerStates.ReleaseWaits()
+	}()
+
+	go watchStuff(ctx, env)
+
+	return env, nil
+}
+
+// Close flushes the state of the environment to disk and releases the
+// files it holds.
+func (env *Environment) Close() error {
+	env.ServerStates.Lock()
+	err := env.ServerStates.Save()
+	env.ServerStates.Unlock()
+
+	if closeErr := env.EventLog.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 func defaultEnvironment() *Environment {
 	env := &Environment{}
-	env.NetworkMaps = make([]mappings.NetworkMap, 0)
-	env.HostnameMaps = make([]mappings.HostnameMap, 0)
-	// FIXME: This whatever the issue is with this warning?!
-	env.ServerStates = &server.States{sync.RWMutex{}, make(map[string]*server.State)}
-	env.ParamsBlacklist = []string{"baseURL"}
-	env.Templates = templates.New()
-	env.Environments = make([]string, 0)
+	env.ServerStates, _ = server.NewStates(nil)
+	env.Inventory, _ = inventory.New(nil)
+	env.Stream = stream.NewBroker()
+	env.ParamsBlacklist = []string{"baseURL", "baseScheme"}
+	env.PollPolicy = polling.DefaultPolicy
+	env.PollExpire = 3 * time.Minute
+	env.config.Store(emptyConfig())
 	env.Logger = log.MakeLogger(os.Stdout)
 
 	return env
 }
 
-func (env *Environment) initStaticTemplates() {
+// initLogger sets up the logger as the log flags say.
+func (env *Environment) initLogger() error {
+	if env.Debug {
+		env.LogLevel = log.LevelDebug
+	}
+
+	var w io.Writer = os.Stdout
+	if env.LogFile != "" {
+		f, err := log.OpenRotatingFile(env.LogFile, int64(env.LogMaxSize)<<20, env.LogMaxBackups)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	logger, err := log.New(w, env.LogFormat, env.LogLevel)
+	if err != nil {
+		return err
+	}
+	env.Logger = logger
+	return nil
+}
+
+func (env *Environment) initStaticTemplates() error {
 	staticTemplates := []string{
 		path.Join(env.StaticDir, "templates/html/header.html"),
 		path.Join(env.StaticDir, "templates/html/index.html"),
 		path.Join(env.StaticDir, "templates/html/events.html"),
 		path.Join(env.StaticDir, "templates/html/mappings.html"),
+		path.Join(env.StaticDir, "templates/html/inventory.html"),
 		path.Join(env.StaticDir, "templates/html/footer.html"),
 	}
 
-	fmt.Println(env.StaticDir)
-
 	for _, t := range staticTemplates {
 		if _, err := os.Stat(t); err != nil {
-			env.Logger.Error("component", "environment", "msg", "Template does not exists!", "environment", t)
-			os.Exit(1)
+			return fmt.Errorf("static template %s does not exist", t)
 		}
 	}
 
-	env.StaticTemplates = template.Must(template.ParseFiles(staticTemplates...))
+	t, err := template.ParseFiles(staticTemplates...)
+	if err != nil {
+		return err
+	}
+	env.StaticTemplates = t
+
+	return nil
 }
 
-func (env *Environment) initEnvOverrides() []string {
-	var environments = make([]string, 0)
-	envPath := filepath.Join(env.DataDir, env.EnvDir)
-	files, err := ioutil.ReadDir(envPath)
-	if err == nil {
-		for _, f := range files {
-			if f.IsDir() {
-				environments = append(environments, f.Name())
-			}
-		}
+func (env *Environment) initTLS() error {
+	if env.TLSCertFile == "" && env.TLSKeyFile == "" {
+		return nil
 	}
-	return environments
+	if env.TLSCertFile == "" || env.TLSKeyFile == "" {
+		return errors.New("both tls-cert and tls-key are required for serving HTTPS")
+	}
+
+	cert, err := certs.Load(env.TLSCertFile, env.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	env.Certificate = cert
+
+	return nil
 }
 
-func (env *Environment) initMappings(mappingsPath string) error {
-	configMappings := mappings.ParseYamlMappings(env.Logger, mappingsPath)
+// initBaseURL splits the scheme from the base URL, if any. Otherwise the
+// scheme is the one served on bind-addr.
+func (env *Environment) initBaseURL() {
+	if env.BaseURL == "" {
+		env.BaseURL = env.BindAddr
+	}
 
-	// Ensure env.NetworkMaps is empty
-	env.NetworkMaps = make([]mappings.NetworkMap, 0)
+	if i := strings.Index(env.BaseURL, "://"); i >= 0 {
+		env.BaseScheme = env.BaseURL[:i]
+		env.BaseURL = strings.TrimSuffix(env.BaseURL[i+3:], "/")
+	} else if env.ServesHTTPSOnly() {
+		env.BaseScheme = "https"
+	} else {
+		env.BaseScheme = "http"
+	}
+}
 
-	for _, configNetMap := range configMappings.NetworkMaps {
-		_, ipnet, err := net.ParseCIDR(configNetMap.Network)
-		if err != nil {
-			return err
-		}
+// ServesHTTPSOnly returns whether bind-addr serves HTTPS instead of HTTP.
+// That's the case when TLS is configured without a separate tls-bind-addr.
+func (env *Environment) ServesHTTPSOnly() bool {
+	return env.Certificate != nil && env.TLSBindAddr == ""
+}
 
-		netMap := mappings.NetworkMap{Network: ipnet, Script: initScript(configNetMap.Script)}
-		env.NetworkMaps = append(env.NetworkMaps, netMap)
+// TLSConfig returns the configuration for serving HTTPS. Client
+// certificates are verified when given, but not required, as booting
+// hosts usually don't have one.
+func (env *Environment) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: env.Certificate.GetCertificate,
+	}
+	if env.Auth != nil && env.Auth.ClientCAs != nil {
+		config.ClientCAs = env.Auth.ClientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
 	}
+	return config
+}
 
-	// Ensure env.HostnameMaps is empty
-	env.HostnameMaps = make([]mappings.HostnameMap, 0)
+// initProxyDHCP prepares the ProxyDHCP responder, which sends plain PXE
+// ROMs the iPXE binary for their architecture and iPXE clients the poll
+// URL.
+func (env *Environment) initProxyDHCP() error {
+	if env.ProxyDHCPIP == "" {
+		return nil
+	}
 
-	for _, configHostMap := range configMappings.HostnameMaps {
-		regex, err := regexp.Compile(configHostMap.Hostname)
-		if err != nil {
-			return err
-		}
+	ip := net.ParseIP(env.ProxyDHCPIP).To4()
+	if ip == nil {
+		return fmt.Errorf("proxydhcp-ip must be an IPv4 address, got %q", env.ProxyDHCPIP)
+	}
 
-		hostMap := mappings.HostnameMap{Hostname: regex, Script: initScript(configHostMap.Script)}
-		env.HostnameMaps = append(env.HostnameMaps, hostMap)
+	bootFiles := map[dhcp.Arch]string{
+		dhcp.ArchBIOS:     env.ProxyDHCPBIOSFile,
+		dhcp.ArchEFIBC:    env.ProxyDHCPEFIFile,
+		dhcp.ArchEFIx8664: env.ProxyDHCPEFIFile,
+		dhcp.ArchEFIARM64: env.ProxyDHCPARM64File,
 	}
+	script := env.BaseScheme + "://" + env.BaseURL + "/poll/1/${netX/mac:hexhyp}" + mappings.IPXEAttributesQuery
+	env.ProxyDHCP = dhcp.New(env.Logger, ip, bootFiles, script)
 
 	return nil
 }
 
-func initScript(configScript mappings.YamlScript) *mappings.Script {
-	mappingScript := &mappings.Script{
-		Name:        configScript.Name,
-		Environment: configScript.Environment,
-		Params:      make(map[string]interface{}),
+// ProxyDHCPListenAddrs returns the addresses the ProxyDHCP responder
+// listens on.
+func (env *Environment) ProxyDHCPListenAddrs() []string {
+	addrs := make([]string, 0)
+	for _, a := range strings.Split(env.ProxyDHCPAddrs, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
 	}
-	for key := range configScript.Params {
-		mappingScript.Params[key] = configScript.Params[key]
+	return addrs
+}
+
+func (env *Environment) initAuth() error {
+	// Client certificates are only requested over HTTPS, so without it
+	// nobody could authenticate with them.
+	if env.AuthClientCAFile != "" && env.Certificate == nil {
+		return errors.New("auth-client-ca requires tls-cert and tls-key")
 	}
 
-	return mappingScript
-}
+	operators := make([]string, 0)
+	for _, o := range strings.Split(env.AuthOperators, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			operators = append(operators, o)
+		}
+	}
 
-var validDataDirs = []string{
-	"cloud-config",
-	"env_overrides",
-	"ipxe",
-	"kickstart",
-	"preseed",
-	"static",
+	a, err := auth.New(auth.Config{
+		TokensFile:   env.AuthTokensFile,
+		HtpasswdFile: env.AuthHtpasswdFile,
+		ClientCAFile: env.AuthClientCAFile,
+		Operators:    operators,
+	})
+	if err != nil {
+		return err
+	}
+	if a != nil {
+		env.Logger.Info("component", "environment", "msg", "Authentication enabled", "operators", strings.Join(operators, ","))
+	}
+	env.Auth = a
+
+	return nil
 }
 
-func isValidDataDir(dir string) bool {
-	for _, validDir := range validDataDirs {
-		if strings.Contains(dir, "/"+validDir+"/") {
-			return true
-		}
+func (env *Environment) initEventLog() error {
+	retention := event.Retention{MaxPerMAC: env.EventsMaxPerMAC, MaxTotal: env.EventsMaxTotal}
+
+	if env.StateDir == "" {
+		env.EventLog = event.NewLog(env.Logger, event.NewMemoryStore(retention))
+		return nil
 	}
-	return false
+
+	if err := os.MkdirAll(env.StateDir, 0750); err != nil {
+		return err
+	}
+	eventsPath := filepath.Join(env.StateDir, eventsFile)
+	store, err := event.NewFileStore(eventsPath, retention)
+	if err != nil {
+		return err
+	}
+	env.Logger.Info("component", "environment", "msg", "Persisting events", "file", eventsPath)
+	env.EventLog = event.NewLog(env.Logger, store)
+
+	return nil
 }
 
-// FIXME: This only seems to work for mappings.yaml, but NOT for eg. foo.slc etc.
-//
-//	although I THINK this is because it's simply not recursive?
-//
-// TODO: Should this be in its own file instead?
-// func watchStuff(logger log.Logger, dataDir string, mappingsFile string, initMappings func(string) error) {
-func watchStuff(env *Environment) {
-	logger := env.Logger
-	dataDir := env.DataDir
-	mappingsFile := env.MappingsFile
-	// initMappings := env.InitMappings
-
-	watcher, err := fsnotify.NewWatcher()
+func (env *Environment) initServerStates() error {
+	if env.StateDir == "" {
+		return nil
+	}
+
+	serversPath := filepath.Join(env.StateDir, serversFile)
+	states, err := server.NewStates(server.NewFileStateStore(serversPath))
 	if err != nil {
-		logger.Error("Failed to create watcher: ", err)
-		os.Exit(1) // TODO: This probably doesn't allow us to do graceful shutdown?
+		return err
 	}
-	defer watcher.Close()
+	env.Logger.Info("component", "environment", "msg", "Persisting server states", "file", serversPath, "restored", len(states.Servers))
+	env.ServerStates = states
 
-	done := make(chan bool)
+	return nil
+}
+
+// initStream publishes the new events and the changes in the servers
+// waiting for a target, until ctx is done.
+func (env *Environment) initStream(ctx context.Context) {
+	env.EventLog.OnAdd(func(e event.Event) {
+		messageType := stream.EventMessage
+		if e.Type == event.ConfigReload {
+			messageType = stream.ReloadMessage
+		}
+		env.Stream.Publish(stream.Message{Type: messageType, Data: e})
+	})
+	env.ServerStates.OnChange(func(added, removed server.Servers) {
+		for _, srv := range added {
+			env.Stream.Publish(stream.Message{Type: stream.ServerAddedMessage, Data: srv})
+		}
+		for _, srv := range removed {
+			env.Stream.Publish(stream.Message{Type: stream.ServerRemovedMessage, Data: srv})
+		}
+	})
 
 	go func() {
-		defer close(done)
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-
-				// Log the file change event
-				logger.Debug("component", "watcher", "msg", "File changed", "file", event.Name, "type", event.Op)
-
-				// Check if the change was a write event
-				if event.Op&fsnotify.Write == fsnotify.Write {
-
-					// Check if the file is the mappings file
-					mappingsPath := path.Join(dataDir, mappingsFile)
-					if event.Name == mappingsPath {
-						// Mappings file changed, so we will attempt to reload all mappings
-						logger.Info("component", "watcher", "msg", "Mappings file changed, recreating mappings")
-						if err := env.initMappings(mappingsPath); err != nil {
-							logger.Error("component", "watcher", "msg", "Init mappings error:", err)
-							os.Exit(1) // TODO: This probably doesn't allow us to do graceful shutdown?
-						}
-						// Otherwise we check for the data directories and rebuild the templates if they change
-					} else if isValidDataDir(event.Name) {
-						// TODO: We probably need to reload more than just the ".slc" templates, eg. re-initializing env_overrides etc. ?
-						logger.Info("component", "watcher", "msg", "Data directory changed, rebuilding templates")
-						// TODO: Reload templates
-						env.Templates.ParseTemplates(env.Logger, env.DataDir, env.EnvDir, env.Environments, env.TemplateExtension)
-					} else {
-						logger.Info("component", "watcher", "msg", "Unknown change detected:", event.Name)
-					}
-				}
-
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				logger.Error("component", "watcher", "msg", "Watcher error:", err)
-				os.Exit(1) // TODO: This probably doesn't allow us to do graceful shutdown?
+		<-ctx.Done()
+		env.Stream.Close()
+	}()
+}
+
+// initMetrics makes the pending servers gauge count the servers waiting
+// for a target.
+func (env *Environment) initMetrics() {
+	metrics.PendingServers.Set(func() float64 {
+		env.ServerStates.RLock()
+		defer env.ServerStates.RUnlock()
+
+		pending := 0
+		for _, state := range env.ServerStates.Servers {
+			if state.Target == server.InitTarget {
+				pending++
 			}
 		}
-	}()
+		return float64(pending)
+	})
+}
 
-	// FIXME: fsnotify/watcher is NOT recursive, so we need to add every directory and subdirectory we want to watch,
-	//        which includes any newly created directories, but also removing any removed ones!
+// initNotifier sends the events to the webhooks configured in
+// WebhooksFile, until ctx is done.
+func (env *Environment) initNotifier(ctx context.Context) error {
+	if env.WebhooksFile == "" {
+		return nil
+	}
+
+	config, err := notify.LoadConfig(env.WebhooksFile)
+	if err != nil {
+		return err
+	}
+	notifier, err := notify.New(env.Logger, config)
+	if err != nil {
+		return fmt.Errorf("%s: %w", env.WebhooksFile, err)
+	}
+	env.Logger.Info("component", "environment", "msg", "Sending events to webhooks", "file", env.WebhooksFile, "webhooks", len(config.Webhooks))
 
-	// TODO: Do we even need to watch the data directory? Wouldn't watching mappings.yaml be enough?
-	// Watch the data directory
-	// if err := watcher.Add(env.DataDir); err != nil {
-	// 	env.Logger.Error("component", "watcher", "msg", "Failed to watch data directory:", err)
-	// 	os.Exit(1)
-	// }
+	notifier.Start(ctx)
+	env.EventLog.OnAdd(notifier.Notify)
+	env.Notifier = notifier
 
-	// Register the mappings file in the filesystem watcher
-	if err := watcher.Add(path.Join(dataDir, mappingsFile)); err != nil {
-		logger.Error("component", "watcher", "msg", "Failed to watch mappings file:", err)
-		os.Exit(1) // TODO: This probably doesn't allow us to do graceful shutdown?
+	return nil
+}
+
+func (env *Environment) initInventory() error {
+	if env.StateDir == "" {
+		return nil
 	}
 
-	// Register the cloud-config directory in the filesystem watcher
-	if err := watcher.Add(path.Join(dataDir, "cloud-config")); err != nil {
-		logger.Error("component", "watcher", "msg", "Failed to watch cloud-config directory:", err)
-		os.Exit(1) // TODO: This probably doesn't allow us to do graceful shutdown?
+	inventoryPath := filepath.Join(env.StateDir, inventoryFile)
+	inv, err := inventory.New(inventory.NewFileStore(inventoryPath))
+	if err != nil {
+		return err
 	}
+	env.Logger.Info("component", "environment", "msg", "Persisting inventory", "file", inventoryPath, "machines", len(inv.List()))
+	env.Inventory = inv
+
+	return nil
+}
 
-	// Register the env_overrides directory in the filesystem watcher
-	if err := watcher.Add(path.Join(dataDir, "env_overrides")); err != nil {
-		logger.Error("component", "watcher", "msg", "Failed to watch env_overrides directory:", err)
-		os.Exit(1) // TODO: This probably doesn't allow us to do graceful shutdown?
+func (env *Environment) initEnvOverrides() []string {
+	var environments = make([]string, 0)
+	envPath := filepath.Join(env.DataDir, env.EnvDir)
+	files, err := ioutil.ReadDir(envPath)
+	if err == nil {
+		for _, f := range files {
+			if f.IsDir() {
+				environments = append(environments, f.Name())
+			}
+		}
 	}
+	return environments
+}
 
-	// Register the ipxe directory in the filesystem watcher
-	if err := watcher.Add(path.Join(dataDir, "ipxe")); err != nil {
-		logger.Error("component", "watcher", "msg", "Failed to watch ipxe directory:", err)
-		os.Exit(1) // TODO: This probably doesn't allow us to do graceful shutdown?
+// initPollPolicy builds the global policy of the hosts waiting for a
+// target from the poll flags. Its fallback script is checked along with
+// the mappings, as it depends on the templates.
+func (env *Environment) initPollPolicy() error {
+	fallback, err := polling.ParseFallback(env.PollFallback)
+	if err != nil {
+		return fmt.Errorf("poll-fallback: %v", err)
+	}
+	if env.PollCleanInterval <= 0 {
+		return errors.New("poll-clean-interval must be positive")
 	}
 
-	// Register the preseed directory in the filesystem watcher
-	if err := watcher.Add(path.Join(dataDir, "preseed")); err != nil {
-		logger.Error("component", "watcher", "msg", "Failed to watch preseed directory:", err)
-		os.Exit(1) // TODO: This probably doesn't allow us to do graceful shutdown?
+	policy := polling.Policy{
+		MaxRetries:    env.PollMaxRetries,
+		PromptTimeout: env.PollPromptTimeout,
+		RetryDelay:    env.PollRetryDelay,
+		MaxRetryDelay: env.PollMaxRetryDelay,
+		Fallback:      fallback,
+	}
+	if env.PollFallbackScript != "" {
+		policy.FallbackScript = initScript(mappings.YamlScript{Name: env.PollFallbackScript, Environment: env.PollFallbackEnv})
 	}
+	if err := policy.Validate(env.PollExpire); err != nil {
+		return fmt.Errorf("invalid poll policy: %v", err)
+	}
+	if env.LongPollTimeout < 0 || env.LongPollTimeout >= env.PollExpire {
+		return fmt.Errorf("long-poll-timeout must be shorter than poll-expire (%v)", env.PollExpire)
+	}
+	env.PollPolicy = policy
+	return nil
+}
 
-	// TODO: No need to watch for the static directory, right?
+func initScript(configScript mappings.YamlScript) *mappings.Script {
+	mappingScript := &mappings.Script{
+		Name:        configScript.Name,
+		Environment: configScript.Environment,
+		Params:      make(map[string]interface{}),
+		Mode:        mappings.Mode(configScript.Mode),
+	}
+	if mappingScript.Mode == "" {
+		mappingScript.Mode = mappings.ModeAlways
+	}
+	for key := range configScript.Params {
+		mappingScript.Params[key] = configScript.Params[key]
+	}
 
-	// FIXME: We need a way to gracefully shut this down, passing in a context or channel for example?
-	logger.Info("component", "watcher", "msg", "Watching for changes...")
-	<-done
+	return mappingScript
 }
@@ -15,6 +15,7 @@
 package environment
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/Didstopia/shoelaces/internal/mappings"
@@ -25,10 +26,10 @@ func TestDefaultEnvironment(t *testing.T) {
 	if env.BaseURL != "" {
 		t.Error("BaseURL should be empty string if instantiated directly.")
 	}
-	if len(env.HostnameMaps) != 0 {
+	if len(env.Config().HostnameMaps) != 0 {
 		t.Error("Hostname mappings should be empty")
 	}
-	if len(env.NetworkMaps) != 0 {
+	if len(env.Config().NetworkMaps) != 0 {
 		t.Error("Network mappings should be empty")
 	}
 	if len(env.ParamsBlacklist) != 1 &&
@@ -59,3 +60,11 @@ func TestInitScript(t *testing.T) {
 		}
 	}
 }
+
+func TestInitAuthClientCAWithoutTLS(t *testing.T) {
+	env := defaultEnvironment()
+	env.AuthClientCAFile = "ca.pem"
+	if err := env.initAuth(); err == nil || !strings.Contains(err.Error(), "auth-client-ca requires tls-cert and tls-key") {
+		t.Errorf("Expected client certificates without HTTPS to be refused, got %v", err)
+	}
+}
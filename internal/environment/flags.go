@@ -15,8 +15,9 @@
 package environment
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"time"
 
 	"github.com/namsral/flag"
 )
@@ -24,18 +25,55 @@ import (
 func (env *Environment) setFlags() {
 	flag.StringVar(&env.ConfigFile, "config", "", "My config file")
 	flag.StringVar(&env.BindAddr, "bind-addr", "localhost:8081", "The address where I'm going to listen")
-	flag.StringVar(&env.BaseURL, "base-url", "", "The base shoelaces URL. If it's not defined, it will default to bind-addr.")
+	flag.StringVar(&env.TLSBindAddr, "tls-bind-addr", "", "An additional address for serving HTTPS. If it's not defined, bind-addr serves HTTPS when TLS is configured.")
+	flag.StringVar(&env.TLSCertFile, "tls-cert", "", "PEM certificate file for serving HTTPS")
+	flag.StringVar(&env.TLSKeyFile, "tls-key", "", "PEM private key file for serving HTTPS")
+	flag.StringVar(&env.TFTPAddr, "tftp-addr", "", "The address where the built-in TFTP server listens, e.g. :69. If it's not defined, the TFTP server is disabled.")
+	flag.StringVar(&env.TFTPDir, "tftp-dir", "tftp", "Directory with the files served over TFTP, relative to data-dir")
+	flag.StringVar(&env.ProxyDHCPIP, "proxydhcp-ip", "", "IPv4 address announced to PXE clients as TFTP server by the ProxyDHCP responder. If it's not defined, ProxyDHCP is disabled.")
+	flag.StringVar(&env.ProxyDHCPAddrs, "proxydhcp-addrs", ":67,:4011", "Comma separated list of addresses where the ProxyDHCP responder listens")
+	flag.StringVar(&env.ProxyDHCPBIOSFile, "proxydhcp-bios-file", "undionly.kpxe", "iPXE binary sent to BIOS PXE clients")
+	flag.StringVar(&env.ProxyDHCPEFIFile, "proxydhcp-efi-file", "ipxe.efi", "iPXE binary sent to x86-64 UEFI PXE clients")
+	flag.StringVar(&env.ProxyDHCPARM64File, "proxydhcp-arm64-file", "", "iPXE binary sent to ARM64 UEFI PXE clients")
+	flag.StringVar(&env.BaseURL, "base-url", "", "The base shoelaces URL, optionally prefixed by http:// or https://. If it's not defined, it will default to bind-addr.")
 	flag.StringVar(&env.DataDir, "data-dir", "", "Directory with mappings, configs, templates, etc.")
 	flag.StringVar(&env.StaticDir, "static-dir", "web", "A custom web directory with static files")
 	flag.StringVar(&env.EnvDir, "env-dir", "env_overrides", "Directory with overrides")
 	flag.StringVar(&env.TemplateExtension, "template-extension", ".slc", "Shoelaces template extension")
 	flag.StringVar(&env.MappingsFile, "mappings-file", "mappings.yaml", "My mappings YAML file")
-	flag.BoolVar(&env.Debug, "debug", false, "Debug mode")
+	flag.StringVar(&env.StateDir, "state-dir", "", "Directory where the event log, the booting servers state and the inventory are persisted. If it's not defined, state is kept in memory only.")
+	flag.IntVar(&env.EventsMaxPerMAC, "events-max-per-mac", 100, "Maximum number of events kept per MAC address (0 means unlimited)")
+	flag.IntVar(&env.EventsMaxTotal, "events-max-total", 10000, "Maximum number of events kept in total (0 means unlimited)")
+	flag.StringVar(&env.AuthTokensFile, "auth-tokens-file", "", "File with one \"<viewer|operator> <token>\" bearer token per line")
+	flag.StringVar(&env.AuthHtpasswdFile, "auth-htpasswd-file", "", "htpasswd file for HTTP basic authentication (MD5 or SHA-1 hashes)")
+	flag.StringVar(&env.AuthClientCAFile, "auth-client-ca", "", "PEM file with the CAs trusted for client certificates (requires HTTPS)")
+	flag.StringVar(&env.AuthOperators, "auth-operators", "", "Comma separated list of users and certificate common names with the operator role")
+	flag.StringVar(&env.WebhooksFile, "webhooks-file", "", "YAML file with the webhooks notified of the events, like Slack or Mattermost incoming webhooks")
+	flag.StringVar(&env.TrustedProxies, "trusted-proxies", "", "Comma separated list of CIDRs and addresses of the reverse proxies and load balancers trusted to report the address of their clients")
+	flag.BoolVar(&env.ProxyProtocol, "proxy-protocol", false, "Accept the PROXY protocol from trusted-proxies")
+	flag.BoolVar(&env.TrustIPParam, "trust-ip-param", false, "Use the ip query parameter sent by iPXE through trusted-proxies as the address of the polling hosts")
+	flag.IntVar(&env.PollMaxRetries, "poll-max-retries", 10, "Number of times hosts without a target are told to poll again before falling back")
+	flag.DurationVar(&env.PollPromptTimeout, "poll-prompt-timeout", 10*time.Second, "How long hosts without a target offer the menu with Ctrl-B before polling again (0 disables the prompt)")
+	flag.DurationVar(&env.PollRetryDelay, "poll-retry-delay", 0, "How long hosts without a target sleep before polling again, doubling with every retry")
+	flag.DurationVar(&env.PollMaxRetryDelay, "poll-max-retry-delay", time.Minute, "Longest delay between the polls of hosts without a target")
+	flag.StringVar(&env.PollFallback, "poll-fallback", "exit", "What hosts boot when they are done retrying: exit, local-boot, script or wait (retry until a target is chosen)")
+	flag.StringVar(&env.PollFallbackScript, "poll-fallback-script", "", "Script booted by the script fallback")
+	flag.StringVar(&env.PollFallbackEnv, "poll-fallback-environment", "", "Environment of poll-fallback-script")
+	flag.DurationVar(&env.PollExpire, "poll-expire", 3*time.Minute, "How long hosts without a target are remembered after their last poll")
+	flag.DurationVar(&env.PollCleanInterval, "poll-clean-interval", time.Minute, "How often forgotten hosts are removed")
+	flag.DurationVar(&env.LongPollTimeout, "long-poll-timeout", 0, "How long the polls of hosts without a target are held, answering as soon as a target is chosen (0 disables long polling)")
+	flag.DurationVar(&env.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for requests and transfers in progress when shutting down")
+	flag.StringVar(&env.LogFormat, "log-format", "logfmt", "Format of the log: logfmt or json")
+	flag.StringVar(&env.LogLevel, "log-level", "info", "Minimum level of the logged lines: debug, info or error")
+	flag.StringVar(&env.LogFile, "log-file", "", "File where the log is written. If it's not defined, the log goes to the standard output.")
+	flag.IntVar(&env.LogMaxSize, "log-max-size", 100, "Size in megabytes at which log-file is rotated (0 means never)")
+	flag.IntVar(&env.LogMaxBackups, "log-max-backups", 5, "Number of rotated log files kept")
+	flag.BoolVar(&env.Debug, "debug", false, "Debug mode, same as log-level=debug")
 
 	flag.Parse()
 }
 
-func (env *Environment) validateFlags() {
+func (env *Environment) validateFlags() error {
 	error := false
 
 	if env.DataDir == "" {
@@ -52,6 +90,8 @@ func (env *Environment) validateFlags() {
 		fmt.Println("\nAvailable parameters:")
 		flag.PrintDefaults()
 		fmt.Println("\nParameters can be specified as environment variables, arguments or in a config file.")
-		os.Exit(1)
+		return errors.New("missing required parameters")
 	}
+
+	return nil
 }
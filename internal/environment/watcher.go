@@ -0,0 +1,217 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package environment
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long the watcher waits for changes to settle before
+// reloading, so a burst of events, like the ones caused by a git checkout,
+// results in a single reload.
+const watchDebounce = 500 * time.Millisecond
+
+// configWatcher watches the whole data directory, adding and removing
+// subdirectories as they come and go, since fsnotify isn't recursive.
+type configWatcher struct {
+	env     *Environment
+	watcher *fsnotify.Watcher
+	dirs    map[string]bool
+	pending []string
+}
+
+// watchStuff reloads the configuration and the TLS certificate when they
+// change, until ctx is done.
+func watchStuff(ctx context.Context, env *Environment) {
+	logger := env.Logger
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("component", "watcher", "msg", "Failed to create watcher, changes won't be reloaded", "err", err)
+		return
+	}
+	defer watcher.Close()
+
+	w := &configWatcher{env: env, watcher: watcher, dirs: make(map[string]bool)}
+	w.addTree(filepath.Clean(env.DataDir))
+	if env.Certificate != nil {
+		for _, dir := range env.Certificate.Dirs() {
+			if err := watcher.Add(dir); err != nil {
+				logger.Error("component", "watcher", "msg", "Failed to watch TLS certificate directory", "dir", dir, "err", err)
+			}
+		}
+	}
+
+	logger.Info("component", "watcher", "msg", "Watching for changes...", "dir", env.DataDir, "dirs", len(w.dirs))
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-reload:
+			reload = nil
+			env.Reload(w.describePending())
+			w.pending = w.pending[:0]
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if w.handle(event) {
+				reload = time.After(watchDebounce)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error("component", "watcher", "msg", "Watcher error", "err", err)
+		}
+	}
+}
+
+// handle processes a file system event and returns whether it requires
+// reloading the configuration.
+func (w *configWatcher) handle(event fsnotify.Event) bool {
+	env := w.env
+	logger := env.Logger
+
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	logger.Debug("component", "watcher", "msg", "File changed", "file", event.Name, "type", event.Op)
+
+	// Reload the TLS certificate when it's renewed
+	if env.Certificate != nil && env.Certificate.IsFile(event.Name) {
+		if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+			if err := env.Certificate.Reload(); err != nil {
+				logger.Error("component", "watcher", "msg", "Failed to reload TLS certificate", "err", err)
+			} else {
+				logger.Info("component", "watcher", "msg", "TLS certificate reloaded", "file", event.Name)
+			}
+		}
+		return false
+	}
+
+	if w.ignored(event.Name) {
+		return false
+	}
+
+	changed := env.isConfigFile(event.Name)
+
+	// New directories are watched too. Their files may have been created
+	// before the watch was in place, so they always trigger a reload.
+	if event.Op&fsnotify.Create != 0 {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			w.addTree(event.Name)
+			changed = true
+		}
+	}
+
+	// Files inside a directory that's moved away don't get their own
+	// events, so removing a watched directory always triggers a reload.
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && w.dirs[event.Name] {
+		w.removeTree(event.Name)
+		changed = true
+	}
+
+	if !changed {
+		return false
+	}
+
+	logger.Info("component", "watcher", "msg", "Configuration changed", "file", event.Name, "type", event.Op)
+	rel, err := filepath.Rel(env.DataDir, event.Name)
+	if err != nil {
+		rel = event.Name
+	}
+	for _, p := range w.pending {
+		if p == rel {
+			return true
+		}
+	}
+	w.pending = append(w.pending, rel)
+	return true
+}
+
+// addTree watches dir and all its subdirectories.
+func (w *configWatcher) addTree(dir string) {
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if p != dir && w.ignored(p) {
+			return filepath.SkipDir
+		}
+		if err := w.watcher.Add(p); err != nil {
+			w.env.Logger.Error("component", "watcher", "msg", "Failed to watch directory", "dir", p, "err", err)
+			return nil
+		}
+		w.dirs[p] = true
+		return nil
+	})
+}
+
+// removeTree forgets dir and all its subdirectories.
+func (w *configWatcher) removeTree(dir string) {
+	for p := range w.dirs {
+		if p == dir || strings.HasPrefix(p, dir+string(filepath.Separator)) {
+			// The watch is already gone when the directory was deleted.
+			w.watcher.Remove(p)
+			delete(w.dirs, p)
+		}
+	}
+}
+
+// ignored returns whether changes in p are irrelevant, like the ones in
+// hidden files and directories, such as .git, or in the TFTP directory.
+func (w *configWatcher) ignored(p string) bool {
+	if strings.HasPrefix(filepath.Base(p), ".") {
+		return true
+	}
+	tftpDir := filepath.Clean(w.env.TFTPDir)
+	return w.env.TFTPDir != "" && (p == tftpDir || strings.HasPrefix(p, tftpDir+string(filepath.Separator)))
+}
+
+func (w *configWatcher) describePending() string {
+	switch len(w.pending) {
+	case 0:
+		return w.env.DataDir
+	case 1:
+		return w.pending[0]
+	default:
+		return fmt.Sprintf("%s and %d more", w.pending[0], len(w.pending)-1)
+	}
+}
+
+// isConfigFile returns whether p is part of the configuration: the
+// mappings file, a template or an environment override directory.
+func (env *Environment) isConfigFile(p string) bool {
+	if p == filepath.Join(env.DataDir, env.MappingsFile) {
+		return true
+	}
+	if strings.HasSuffix(p, env.TemplateExtension) {
+		return true
+	}
+	return filepath.Dir(p) == filepath.Join(env.DataDir, env.EnvDir)
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package environment
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/utils"
+)
+
+// startWatcher loads the configuration of env and watches it until the
+// test ends.
+func startWatcher(t *testing.T, env *Environment) {
+	t.Helper()
+	if err := env.Reload("startup"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchStuff(ctx, env)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	// Give the watcher time to add its watches
+	time.Sleep(100 * time.Millisecond)
+}
+
+func reloadEvents(t *testing.T, env *Environment) []event.Event {
+	t.Helper()
+	events, err := env.EventLog.Query(event.Filter{Types: []event.Type{event.ConfigReload}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWatcherNewEnvironment(t *testing.T) {
+	env := testEnvironment(t)
+	startWatcher(t, env)
+
+	writeFile(t, filepath.Join(env.DataDir, env.EnvDir, "production", "ipxe", "prod.ipxe.slc"), "{{define \"prod.ipxe\" -}}\nboot\n{{end}}\n")
+
+	waitFor(t, "the production environment", func() bool {
+		config := env.Config()
+		return utils.StringInSlice("production", config.Environments) && config.Templates.HasTemplate("prod.ipxe", "production")
+	})
+
+	// Templates added to the new environment later are picked up too, as
+	// its directories are watched now.
+	writeFile(t, filepath.Join(env.DataDir, env.EnvDir, "production", "ipxe", "late.ipxe.slc"), "{{define \"late.ipxe\" -}}\nboot\n{{end}}\n")
+	waitFor(t, "the late template", func() bool {
+		return env.Config().Templates.HasTemplate("late.ipxe", "production")
+	})
+
+	if err := os.RemoveAll(filepath.Join(env.DataDir, env.EnvDir, "production")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the production environment to go away", func() bool {
+		return !utils.StringInSlice("production", env.Config().Environments)
+	})
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	env := testEnvironment(t)
+	startWatcher(t, env)
+
+	for i := 0; i < 10; i++ {
+		writeFile(t, filepath.Join(env.DataDir, "ipxe", fmt.Sprintf("burst%d.ipxe.slc", i)), fmt.Sprintf("{{define \"burst%d.ipxe\" -}}\nboot\n{{end}}\n", i))
+	}
+	writeFile(t, filepath.Join(env.DataDir, ".git", "index"), "ignored")
+
+	waitFor(t, "the reload", func() bool {
+		return len(reloadEvents(t, env)) > 1
+	})
+	time.Sleep(2 * watchDebounce)
+
+	events := reloadEvents(t, env)
+	if len(events) != 2 {
+		t.Fatalf("Expected a single reload after the startup one, got %d", len(events)-1)
+	}
+	if source := events[1].Params["source"]; source != "ipxe/burst0.ipxe.slc and 9 more" {
+		t.Errorf("Unexpected reload source %q", source)
+	}
+	if !env.Config().Templates.HasTemplate("burst9.ipxe", "") {
+		t.Error("Expected every new template to be loaded")
+	}
+}
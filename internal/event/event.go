@@ -16,8 +16,14 @@ package event
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/Didstopia/shoelaces/internal/log"
 	"github.com/Didstopia/shoelaces/internal/server"
 )
 
@@ -34,15 +40,70 @@ const (
 	// HostTimeout is the event generated when a host polls and after some
 	// minutes without activity, timeouts.
 	HostTimeout Type = 3
+	// ConfigReload is the event generated when the mappings and templates
+	// are reloaded, successfully or not. It isn't related to any host.
+	ConfigReload Type = 4
+	// InstallStarted is the event generated when an installer reports that
+	// it started.
+	InstallStarted Type = 5
+	// InstallProgress is the event generated when an installer reports its
+	// progress.
+	InstallProgress Type = 6
+	// InstallSuccess is the event generated when an installer reports that
+	// it finished successfully.
+	InstallSuccess Type = 7
+	// InstallFailure is the event generated when an installer reports that
+	// it failed.
+	InstallFailure Type = 8
 
+	// InventoryBoot is triggered when a host is found in the inventory
+	InventoryBoot = "Inventory"
+	// MACMatchBoot is triggered when a MAC matches a MAC mapping
+	MACMatchBoot = "MAC Match"
+	// HardwareMatchBoot is triggered when the attributes reported by iPXE
+	// match a hardware mapping
+	HardwareMatchBoot = "Hardware Match"
 	// PtrMatchBoot is triggered when a PTR is matched to an IP
 	PtrMatchBoot = "DNS Match"
 	// SubnetMatchBoot is triggered when an IP matches a subnet mapping
 	SubnetMatchBoot = "Subnet Match"
 	// ManualBoot is triggered when the user selects manual boot
 	ManualBoot = "Manual"
+	// FallbackBoot is triggered when a host stops waiting for a target and
+	// boots the fallback script of its policy
+	FallbackBoot = "Fallback"
 )
 
+var typeNames = map[Type]string{
+	HostPoll:        "host-poll",
+	UserSelection:   "user-selection",
+	HostBoot:        "host-boot",
+	HostTimeout:     "host-timeout",
+	ConfigReload:    "config-reload",
+	InstallStarted:  "install-started",
+	InstallProgress: "install-progress",
+	InstallSuccess:  "install-success",
+	InstallFailure:  "install-failure",
+}
+
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
+
+// ParseType receives either the name or the number of an event type and
+// returns the matching Type.
+func ParseType(s string) (Type, error) {
+	for t, name := range typeNames {
+		if s == name || s == strconv.Itoa(int(t)) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown event type %q", s)
+}
+
 // Event holds information related to the interactions of hosts when they boot.
 // It's used exclusively in the Shoelaces web frontend.
 type Event struct {
@@ -53,11 +114,54 @@ type Event struct {
 	Script   string                 `json:"script"`
 	Message  string                 `json:"message"`
 	Params   map[string]interface{} `json:"params"`
+	// RequestID is the ID of the HTTP request that caused the event, if
+	// any.
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Filter selects events by MAC address, type and date. Zero values match
+// every event.
+type Filter struct {
+	Mac   string
+	Types []Type
+	Since time.Time
+	Until time.Time
+}
+
+// Match returns whether the event is selected by the filter.
+func (f Filter) Match(e Event) bool {
+	if f.Mac != "" && e.Server.Mac != f.Mac {
+		return false
+	}
+	if !f.Since.IsZero() && e.Date.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Date.After(f.Until) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if e.Type == t {
+			return true
+		}
+	}
+	return false
 }
 
-// Log holds the events log
+// Log holds the events log. The events are kept in a Store, which defaults
+// to an unbounded MemoryStore when none is given.
 type Log struct {
-	Events map[string][]Event
+	mu     sync.Mutex
+	logger log.Logger
+	store  Store
+	onAdd  []func(Event)
+}
+
+// NewLog returns a Log backed by the given Store.
+func NewLog(logger log.Logger, store Store) *Log {
+	return &Log{logger: logger, store: store}
 }
 
 // New creates a new Event object
@@ -87,14 +191,146 @@ func (e *Event) setMessage() {
 		e.Message = "Host " + e.Server.Hostname + " booted using " + e.BootType + " method with the following parameters: " + string(params)
 	case HostTimeout:
 		e.Message = "Host " + e.Server.Hostname + " timed out."
+		if fallback, _ := e.Params["fallback"].(string); fallback != "" {
+			e.Message = "Host " + e.Server.Hostname + " timed out waiting for a target, falling back to " + fallback + "."
+		}
+	case ConfigReload:
+		source, _ := e.Params["source"].(string)
+		if reason, failed := e.Params["error"].(string); failed {
+			e.Message = "Reloading the configuration after a change in " + source + " failed, the previous one is still in use: " + reason
+		} else {
+			summary, _ := e.Params["summary"].(string)
+			e.Message = "Configuration reloaded after a change in " + source + ": " + summary + "."
+		}
+	case InstallStarted:
+		e.Message = "Host " + e.Server.Hostname + " started installing" + e.reportedMessage()
+	case InstallProgress:
+		e.Message = "Host " + e.Server.Hostname + " reported progress" + e.reportedMessage()
+	case InstallSuccess:
+		e.Message = "Host " + e.Server.Hostname + " finished installing" + e.reportedMessage()
+		if localBoot, _ := e.Params["localBoot"].(bool); localBoot {
+			e.Message += " It boots from its local disk from now on."
+		}
+	case InstallFailure:
+		e.Message = "Host " + e.Server.Hostname + " failed installing" + e.reportedMessage()
+	}
+}
+
+// reportedMessage returns the message sent by an installer along with its
+// report, if any, ending the sentence.
+func (e *Event) reportedMessage() string {
+	if message, _ := e.Params["message"].(string); message != "" {
+		return ": " + message + "."
 	}
+	return "."
 }
 
 // AddEvent adds an Event into the event log
 func (el *Log) AddEvent(eventType Type, srv server.Server, bootType string, script string, params map[string]interface{}) {
-	if el.Events == nil {
-		el.Events = make(map[string][]Event)
+	el.add(New(eventType, srv, bootType, script, params))
+}
+
+// Recorder adds events to a log.
+type Recorder interface {
+	AddEvent(eventType Type, srv server.Server, bootType string, script string, params map[string]interface{})
+}
+
+// ForRequest returns a Recorder adding events to the log with the ID of
+// the HTTP request causing them.
+func (el *Log) ForRequest(requestID string) Recorder {
+	return requestRecorder{log: el, requestID: requestID}
+}
+
+type requestRecorder struct {
+	log       *Log
+	requestID string
+}
+
+func (r requestRecorder) AddEvent(eventType Type, srv server.Server, bootType string, script string, params map[string]interface{}) {
+	e := New(eventType, srv, bootType, script, params)
+	e.RequestID = r.requestID
+	r.log.add(e)
+}
+
+// AddReloadEvent records a reload of the configuration triggered by a
+// change in source. A non nil err means the reload failed and the
+// previous configuration is still in use.
+func (el *Log) AddReloadEvent(source, summary string, err error) {
+	params := map[string]interface{}{"source": source, "status": "success"}
+	if err != nil {
+		params["status"] = "failure"
+		params["error"] = err.Error()
+	} else {
+		params["summary"] = summary
+	}
+	el.add(New(ConfigReload, server.Server{}, "", "", params))
+}
+
+// OnAdd adds a function called with every event added to the log. It's
+// called in the order the events are added, so it must not block.
+func (el *Log) OnAdd(fn func(Event)) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	el.onAdd = append(el.onAdd, fn)
+}
+
+func (el *Log) add(e Event) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	if el.store == nil {
+		el.store = NewMemoryStore(Retention{})
+	}
+
+	if err := el.store.Append(e); err != nil {
+		el.logger.Error("component", "event", "msg", "Failed to store event", "mac", e.Server.Mac, "type", e.Type, "err", err)
+	}
+	for _, fn := range el.onAdd {
+		fn(e)
+	}
+}
+
+// ListEvents returns the logged events grouped by MAC address.
+func (el *Log) ListEvents() (map[string][]Event, error) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	if el.store == nil {
+		return make(map[string][]Event), nil
+	}
+	return el.store.Events()
+}
+
+// Close releases the underlying Store, if it holds any resource.
+func (el *Log) Close() error {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	if c, ok := el.store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Query returns the events selected by the filter, sorted by date.
+func (el *Log) Query(f Filter) ([]Event, error) {
+	grouped, err := el.ListEvents()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]Event, 0)
+	for _, macEvents := range grouped {
+		for _, e := range macEvents {
+			if f.Match(e) {
+				events = append(events, e)
+			}
+		}
 	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Date.Before(events[j].Date)
+	})
 
-	el.Events[srv.Mac] = append(el.Events[srv.Mac], New(eventType, srv, bootType, script, params))
+	return events, nil
 }
@@ -16,9 +16,12 @@ package event
 
 import (
 	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"testing"
 	"time"
 
+	"github.com/Didstopia/shoelaces/internal/log"
 	"github.com/Didstopia/shoelaces/internal/server"
 )
 
@@ -70,3 +73,62 @@ func TestEventMarshalJSON(t *testing.T) {
 		t.Errorf("Expected %s\nGot: %s\n", expectedEvent, marshaled)
 	}
 }
+
+func TestAddReloadEvent(t *testing.T) {
+	el := NewLog(log.MakeLogger(ioutil.Discard), nil)
+	el.AddReloadEvent("mappings.yaml", "2 network mappings", nil)
+	el.AddReloadEvent("ipxe/broken.ipxe.slc", "", errors.New("unexpected EOF"))
+
+	events, err := el.Query(Filter{Types: []Type{ConfigReload}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 reload events, got %d", len(events))
+	}
+	if events[0].Params["status"] != "success" || events[1].Params["status"] != "failure" {
+		t.Errorf("Unexpected statuses: %v, %v", events[0].Params["status"], events[1].Params["status"])
+	}
+	if events[1].Params["error"] != "unexpected EOF" {
+		t.Errorf("Expected the error to be recorded, got %v", events[1].Params["error"])
+	}
+	if events[0].Message == "" || events[1].Message == "" {
+		t.Error("Expected reload events to have a message")
+	}
+}
+
+func TestForRequest(t *testing.T) {
+	el := NewLog(log.MakeLogger(ioutil.Discard), nil)
+	el.ForRequest("4bf92f35").AddEvent(HostPoll, server.Server{Mac: "52:54:00:aa:bb:cc"}, "", "", nil)
+	el.AddEvent(HostTimeout, server.Server{Mac: "52:54:00:aa:bb:cc"}, "", "", nil)
+
+	events, err := el.Query(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].RequestID != "4bf92f35" || events[1].RequestID != "" {
+		t.Errorf("Expected only the first event to have a request ID, got %+v", events)
+	}
+}
+
+func TestInstallEvents(t *testing.T) {
+	srv := server.Server{Mac: "52:54:00:aa:bb:cc", IP: "10.0.0.1", Hostname: "node1"}
+	testCases := []struct {
+		eventType Type
+		params    map[string]interface{}
+		want      string
+	}{
+		{InstallStarted, map[string]interface{}{"phase": "started"}, "Host node1 started installing."},
+		{InstallProgress, map[string]interface{}{"phase": "progress", "message": "partitioning"}, "Host node1 reported progress: partitioning."},
+		{InstallSuccess, map[string]interface{}{"phase": "success", "localBoot": true}, "Host node1 finished installing. It boots from its local disk from now on."},
+		{InstallFailure, map[string]interface{}{"phase": "failure", "message": "no disk", "log": "..."}, "Host node1 failed installing: no disk."},
+	}
+	for _, tc := range testCases {
+		if e := New(tc.eventType, srv, "", "", tc.params); e.Message != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.eventType, tc.want, e.Message)
+		}
+		if parsed, err := ParseType(tc.eventType.String()); err != nil || parsed != tc.eventType {
+			t.Errorf("%s: failed to parse its name: %v", tc.eventType, err)
+		}
+	}
+}
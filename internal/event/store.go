@@ -0,0 +1,228 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// minCompactLines is the minimum amount of stale lines a FileStore
+// accumulates before rewriting its file.
+const minCompactLines = 100
+
+// Store is the storage backend of a Log.
+type Store interface {
+	// Append records an event.
+	Append(e Event) error
+	// Events returns the recorded events grouped by MAC address, oldest
+	// first.
+	Events() (map[string][]Event, error)
+}
+
+// Retention holds the limits on how many events a Store keeps. A zero
+// value means no limit. When a limit is exceeded the oldest events are
+// dropped first.
+type Retention struct {
+	MaxPerMAC int
+	MaxTotal  int
+}
+
+// MemoryStore keeps the events in memory only.
+type MemoryStore struct {
+	retention Retention
+	events    []Event
+	perMAC    map[string]int
+}
+
+// NewMemoryStore returns an empty MemoryStore applying the given retention.
+func NewMemoryStore(retention Retention) *MemoryStore {
+	return &MemoryStore{
+		retention: retention,
+		events:    make([]Event, 0),
+		perMAC:    make(map[string]int),
+	}
+}
+
+// Append adds an event to the store, dropping old events if any of the
+// retention limits is exceeded.
+func (m *MemoryStore) Append(e Event) error {
+	m.add(e)
+	return nil
+}
+
+// add appends an event and returns how many events were dropped to honor
+// the retention limits.
+func (m *MemoryStore) add(e Event) (dropped int) {
+	mac := e.Server.Mac
+	m.events = append(m.events, e)
+	m.perMAC[mac]++
+
+	if m.retention.MaxPerMAC > 0 && m.perMAC[mac] > m.retention.MaxPerMAC {
+		for i := range m.events {
+			if m.events[i].Server.Mac == mac {
+				m.events = append(m.events[:i], m.events[i+1:]...)
+				m.perMAC[mac]--
+				dropped++
+				break
+			}
+		}
+	}
+
+	for m.retention.MaxTotal > 0 && len(m.events) > m.retention.MaxTotal {
+		oldest := m.events[0].Server.Mac
+		m.events = m.events[1:]
+		if m.perMAC[oldest]--; m.perMAC[oldest] == 0 {
+			delete(m.perMAC, oldest)
+		}
+		dropped++
+	}
+
+	return dropped
+}
+
+// Events returns the stored events grouped by MAC address.
+func (m *MemoryStore) Events() (map[string][]Event, error) {
+	grouped := make(map[string][]Event)
+	for _, e := range m.events {
+		grouped[e.Server.Mac] = append(grouped[e.Server.Mac], e)
+	}
+	return grouped, nil
+}
+
+// FileStore keeps the events in an append-only JSON lines file, so the
+// event history survives restarts. The retained events are also cached in
+// memory, and the file is compacted once enough dropped events pile up.
+type FileStore struct {
+	path  string
+	file  *os.File
+	cache *MemoryStore
+	stale int
+}
+
+// NewFileStore opens, or creates, the file at path and loads the events
+// found in it, applying the given retention.
+func NewFileStore(path string, retention Retention) (*FileStore, error) {
+	fs := &FileStore{
+		path:  path,
+		cache: NewMemoryStore(retention),
+	}
+
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+	if err := fs.compact(); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func (fs *FileStore) load() error {
+	fh, err := os.Open(fs.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Event
+		// Skip lines that can't be decoded, e.g. a partial write on crash.
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		fs.cache.add(e)
+	}
+	return scanner.Err()
+}
+
+// Append writes the event to the file and the in-memory cache.
+func (fs *FileStore) Append(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	fs.stale += fs.cache.add(e)
+	if _, err := fs.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	if fs.stale >= minCompactLines && fs.stale >= len(fs.cache.events) {
+		return fs.compact()
+	}
+	return nil
+}
+
+// Events returns the retained events grouped by MAC address.
+func (fs *FileStore) Events() (map[string][]Event, error) {
+	return fs.cache.Events()
+}
+
+// Close closes the underlying file.
+func (fs *FileStore) Close() error {
+	return fs.file.Close()
+}
+
+// compact rewrites the file with only the retained events and reopens it
+// for appending. The new file is renamed into place so a crash never
+// leaves a truncated history behind.
+func (fs *FileStore) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, e := range fs.cache.events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), fs.path); err != nil {
+		return err
+	}
+	if fs.file != nil {
+		fs.file.Close()
+	}
+
+	fs.file, err = os.OpenFile(fs.path, os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	fs.stale = 0
+
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package event
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Didstopia/shoelaces/internal/server"
+)
+
+func mockEvent(mac, script string) Event {
+	return New(HostBoot, server.Server{Mac: mac}, ManualBoot, script, nil)
+}
+
+func TestMemoryStoreRetention(t *testing.T) {
+	store := NewMemoryStore(Retention{MaxPerMAC: 2, MaxTotal: 3})
+	store.Append(mockEvent("aa", "one"))
+	store.Append(mockEvent("aa", "two"))
+	store.Append(mockEvent("aa", "three"))
+	store.Append(mockEvent("bb", "four"))
+	store.Append(mockEvent("cc", "five"))
+
+	events, _ := store.Events()
+	if len(events["aa"]) != 1 || events["aa"][0].Script != "three" {
+		t.Errorf("Expected only the newest event for aa\nGot: %v", events["aa"])
+	}
+	if len(events["bb"]) != 1 || len(events["cc"]) != 1 {
+		t.Errorf("Expected one event for bb and cc\nGot: %v", events)
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	retention := Retention{MaxPerMAC: 2}
+
+	store, err := NewFileStore(path, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, script := range []string{"one", "two", "three"} {
+		if err := store.Append(mockEvent("aa", script)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	store, err = NewFileStore(path, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	events, _ := store.Events()
+	if len(events["aa"]) != 2 {
+		t.Fatalf("Expected 2 events after reload\nGot: %d", len(events["aa"]))
+	}
+	if events["aa"][0].Script != "two" || events["aa"][1].Script != "three" {
+		t.Errorf("Expected events two and three\nGot: %s and %s", events["aa"][0].Script, events["aa"][1].Script)
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/mappings"
+	"github.com/Didstopia/shoelaces/internal/polling"
+	"github.com/Didstopia/shoelaces/internal/server"
+	"github.com/Didstopia/shoelaces/internal/templates"
+	"github.com/Didstopia/shoelaces/internal/utils"
+	"github.com/gorilla/mux"
+)
+
+// APIError is the body of every error response of the JSON API.
+type APIError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// TargetRequest is the body expected when setting the target of a server.
+// Mode defaults to once.
+type TargetRequest struct {
+	Script      string                 `json:"script"`
+	Environment string                 `json:"environment"`
+	Params      map[string]interface{} `json:"params"`
+	Mode        mappings.Mode          `json:"mode"`
+}
+
+// TargetResponse is returned once a target has been set for a server.
+type TargetResponse struct {
+	Mac         string                 `json:"mac"`
+	Script      string                 `json:"script"`
+	Environment string                 `json:"environment"`
+	Params      map[string]interface{} `json:"params"`
+	Mode        mappings.Mode          `json:"mode"`
+}
+
+type apiScript struct {
+	Name        string                 `json:"name"`
+	Environment string                 `json:"environment"`
+	Params      map[string]interface{} `json:"params"`
+	Mode        mappings.Mode          `json:"mode"`
+}
+
+type apiMACMap struct {
+	MAC    string    `json:"mac"`
+	Script apiScript `json:"script"`
+}
+
+type apiHardwareMap struct {
+	Match  map[string]string `json:"match"`
+	Script apiScript         `json:"script"`
+}
+
+type apiNetworkMap struct {
+	Network string    `json:"network"`
+	Script  apiScript `json:"script"`
+}
+
+type apiHostnameMap struct {
+	Hostname string    `json:"hostname"`
+	Script   apiScript `json:"script"`
+}
+
+// MappingsResponse holds the mappings currently in use.
+type MappingsResponse struct {
+	MACMaps      []apiMACMap      `json:"macMaps"`
+	HardwareMaps []apiHardwareMap `json:"hardwareMaps"`
+	NetworkMaps  []apiNetworkMap  `json:"networkMaps"`
+	HostnameMaps []apiHostnameMap `json:"hostnameMaps"`
+}
+
+// APIServerListHandler returns the servers that are waiting for a target.
+func APIServerListHandler(w http.ResponseWriter, r *http.Request) {
+	env := envFromRequest(r)
+	writeJSON(w, http.StatusOK, polling.ListServers(env.ServerStates))
+}
+
+// APISetTargetHandler sets the script a waiting server boots next.
+func APISetTargetHandler(w http.ResponseWriter, r *http.Request) {
+	var req TargetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return
+	}
+	if req.Script == "" && req.Mode != mappings.ModeLocalBoot {
+		writeAPIError(w, http.StatusBadRequest, "Script must not be empty")
+		return
+	}
+	if req.Params == nil {
+		req.Params = make(map[string]interface{})
+	}
+
+	mac := utils.MacDashToColon(mux.Vars(r)["mac"])
+	if req.Mode == "" {
+		req.Mode = mappings.ModeOnce
+	}
+	if status, err := updateTarget(r, mac, req.Script, req.Environment, req.Params, req.Mode); err != nil {
+		writeAPIError(w, status, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TargetResponse{
+		Mac:         mac,
+		Script:      req.Script,
+		Environment: req.Environment,
+		Params:      envFromRequest(r).Config().Templates.RedactSecrets(req.Script, req.Environment, req.Params),
+		Mode:        req.Mode,
+	})
+}
+
+// APIClearTargetHandler removes the target chosen for a waiting server.
+func APIClearTargetHandler(w http.ResponseWriter, r *http.Request) {
+	env := envFromRequest(r)
+	mac := utils.MacDashToColon(mux.Vars(r)["mac"])
+
+	if err := polling.ClearTarget(loggerFromRequest(r), env.ServerStates, mac); err != nil {
+		writeAPIError(w, statusForPollingError(err), err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIEventListHandler returns the logged events sorted by date. They can
+// be filtered with the "mac", "type", "since" and "until" query
+// parameters. Dates use the RFC 3339 format and "type" can be repeated.
+func APIEventListHandler(w http.ResponseWriter, r *http.Request) {
+	env := envFromRequest(r)
+	query := r.URL.Query()
+
+	filter := event.Filter{Mac: utils.MacDashToColon(query.Get("mac"))}
+	for _, t := range query["type"] {
+		eventType, err := event.ParseType(t)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		filter.Types = append(filter.Types, eventType)
+	}
+
+	var err error
+	if filter.Since, err = parseTimeParam(query.Get("since")); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid since parameter: "+err.Error())
+		return
+	}
+	if filter.Until, err = parseTimeParam(query.Get("until")); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid until parameter: "+err.Error())
+		return
+	}
+
+	events, err := env.EventLog.Query(filter)
+	if err != nil {
+		loggerFromRequest(r).Error("component", "handler", "msg", "Failed to query events", "err", err)
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// APIMappingsHandler returns the mappings in use, in the order they are
+// tried.
+func APIMappingsHandler(w http.ResponseWriter, r *http.Request) {
+	config := envFromRequest(r).Config()
+
+	resp := MappingsResponse{
+		MACMaps:      make([]apiMACMap, 0, len(config.MACMaps)),
+		HardwareMaps: make([]apiHardwareMap, 0, len(config.HardwareMaps)),
+		NetworkMaps:  make([]apiNetworkMap, 0, len(config.NetworkMaps)),
+		HostnameMaps: make([]apiHostnameMap, 0, len(config.HostnameMaps)),
+	}
+	for _, m := range config.MACMaps {
+		resp.MACMaps = append(resp.MACMaps, apiMACMap{
+			MAC:    m.MAC.String(),
+			Script: newAPIScript(config.Templates, m.Script),
+		})
+	}
+	for _, m := range config.HardwareMaps {
+		match := make(map[string]string, len(m.Match))
+		for name, regex := range m.Match {
+			match[name] = regex.String()
+		}
+		resp.HardwareMaps = append(resp.HardwareMaps, apiHardwareMap{
+			Match:  match,
+			Script: newAPIScript(config.Templates, m.Script),
+		})
+	}
+	for _, m := range config.NetworkMaps {
+		resp.NetworkMaps = append(resp.NetworkMaps, apiNetworkMap{
+			Network: m.Network.String(),
+			Script:  newAPIScript(config.Templates, m.Script),
+		})
+	}
+	for _, m := range config.HostnameMaps {
+		resp.HostnameMaps = append(resp.HostnameMaps, apiHostnameMap{
+			Hostname: m.Hostname.String(),
+			Script:   newAPIScript(config.Templates, m.Script),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// APINotFoundHandler returns a JSON error for unknown API endpoints.
+func APINotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "Not found")
+}
+
+// APIMethodNotAllowedHandler returns a JSON error when an API endpoint
+// does not support the requested method.
+func APIMethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+// updateTarget validates and sets the target of a booting server. It's
+// shared by the API and the form based endpoint, and returns the HTTP
+// status code matching the error, if any.
+func updateTarget(r *http.Request, mac, scriptName, environment string, params map[string]interface{}, mode mappings.Mode) (int, error) {
+	env := envFromRequest(r)
+
+	if mac == "" {
+		return http.StatusBadRequest, errors.New("MAC address must not be empty")
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	inputErr, err := polling.UpdateTarget(
+		loggerFromRequest(r), env.ServerStates, env.Inventory, env.Config().Templates, env.EventLog.ForRequest(requestIDFromRequest(r)), env.BaseScheme, env.BaseURL,
+		server.New(mac, ip, ""), scriptName, environment, params, mode)
+	if err == nil {
+		return http.StatusOK, nil
+	}
+	if inputErr {
+		return statusForPollingError(err), err
+	}
+	return http.StatusInternalServerError, err
+}
+
+func statusForPollingError(err error) int {
+	if errors.Is(err, polling.ErrNotBooting) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// newAPIScript returns a script of the mappings, with the values of its
+// secret parameters masked.
+func newAPIScript(t *templates.ShoelacesTemplates, s *mappings.Script) apiScript {
+	return apiScript{Name: s.Name, Environment: s.Environment, Params: t.RedactSecrets(s.Name, s.Environment, s.Params), Mode: s.Mode}
+}
+
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, strings.TrimSpace(value))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	body, _ := json.Marshal(APIError{Error: apiErrorDetail{Code: status, Message: message}})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
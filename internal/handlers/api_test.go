@@ -0,0 +1,453 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Didstopia/shoelaces/internal/environment"
+	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/inventory"
+	"github.com/Didstopia/shoelaces/internal/log"
+	"github.com/Didstopia/shoelaces/internal/mappings"
+	"github.com/Didstopia/shoelaces/internal/polling"
+	"github.com/Didstopia/shoelaces/internal/server"
+	"github.com/Didstopia/shoelaces/internal/stream"
+	"github.com/Didstopia/shoelaces/internal/templates"
+)
+
+// testMAC is polled with dashes, as iPXE does.
+const testMAC = "52-54-00-12-34-56"
+
+// newTestEnv returns an environment with a single test.ipxe script and no
+// mappings.
+func newTestEnv(t *testing.T) *environment.Environment {
+	t.Helper()
+
+	dataDir := t.TempDir()
+	tpl := "{{define \"test.ipxe\" -}}\n#!ipxe\nset hostname {{.hostname}}\n{{end}}\n"
+	if err := os.MkdirAll(filepath.Join(dataDir, "ipxe"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "ipxe", "test.ipxe.slc"), []byte(tpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "mappings.yaml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := log.MakeLogger(ioutil.Discard)
+	states, _ := server.NewStates(nil)
+	inv, _ := inventory.New(nil)
+	env := &environment.Environment{
+		Logger:            logger,
+		EventLog:          event.NewLog(logger, event.NewMemoryStore(event.Retention{})),
+		ServerStates:      states,
+		Inventory:         inv,
+		Stream:            stream.NewBroker(),
+		ParamsBlacklist:   []string{"baseURL", "baseScheme"},
+		PollPolicy:        polling.DefaultPolicy,
+		PollExpire:        3 * time.Minute,
+		DataDir:           dataDir,
+		EnvDir:            "env_overrides",
+		MappingsFile:      "mappings.yaml",
+		TemplateExtension: ".slc",
+		BaseScheme:        "http",
+		BaseURL:           "localhost:8081",
+	}
+	if err := env.Reload("test"); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+// newTestRouter routes the handlers under test like the router package
+// does, behind the usual middlewares.
+func newTestRouter(env *environment.Environment) http.Handler {
+	r := mux.NewRouter()
+	r.Use(MetricsMiddleware)
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(APINotFoundHandler)
+	api.MethodNotAllowedHandler = http.HandlerFunc(APIMethodNotAllowedHandler)
+	api.HandleFunc("/servers", APIServerListHandler).Methods("GET")
+	api.HandleFunc("/servers/{mac}/target", APISetTargetHandler).Methods("PUT")
+	api.HandleFunc("/servers/{mac}/target", APIClearTargetHandler).Methods("DELETE")
+	api.HandleFunc("/stream", APIStreamHandler).Methods("GET")
+	api.HandleFunc("/mappings", APIMappingsHandler).Methods("GET")
+	api.HandleFunc("/scripts/{script}/params", APIScriptParamsHandler).Methods("GET")
+	api.HandleFunc("/machines", APIMachineListHandler).Methods("GET")
+	api.HandleFunc("/machines", APIAddMachineHandler).Methods("POST")
+	api.HandleFunc("/machines/{id}", APIMachineHandler).Methods("GET")
+	api.HandleFunc("/machines/{id}", APIUpdateMachineHandler).Methods("PUT")
+	api.HandleFunc("/machines/{id}", APIDeleteMachineHandler).Methods("DELETE")
+	r.HandleFunc("/ajax/script/params", GetTemplateParams)
+	r.HandleFunc("/poll/1/{mac}", PollHandler).Methods("GET")
+	r.HandleFunc("/report/{mac}/{phase}", ReportHandler).Methods("GET", "POST")
+	return MiddlewareChain(env).Then(r)
+}
+
+// newRequest returns a request from 192.0.2.1, the address of the test
+// host.
+func newRequest(method, target, body string) *http.Request {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	return httptest.NewRequest(method, target, reader)
+}
+
+// do sends a request to handler and returns the response.
+func do(t *testing.T, handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, newRequest(method, target, body))
+	return rec
+}
+
+// poll polls handler for testMAC. The host name is given, so it isn't
+// resolved.
+func poll(t *testing.T, handler http.Handler) *httptest.ResponseRecorder {
+	t.Helper()
+	return do(t, handler, "GET", "/poll/1/"+testMAC+"?host=test", "")
+}
+
+// decodeAPIError returns the error of an API response, failing the test if
+// the body isn't one.
+func decodeAPIError(t *testing.T, rec *httptest.ResponseRecorder) apiErrorDetail {
+	t.Helper()
+
+	var body APIError
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected an API error, got %q: %v", rec.Body, err)
+	}
+	if body.Error.Code != rec.Code {
+		t.Errorf("Expected the error code to be the status %d, got %d", rec.Code, body.Error.Code)
+	}
+	return body.Error
+}
+
+func TestAPIServers(t *testing.T) {
+	env := newTestEnv(t)
+	handler := newTestRouter(env)
+
+	rec := do(t, handler, "GET", "/api/v1/servers", "")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("Expected no servers, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := poll(t, handler); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the poll to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = do(t, handler, "GET", "/api/v1/servers", "")
+	var servers []server.Server
+	if err := json.Unmarshal(rec.Body.Bytes(), &servers); err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].Mac != "52:54:00:12:34:56" || servers[0].IP != "192.0.2.1" || servers[0].Hostname != "test" {
+		t.Errorf("Expected the polling host to wait for a target, got %+v", servers)
+	}
+}
+
+func TestAPISetTarget(t *testing.T) {
+	env := newTestEnv(t)
+	handler := newTestRouter(env)
+	if rec := poll(t, handler); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the poll to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+
+	testCases := []struct {
+		name    string
+		mac     string
+		body    string
+		status  int
+		message string
+	}{
+		{"invalid json", testMAC, `{"script":`, http.StatusBadRequest, "Invalid JSON body"},
+		{"no script", testMAC, `{"params": {}}`, http.StatusBadRequest, "Script must not be empty"},
+		{"unknown mode", testMAC, `{"script": "test.ipxe", "mode": "twice"}`, http.StatusBadRequest, "Unknown mode"},
+		{"invalid mac", "not-a-mac", `{"script": "test.ipxe"}`, http.StatusBadRequest, polling.ErrInvalidMAC.Error()},
+		{"not booting", "52-54-00-00-00-01", `{"script": "test.ipxe"}`, http.StatusNotFound, polling.ErrNotBooting.Error()},
+		{"unknown script", testMAC, `{"script": "missing.ipxe"}`, http.StatusBadRequest, "missing.ipxe"},
+		{"not booting, unknown script", "52-54-00-00-00-01", `{"script": "missing.ipxe"}`, http.StatusNotFound, polling.ErrNotBooting.Error()},
+		{"not booting, unknown mode", "52-54-00-00-00-01", `{"script": "test.ipxe", "mode": "twice"}`, http.StatusNotFound, polling.ErrNotBooting.Error()},
+	}
+	for _, tc := range testCases {
+		rec := do(t, handler, "PUT", "/api/v1/servers/"+tc.mac+"/target", tc.body)
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.status, rec.Code, rec.Body)
+			continue
+		}
+		if e := decodeAPIError(t, rec); !strings.Contains(e.Message, tc.message) {
+			t.Errorf("%s: expected %q in the error, got %q", tc.name, tc.message, e.Message)
+		}
+	}
+
+	rec := do(t, handler, "PUT", "/api/v1/servers/"+testMAC+"/target", `{"script": "test.ipxe", "params": {"hostname": "node1"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the target to be set, got %d: %s", rec.Code, rec.Body)
+	}
+	var target TargetResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &target); err != nil {
+		t.Fatal(err)
+	}
+	if target.Mac != "52:54:00:12:34:56" || target.Script != "test.ipxe" || target.Mode != mappings.ModeOnce {
+		t.Errorf("Expected the target in the once mode, got %+v", target)
+	}
+	if servers := polling.ListServers(env.ServerStates); len(servers) != 0 {
+		t.Errorf("Expected the host to stop waiting, got %+v", servers)
+	}
+
+	// Clearing the target puts the host back in the list
+	if rec := do(t, handler, "DELETE", "/api/v1/servers/"+testMAC+"/target", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected the target to be cleared, got %d: %s", rec.Code, rec.Body)
+	}
+	if servers := polling.ListServers(env.ServerStates); len(servers) != 1 {
+		t.Errorf("Expected the host to wait again, got %+v", servers)
+	}
+	rec = do(t, handler, "DELETE", "/api/v1/servers/52-54-00-00-00-01/target", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a host that isn't booting, got %d: %s", rec.Code, rec.Body)
+	} else {
+		decodeAPIError(t, rec)
+	}
+
+	// The host boots the target it's given
+	do(t, handler, "PUT", "/api/v1/servers/"+testMAC+"/target", `{"script": "test.ipxe", "params": {"hostname": "node1"}}`)
+	if rec := poll(t, handler); !strings.Contains(rec.Body.String(), "set hostname node1\n") {
+		t.Errorf("Expected the target to be booted, got %q", rec.Body)
+	}
+}
+
+func TestScriptParams(t *testing.T) {
+	handler := newTestRouter(newTestEnv(t))
+
+	rec := do(t, handler, "GET", "/ajax/script/params?script=test.ipxe", "")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `["hostname"]` {
+		t.Errorf("Expected the names of the parameters, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = do(t, handler, "GET", "/api/v1/scripts/test.ipxe/params?environment=default", "")
+	var params []templates.Param
+	if err := json.Unmarshal(rec.Body.Bytes(), &params); err != nil {
+		t.Fatal(err)
+	}
+	if len(params) != 1 || params[0].Name != "hostname" || params[0].Type != templates.TypeString || !params[0].Required {
+		t.Errorf("Expected the parameters with their metadata, got %+v", params)
+	}
+}
+
+func TestAPISecrets(t *testing.T) {
+	env := newTestEnv(t)
+	tpl := "{{/*---\nparams:\n  - name: password\n    secret: true\n---*/ -}}\n" +
+		"{{define \"secret.ipxe\" -}}\n#!ipxe\nset password {{.password}}\n{{end}}\n"
+	if err := ioutil.WriteFile(filepath.Join(env.DataDir, "ipxe", "secret.ipxe.slc"), []byte(tpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mappingsYAML := "macMaps:\n  - mac: 52:54:00:00:00:01\n    script:\n      name: secret.ipxe\n      params:\n        password: hunter2\n"
+	if err := ioutil.WriteFile(filepath.Join(env.DataDir, "mappings.yaml"), []byte(mappingsYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Reload("test"); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestRouter(env)
+
+	rec := do(t, handler, "GET", "/api/v1/mappings", "")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "hunter2") || !strings.Contains(rec.Body.String(), templates.SecretMask) {
+		t.Errorf("Expected the secrets of the mappings to be masked, got %d: %s", rec.Code, rec.Body)
+	}
+
+	body := `{"name": "node1", "mac": "` + testMAC + `", "script": "secret.ipxe", "params": {"password": "s3cret"}}`
+	rec = do(t, handler, "POST", "/api/v1/machines", body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the machine to be added, got %d: %s", rec.Code, rec.Body)
+	}
+	var added inventory.Machine
+	if err := json.Unmarshal(rec.Body.Bytes(), &added); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/api/v1/machines", "/api/v1/machines/" + added.ID} {
+		rec := do(t, handler, "GET", target, "")
+		if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "s3cret") {
+			t.Errorf("%s: expected the secrets of the machines to be masked, got %d: %s", target, rec.Code, rec.Body)
+		}
+	}
+
+	// Machines sent back as they were read keep their secrets
+	added.Name = "renamed"
+	updated, _ := json.Marshal(added)
+	if rec := do(t, handler, "PUT", "/api/v1/machines/"+added.ID, string(updated)); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "s3cret") {
+		t.Errorf("Expected the machine to be updated, got %d: %s", rec.Code, rec.Body)
+	}
+	if m, _ := env.Inventory.Get(added.ID); m.Name != "renamed" || m.Params["password"] != "s3cret" {
+		t.Errorf("Expected the secret to be kept, got %+v", m)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	handler := newTestRouter(newTestEnv(t))
+
+	testCases := []struct {
+		method string
+		target string
+		status int
+	}{
+		{"GET", "/api/v1/unknown", http.StatusNotFound},
+		{"POST", "/api/v1/servers", http.StatusMethodNotAllowed},
+	}
+	for _, tc := range testCases {
+		rec := do(t, handler, tc.method, tc.target, "")
+		if rec.Code != tc.status {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.target, tc.status, rec.Code)
+			continue
+		}
+		decodeAPIError(t, rec)
+	}
+}
+
+func TestAPIMachines(t *testing.T) {
+	env := newTestEnv(t)
+	handler := newTestRouter(env)
+
+	body := `{"name": "node1", "mac": "` + testMAC + `", "script": "test.ipxe", "mode": "until-reported-done"}`
+	rec := do(t, handler, "POST", "/api/v1/machines", body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the machine to be added, got %d: %s", rec.Code, rec.Body)
+	}
+	var added inventory.Machine
+	if err := json.Unmarshal(rec.Body.Bytes(), &added); err != nil {
+		t.Fatal(err)
+	}
+	if location := rec.Header().Get("Location"); location != "/api/v1/machines/"+added.ID {
+		t.Errorf("Expected the location of the machine, got %q", location)
+	}
+	if added.MAC != "52:54:00:12:34:56" || added.Mode != mappings.ModeUntilDone {
+		t.Errorf("Expected the machine as added, got %+v", added)
+	}
+
+	testCases := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		status  int
+		message string
+	}{
+		{"invalid json", "POST", "/api/v1/machines", `{"name":`, http.StatusBadRequest, "Invalid JSON body"},
+		{"no identifier", "POST", "/api/v1/machines", `{"name": "node2"}`, http.StatusBadRequest, inventory.ErrNoIdentifier.Error()},
+		{"unknown script", "POST", "/api/v1/machines", `{"serial": "CN7475", "script": "missing.ipxe"}`, http.StatusBadRequest, "missing.ipxe"},
+		{"unknown environment", "POST", "/api/v1/machines", `{"serial": "CN7475", "script": "test.ipxe", "environment": "prod"}`, http.StatusBadRequest, "Unknown environment"},
+		{"duplicate mac", "POST", "/api/v1/machines", `{"mac": "52:54:00:12:34:56"}`, http.StatusConflict, "node1"},
+		{"missing", "GET", "/api/v1/machines/missing", "", http.StatusNotFound, inventory.ErrNotFound.Error()},
+		{"update missing", "PUT", "/api/v1/machines/missing", `{"serial": "CN7475"}`, http.StatusNotFound, inventory.ErrNotFound.Error()},
+	}
+	for _, tc := range testCases {
+		rec := do(t, handler, tc.method, tc.target, tc.body)
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.status, rec.Code, rec.Body)
+			continue
+		}
+		if e := decodeAPIError(t, rec); !strings.Contains(e.Message, tc.message) {
+			t.Errorf("%s: expected %q in the error, got %q", tc.name, tc.message, e.Message)
+		}
+	}
+
+	rec = do(t, handler, "PUT", "/api/v1/machines/"+added.ID, `{"name": "renamed", "mac": "`+testMAC+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the machine to be updated, got %d: %s", rec.Code, rec.Body)
+	}
+	if m, _ := env.Inventory.Get(added.ID); m.Name != "renamed" || m.Script != "" {
+		t.Errorf("Expected the machine to be replaced, got %+v", m)
+	}
+
+	rec = do(t, handler, "GET", "/api/v1/machines", "")
+	var machines []inventory.Machine
+	if err := json.Unmarshal(rec.Body.Bytes(), &machines); err != nil {
+		t.Fatal(err)
+	}
+	if len(machines) != 1 || machines[0].ID != added.ID {
+		t.Errorf("Expected the machine in the list, got %+v", machines)
+	}
+
+	if rec := do(t, handler, "DELETE", "/api/v1/machines/"+added.ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected the machine to be deleted, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do(t, handler, "DELETE", "/api/v1/machines/"+added.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a deleted machine, got %d: %s", rec.Code, rec.Body)
+	}
+	if len(env.Inventory.List()) != 0 {
+		t.Errorf("Expected an empty inventory, got %+v", env.Inventory.List())
+	}
+}
+
+func TestAPISetTargetNonStringHostname(t *testing.T) {
+	testCases := []struct {
+		hostname string
+		expected string
+	}{
+		{"42", "set hostname 42\n"},
+		{"null", "set hostname 52-54-00-12-34-56\n"},
+		{"[\"a\", 1]", "set hostname [a 1]\n"},
+	}
+	for _, tc := range testCases {
+		env := newTestEnv(t)
+		handler := newTestRouter(env)
+
+		if rec := poll(t, handler); rec.Code != http.StatusOK {
+			t.Fatalf("Expected the first poll to succeed, got %d: %s", rec.Code, rec.Body)
+		}
+		body := `{"script": "test.ipxe", "params": {"hostname": ` + tc.hostname + `}}`
+		if rec := do(t, handler, "PUT", "/api/v1/servers/"+testMAC+"/target", body); rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected the target to be set, got %d: %s", tc.hostname, rec.Code, rec.Body)
+		}
+
+		// The poll used to panic on hostnames that weren't strings
+		for i := 0; i < 2; i++ {
+			rec := poll(t, handler)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: expected the poll to succeed, got %d: %s", tc.hostname, rec.Code, rec.Body)
+			}
+			if i == 0 && !strings.Contains(rec.Body.String(), tc.expected) {
+				t.Errorf("%s: expected %q in the script, got %q", tc.hostname, tc.expected, rec.Body)
+			}
+		}
+	}
+}
+
+func TestAPIMachineNonStringHostname(t *testing.T) {
+	env := newTestEnv(t)
+	handler := newTestRouter(env)
+
+	body := `{"name": "node1", "mac": "` + testMAC + `", "script": "test.ipxe", "params": {"hostname": 42}}`
+	if rec := do(t, handler, "POST", "/api/v1/machines", body); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the machine to be added, got %d: %s", rec.Code, rec.Body)
+	}
+	rec := poll(t, handler)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "set hostname 42\n") {
+		t.Errorf("Expected the script of the machine, got %d: %q", rec.Code, rec.Body)
+	}
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/Didstopia/shoelaces/internal/environment"
 	"github.com/Didstopia/shoelaces/internal/ipxe"
+	"github.com/Didstopia/shoelaces/internal/log"
 	"github.com/Didstopia/shoelaces/internal/mappings"
 )
 
@@ -39,15 +40,22 @@ func (t *DefaultTemplateRenderer) ServeHTTP(w http.ResponseWriter, r *http.Reque
 	tpl := env.StaticTemplates
 	// XXX: Probably not ideal as it's doing the directory listing on every request
 	ipxeScripts := ipxe.ScriptList(env)
+	config := env.Config()
 	tplVars := struct {
+		BaseScheme   string
 		BaseURL      string
-		HostnameMaps *[]mappings.HostnameMap
-		NetworkMaps  *[]mappings.NetworkMap
+		MACMaps      []mappings.MACMap
+		HardwareMaps []mappings.HardwareMap
+		HostnameMaps []mappings.HostnameMap
+		NetworkMaps  []mappings.NetworkMap
 		Scripts      *[]ipxe.Script
 	}{
+		env.BaseScheme,
 		env.BaseURL,
-		&env.HostnameMaps,
-		&env.NetworkMaps,
+		config.MACMaps,
+		config.HardwareMaps,
+		config.HostnameMaps,
+		config.NetworkMaps,
 		&ipxeScripts,
 	}
 	renderTemplate(w, tpl, "header", tplVars)
@@ -66,6 +74,22 @@ func envFromRequest(r *http.Request) *environment.Environment {
 	return r.Context().Value(ShoelacesEnvCtxID).(*environment.Environment)
 }
 
+// loggerFromRequest returns the logger of the request, which adds its ID
+// to every line.
+func loggerFromRequest(r *http.Request) log.Logger {
+	if logger, ok := r.Context().Value(ShoelacesLoggerCtxID).(log.Logger); ok {
+		return logger
+	}
+	return envFromRequest(r).Logger
+}
+
+// requestIDFromRequest returns the ID given to the request by
+// loggingMiddleware.
+func requestIDFromRequest(r *http.Request) string {
+	id, _ := r.Context().Value(ShoelacesRequestIDCtxID).(string)
+	return id
+}
+
 func envNameFromRequest(r *http.Request) string {
 	e := r.Context().Value(ShoelacesEnvNameCtxID)
 	if e != nil {
@@ -17,17 +17,23 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
-	"os"
 )
 
 // ListEvents returns a JSON list of the logged events.
 func ListEvents(w http.ResponseWriter, r *http.Request) {
 	// Get Environment and convert the EventLog to JSON
 	env := envFromRequest(r)
-	eventList, err := json.Marshal(env.EventLog.Events)
+	events, err := env.EventLog.ListEvents()
 	if err != nil {
-		env.Logger.Error("component", "handler", "err", err)
-		os.Exit(1)
+		loggerFromRequest(r).Error("component", "handler", "msg", "Failed to list events", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	eventList, err := json.Marshal(events)
+	if err != nil {
+		loggerFromRequest(r).Error("component", "handler", "msg", "Failed to encode events", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	//Write the EventLog and send the HTTP response
@@ -0,0 +1,149 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Didstopia/shoelaces/internal/inventory"
+	"github.com/Didstopia/shoelaces/internal/polling"
+	"github.com/Didstopia/shoelaces/internal/utils"
+	"github.com/gorilla/mux"
+)
+
+// APIMachineListHandler returns the machines in the inventory.
+func APIMachineListHandler(w http.ResponseWriter, r *http.Request) {
+	env := envFromRequest(r)
+
+	machines := env.Inventory.List()
+	for i := range machines {
+		machines[i] = redactMachine(r, machines[i])
+	}
+	writeJSON(w, http.StatusOK, machines)
+}
+
+// APIMachineHandler returns a machine of the inventory.
+func APIMachineHandler(w http.ResponseWriter, r *http.Request) {
+	env := envFromRequest(r)
+
+	machine, err := env.Inventory.Get(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, statusForInventoryError(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, redactMachine(r, machine))
+}
+
+// APIAddMachineHandler adds a machine to the inventory.
+func APIAddMachineHandler(w http.ResponseWriter, r *http.Request) {
+	env := envFromRequest(r)
+
+	machine, ok := decodeMachine(w, r)
+	if !ok {
+		return
+	}
+	machine, err := env.Inventory.Add(machine)
+	if err != nil {
+		writeAPIError(w, statusForInventoryError(err), err.Error())
+		return
+	}
+
+	loggerFromRequest(r).Info("component", "inventory", "msg", "Machine added", "id", machine.ID, "name", machine.Name, "script", machine.Script)
+	w.Header().Set("Location", "/api/v1/machines/"+machine.ID)
+	writeJSON(w, http.StatusCreated, redactMachine(r, machine))
+}
+
+// APIUpdateMachineHandler replaces a machine of the inventory.
+func APIUpdateMachineHandler(w http.ResponseWriter, r *http.Request) {
+	env := envFromRequest(r)
+
+	machine, ok := decodeMachine(w, r)
+	if !ok {
+		return
+	}
+	machine.ID = mux.Vars(r)["id"]
+	machine, err := env.Inventory.Update(machine)
+	if err != nil {
+		writeAPIError(w, statusForInventoryError(err), err.Error())
+		return
+	}
+
+	loggerFromRequest(r).Info("component", "inventory", "msg", "Machine updated", "id", machine.ID, "name", machine.Name, "script", machine.Script)
+	writeJSON(w, http.StatusOK, redactMachine(r, machine))
+}
+
+// APIDeleteMachineHandler removes a machine from the inventory.
+func APIDeleteMachineHandler(w http.ResponseWriter, r *http.Request) {
+	env := envFromRequest(r)
+	id := mux.Vars(r)["id"]
+
+	if err := env.Inventory.Delete(id); err != nil {
+		writeAPIError(w, statusForInventoryError(err), err.Error())
+		return
+	}
+
+	loggerFromRequest(r).Info("component", "inventory", "msg", "Machine deleted", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeMachine reads a machine from the request body and checks that its
+// script can be rendered. It writes the error response when it can't. The
+// secrets of the machine being replaced, if any, are kept when they're
+// sent back masked.
+func decodeMachine(w http.ResponseWriter, r *http.Request) (inventory.Machine, bool) {
+	env := envFromRequest(r)
+
+	var machine inventory.Machine
+	if err := json.NewDecoder(r.Body).Decode(&machine); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		return machine, false
+	}
+
+	config := env.Config()
+	if stored, err := env.Inventory.Get(mux.Vars(r)["id"]); err == nil {
+		machine.Params = config.Templates.RestoreSecrets(machine.Script, machine.Environment, machine.Params, stored.Params)
+	}
+	if machine.Environment != "" && !utils.StringInSlice(machine.Environment, config.Environments) {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Unknown environment %q", machine.Environment))
+		return machine, false
+	}
+	if err := polling.ValidateMachine(loggerFromRequest(r), config.Templates, env.BaseScheme, env.BaseURL, machine); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return machine, false
+	}
+	return machine, true
+}
+
+// redactMachine returns m with the values of its secret parameters masked.
+func redactMachine(r *http.Request, m inventory.Machine) inventory.Machine {
+	m.Params = envFromRequest(r).Config().Templates.RedactSecrets(m.Script, m.Environment, m.Params)
+	return m
+}
+
+func statusForInventoryError(err error) int {
+	switch {
+	case errors.Is(err, inventory.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, inventory.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, inventory.ErrInvalid), errors.Is(err, inventory.ErrNoIdentifier):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
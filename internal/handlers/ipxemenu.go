@@ -20,10 +20,11 @@ import (
 	"net/http"
 
 	"github.com/Didstopia/shoelaces/internal/ipxe"
+	"github.com/Didstopia/shoelaces/internal/mappings"
 )
 
 const menuHeader = "#!ipxe\n" +
-	"chain /poll/1/${netX/mac:hexhyp}\n" +
+	"chain /poll/1/${netX/mac:hexhyp}" + mappings.IPXEAttributesQuery + "\n" +
 	"menu Choose target to boot\n"
 
 const menuFooter = "\n" +
@@ -55,6 +56,9 @@ func IPXEMenu(w http.ResponseWriter, r *http.Request) {
 		} else {
 			desc = string(s.Name)
 		}
+		if s.Description != "" {
+			desc += " - " + s.Description
+		}
 		bootItem := fmt.Sprintf("item %s%s %s\n", s.Path, s.Name, desc)
 		bootItemsBuffer.WriteString(bootItem)
 	}
@@ -0,0 +1,68 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/Didstopia/shoelaces/internal/metrics"
+)
+
+// MetricsHandler exposes the metrics in the Prometheus text format.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.ContentType)
+	if err := metrics.Default.Write(w); err != nil {
+		loggerFromRequest(r).Debug("component", "metrics", "msg", "Failed to write the metrics", "err", err)
+	}
+}
+
+// MetricsMiddleware measures the time taken to answer the requests, by
+// route template, so /poll/1/{mac} is a single route whatever the MAC is.
+// It must be used on the mux.Router for the route to be known. Streams
+// and held long polls are left out, as they last as long as the client
+// stays or no target is chosen.
+func MetricsMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseRecorder{ResponseWriter: w}
+		unmeasured := new(int32)
+		h.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), ShoelacesUnmeasuredCtxID, unmeasured)))
+
+		if rw.Header().Get("Content-Type") == "text/event-stream" || atomic.LoadInt32(unmeasured) != 0 {
+			return
+		}
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		metrics.HTTPRequestDuration.Observe(time.Since(start).Seconds(), route, r.Method, strconv.Itoa(rw.Status()))
+	})
+}
+
+// skipMetrics leaves the request out of the metrics, for responses whose
+// duration doesn't tell how fast Shoelaces answers.
+func skipMetrics(r *http.Request) {
+	if unmeasured, ok := r.Context().Value(ShoelacesUnmeasuredCtxID).(*int32); ok {
+		atomic.StoreInt32(unmeasured, 1)
+	}
+}
@@ -16,11 +16,17 @@ package handlers
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
 	"net/http"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/justinas/alice"
 
+	"github.com/Didstopia/shoelaces/internal/auth"
 	"github.com/Didstopia/shoelaces/internal/environment"
 )
 
@@ -33,8 +39,31 @@ const ShoelacesEnvCtxID ShoelacesCtxID = 0
 // ShoelacesEnvNameCtxID is the context ID key for the chosen environment.
 const ShoelacesEnvNameCtxID ShoelacesCtxID = 1
 
+// ShoelacesRequestIDCtxID is the context ID key for the ID of the request.
+const ShoelacesRequestIDCtxID ShoelacesCtxID = 2
+
+// ShoelacesLoggerCtxID is the context ID key for the logger of the
+// request, which adds its ID to every line.
+const ShoelacesLoggerCtxID ShoelacesCtxID = 3
+
+// ShoelacesUnmeasuredCtxID is the context ID key for the flag handlers
+// set to leave their request out of the metrics.
+const ShoelacesUnmeasuredCtxID ShoelacesCtxID = 4
+
 var envRe = regexp.MustCompile(`^(:?/env\/([a-zA-Z0-9_-]+))?(\/.*)`)
 
+// requestIDHeader carries the ID of a request, when it's set by a proxy or
+// the client. It's sent back in the response either way.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDRe matches the request IDs taken from requestIDHeader, so they
+// are safe to log.
+var requestIDRe = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
+// publicPaths are reachable without authentication, as booting hosts
+// can't provide any credentials.
+var publicPaths = []string{"/poll/", "/configs/", "/ipxemenu", "/static/", "/report/"}
+
 // environmentMiddleware Rewrites the URL in case it was an environment
 // specific and sets the environment in the context.
 func environmentMiddleware(h http.Handler) http.Handler {
@@ -50,17 +79,147 @@ func environmentMiddleware(h http.Handler) http.Handler {
 	})
 }
 
-// loggingMiddleware adds an entry to the logger each time the HTTP service
-// receives a request.
+// clientIPMiddleware replaces the address of trusted proxies with the one
+// of their client in the RemoteAddr of the requests, so the rest of the
+// handlers don't have to care about proxies.
+func clientIPMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxies := envFromRequest(r).Proxies
+		if len(proxies) > 0 {
+			if _, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				r.RemoteAddr = net.JoinHostPort(proxies.ClientIP(r), port)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loggingMiddleware gives every request an ID and a logger adding it to
+// every line, and adds an access entry to the logger once the request is
+// handled, with the status, size and duration of the response. The ID is
+// taken from the X-Request-ID header when it's valid.
 func loggingMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger := envFromRequest(r).Logger
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRe.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := envFromRequest(r).Logger.With("request_id", id)
+		ctx := context.WithValue(r.Context(), ShoelacesRequestIDCtxID, id)
+		ctx = context.WithValue(ctx, ShoelacesLoggerCtxID, logger)
+
+		logger.Debug("component", "http", "msg", "Request received", "src", r.RemoteAddr, "method", r.Method, "url", r.URL)
+		rw := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(rw, r.WithContext(ctx))
+		logger.Info("component", "http", "msg", "Request handled", "src", r.RemoteAddr, "method", r.Method, "url", r.URL,
+			"status", rw.Status(), "bytes", rw.bytes, "duration", time.Since(start))
+	})
+}
+
+// responseRecorder keeps track of the status and size of a response. It
+// implements http.Flusher when the wrapped writer does, which streaming
+// responses rely on.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client, if the wrapped writer can.
+func (rw *responseRecorder) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Status returns the status of the response, which is 200 when the
+// handler didn't set one.
+func (rw *responseRecorder) Status() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
+
+// newRequestID returns a random ID for a request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// authMiddleware rejects requests without the role they require when
+// authentication is enabled. Reading requires the viewer role, while any
+// other method requires the operator role.
+func authMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := envFromRequest(r)
+		required := requiredRole(r)
+		if env.Auth == nil || required == auth.RoleNone {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		identity, ok := env.Auth.Authenticate(r)
+		if !ok {
+			if env.Auth.UsesBasicAuth() {
+				w.Header().Set("WWW-Authenticate", `Basic realm="Shoelaces"`)
+			}
+			denyRequest(w, r, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		if identity.Role < required {
+			loggerFromRequest(r).Info("component", "http", "msg", "Access denied", "user", identity.Name, "role", identity.Role, "method", r.Method, "url", r.URL)
+			denyRequest(w, r, http.StatusForbidden, "The "+required.String()+" role is required")
+			return
+		}
 
-		logger.Info("component", "http", "type", "request", "src", r.RemoteAddr, "method", r.Method, "url", r.URL)
+		loggerFromRequest(r).Debug("component", "http", "msg", "Authenticated", "user", identity.Name, "role", identity.Role, "auth", identity.Method)
 		h.ServeHTTP(w, r)
 	})
 }
 
+func requiredRole(r *http.Request) auth.Role {
+	for _, p := range publicPaths {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return auth.RoleNone
+		}
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return auth.RoleViewer
+	}
+	return auth.RoleOperator
+}
+
+func denyRequest(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(w, status, message)
+		return
+	}
+	http.Error(w, message, status)
+}
+
 // SecureHeaders adds secure headers to the responses
 func secureHeadersMiddleware(h http.Handler) http.Handler {
 
@@ -107,5 +266,7 @@ func MiddlewareChain(env *environment.Environment) alice.Chain {
 		disableCacheMiddleware,
 		environmentMiddleware,
 		contextMiddleware,
-		loggingMiddleware)
+		clientIPMiddleware,
+		loggingMiddleware,
+		authMiddleware)
 }
@@ -15,51 +15,71 @@
 package handlers
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
-	"os"
+	"time"
 
 	"github.com/Didstopia/shoelaces/internal/log"
+	"github.com/Didstopia/shoelaces/internal/mappings"
 	"github.com/Didstopia/shoelaces/internal/polling"
 	"github.com/Didstopia/shoelaces/internal/server"
 	"github.com/Didstopia/shoelaces/internal/utils"
 	"github.com/gorilla/mux"
 )
 
+// pollKeepAlive is how often something is sent to the hosts whose polls
+// are held.
+const pollKeepAlive = 15 * time.Second
+
 // PollHandler is called by iPXE boot agents. It returns the boot script
 // specified on the configuration or, if the host is unknown, it makes it
 // retry for a while until the user specifies alternative IPXE boot script.
 func PollHandler(w http.ResponseWriter, r *http.Request) {
 	env := envFromRequest(r)
 
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	ip := pollIP(r, peer)
 
 	vars := mux.Vars(r)
 	// iPXE MAC addresses come with dashes instead of colons
 	mac := utils.MacDashToColon(vars["mac"])
-	host := r.FormValue("host")
+	host := r.URL.Query().Get("host")
 
-	err = validateMACAndIP(env.Logger, mac, ip)
+	err = validateMACAndIP(loggerFromRequest(r), mac, ip)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	if host == "" {
-		host = resolveHostname(env.Logger, ip)
+		host = resolveHostname(loggerFromRequest(r), ip)
 	}
 
 	server := server.New(mac, ip, host)
-	script, err := polling.Poll(
-		env.Logger, env.ServerStates, env.HostnameMaps, env.NetworkMaps,
-		env.EventLog, env.Templates, env.BaseURL, server)
+	server.Attributes = hardwareAttributes(r)
+	server.Peer = peer
+	config := env.Config()
+	envName := envNameFromRequest(r)
+	policy := polling.FindPolicy(config.PollPolicies, ip, envName, config.DefaultPollPolicy)
+	poll := func() (string, error) {
+		return polling.Poll(
+			loggerFromRequest(r), env.ServerStates, env.Inventory, config.MACMaps, config.HardwareMaps,
+			config.HostnameMaps, config.NetworkMaps, policy,
+			env.EventLog.ForRequest(requestIDFromRequest(r)), config.Templates, env.BaseScheme, env.BaseURL, envName, server)
+	}
+
+	if env.LongPollTimeout > 0 {
+		longPoll(w, r, mac, poll)
+		return
+	}
 
+	script, err := poll()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -67,32 +87,77 @@ func PollHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(script))
 }
 
-// ServerListHandler provides a list of the servers that tried to boot
-// but did not match the hostname regex or network mappings.
-func ServerListHandler(w http.ResponseWriter, r *http.Request) {
+// longPoll holds the poll of a host waiting for a target until one is
+// chosen, for up to LongPollTimeout. The host then polls again right away
+// and boots it. Meanwhile, it gets an iPXE comment every pollKeepAlive, so
+// neither iPXE nor proxies drop the connection. When time is up, the host
+// gets the retry script of its first poll.
+func longPoll(w http.ResponseWriter, r *http.Request, mac string, poll func() (string, error)) {
 	env := envFromRequest(r)
 
-	servers, err := json.Marshal(polling.ListServers(env.ServerStates))
+	// Waiting first means no target chosen after the poll is missed
+	wait, cancel := env.ServerStates.WaitTarget(mac)
+	defer cancel()
+
+	script, err := poll()
 	if err != nil {
-		env.Logger.Error("component", "handler", "err", err)
-		os.Exit(1)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || !env.ServerStates.Waiting(mac) {
+		w.Write([]byte(script))
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(servers)
+	// Held polls last until a target is chosen, so their duration would
+	// only skew the latency of the answered ones.
+	skipMetrics(r)
+
+	// The scripts written afterwards start with #!ipxe as well, which is a
+	// comment anywhere else.
+	io.WriteString(w, "#!ipxe\n")
+	flusher.Flush()
+
+	timeout := time.NewTimer(env.LongPollTimeout)
+	defer timeout.Stop()
+	keepAlive := time.NewTicker(pollKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, "# Waiting for a target\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-timeout.C:
+			io.WriteString(w, script)
+			return
+
+		case <-wait:
+			// Released waits, like when shutting down, leave the host
+			// waiting, so it goes back to the retry loop.
+			if !env.ServerStates.Waiting(mac) {
+				if next, err := poll(); err != nil {
+					loggerFromRequest(r).Error("component", "polling", "msg", "Failed to poll after a target was chosen", "mac", mac, "err", err)
+				} else {
+					script = next
+				}
+			}
+			io.WriteString(w, script)
+			return
+		}
+	}
 }
 
 // UpdateTargetHandler is a POST endpoint that receives parameters for
 // booting manually.
 func UpdateTargetHandler(w http.ResponseWriter, r *http.Request) {
-	env := envFromRequest(r)
-
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -103,17 +168,10 @@ func UpdateTargetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	server := server.New(mac, ip, "")
-	inputErr, err := polling.UpdateTarget(
-		env.Logger, env.ServerStates, env.Templates, env.EventLog, env.BaseURL, server,
-		scriptName, environment, params)
-
-	if err != nil {
-		if inputErr {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	// Every other field is a template parameter, so targets set with the
+	// form are always in the once mode.
+	if status, err := updateTarget(r, mac, scriptName, environment, params, mappings.ModeOnce); err != nil {
+		http.Error(w, err.Error(), status)
 		return
 	}
 	http.Redirect(w, r, "/", http.StatusFound)
@@ -135,6 +193,37 @@ func parsePostForm(form map[string][]string) (mac, scriptName, environment strin
 	return
 }
 
+// hardwareAttributes returns the hardware attributes reported by iPXE in
+// the query string. iPXE expands unknown settings to empty strings, so
+// those are left out. The body isn't read, as it holds the logs of the
+// reports.
+func hardwareAttributes(r *http.Request) map[string]string {
+	var attributes map[string]string
+	query := r.URL.Query()
+	for _, name := range mappings.AttributeNames {
+		if value := query.Get(name); value != "" {
+			if attributes == nil {
+				attributes = make(map[string]string)
+			}
+			attributes[name] = value
+		}
+	}
+	return attributes
+}
+
+// pollIP returns the IP address of a polling host. It's the one iPXE sends
+// in the ip query parameter when trust-ip-param is set and peer is a
+// trusted proxy or relay, or peer otherwise.
+func pollIP(r *http.Request, peer string) string {
+	env := envFromRequest(r)
+	if env.TrustIPParam && env.Proxies.Contains(net.ParseIP(peer)) {
+		if ip := r.URL.Query().Get("ip"); net.ParseIP(ip) != nil {
+			return ip
+		}
+	}
+	return peer
+}
+
 func validateMACAndIP(logger log.Logger, mac string, ip string) (err error) {
 	if !utils.IsValidMAC(mac) {
 		logger.Error("component", "polling", "msg", "Invalid MAC", "mac", mac)
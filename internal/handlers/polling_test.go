@@ -0,0 +1,151 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/environment"
+	"github.com/Didstopia/shoelaces/internal/inventory"
+	"github.com/Didstopia/shoelaces/internal/metrics"
+)
+
+const retryChain = "chain -ar http://localhost:8081/poll/1/" + testMAC
+
+func TestLongPollTimeout(t *testing.T) {
+	env := newTestEnv(t)
+	env.LongPollTimeout = 50 * time.Millisecond
+	handler := newTestRouter(env)
+
+	start := time.Now()
+	rec := poll(t, handler)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the poll to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+	if time.Since(start) < env.LongPollTimeout {
+		t.Errorf("Expected the poll to be held for %v, answered after %v", env.LongPollTimeout, time.Since(start))
+	}
+	if body := rec.Body.String(); !strings.HasPrefix(body, "#!ipxe\n#!ipxe\n") || !strings.Contains(body, retryChain) {
+		t.Errorf("Expected the retry script once time is up, got %q", body)
+	}
+}
+
+func TestLongPollMetrics(t *testing.T) {
+	env := newTestEnv(t)
+	env.LongPollTimeout = 50 * time.Millisecond
+	handler := newTestRouter(env)
+	route := "/poll/1/{mac}"
+	if _, err := env.Inventory.Add(inventory.Machine{MAC: testMAC, Name: "node1", Script: "test.ipxe"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Polls answered right away are measured
+	before := metrics.HTTPRequestDuration.Count(route, "GET", "200")
+	poll(t, handler)
+	if count := metrics.HTTPRequestDuration.Count(route, "GET", "200"); count != before+1 {
+		t.Errorf("Expected the answered poll to be measured, got %d polls measured", count-before)
+	}
+
+	// Held ones aren't
+	rec := do(t, handler, "GET", "/poll/1/52-54-00-00-00-01?host=test", "")
+	if !strings.HasPrefix(rec.Body.String(), "#!ipxe\n#!ipxe\n") {
+		t.Fatalf("Expected the poll to be held, got %q", rec.Body)
+	}
+	if count := metrics.HTTPRequestDuration.Count(route, "GET", "200"); count != before+1 {
+		t.Errorf("Expected the held poll to be left out, got %d polls measured", count-before)
+	}
+}
+
+func TestLongPollAssigned(t *testing.T) {
+	env := newTestEnv(t)
+	env.LongPollTimeout = time.Minute
+	handler := newTestRouter(env)
+	if _, err := env.Inventory.Add(inventory.Machine{MAC: testMAC, Name: "node1", Script: "test.ipxe"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hosts with a script aren't held
+	rec := poll(t, handler)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "#!ipxe\nset hostname node1\n") {
+		t.Errorf("Expected the script of the machine, got %d: %q", rec.Code, rec.Body)
+	}
+}
+
+func TestLongPollWakeUp(t *testing.T) {
+	testCases := []struct {
+		name     string
+		wakeUp   func(t *testing.T, env *environment.Environment, url string)
+		expected string
+	}{
+		{"target", setTestTarget, "set hostname node1\n"},
+		{"shutdown", func(t *testing.T, env *environment.Environment, url string) { env.ServerStates.ReleaseWaits() }, retryChain},
+	}
+	for _, tc := range testCases {
+		env := newTestEnv(t)
+		env.LongPollTimeout = time.Minute
+		ts := httptest.NewServer(newTestRouter(env))
+
+		start := time.Now()
+		resp, err := http.Get(ts.URL + "/poll/1/" + testMAC + "?host=test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := bufio.NewReader(resp.Body)
+
+		// The host is held once it got the first line
+		if line, err := body.ReadString('\n'); err != nil || line != "#!ipxe\n" {
+			t.Fatalf("%s: expected the poll to be held, got %q: %v", tc.name, line, err)
+		}
+		tc.wakeUp(t, env, ts.URL)
+		rest, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(rest), tc.expected) {
+			t.Errorf("%s: expected %q in the script, got %q", tc.name, tc.expected, rest)
+		}
+		if elapsed := time.Since(start); elapsed >= env.LongPollTimeout {
+			t.Errorf("%s: expected the poll to be answered right away, got %v", tc.name, elapsed)
+		}
+		resp.Body.Close()
+		ts.Close()
+	}
+}
+
+// setTestTarget chooses test.ipxe as the target of testMAC through the
+// API at url.
+func setTestTarget(t *testing.T, env *environment.Environment, url string) {
+	t.Helper()
+
+	body := `{"script": "test.ipxe", "params": {"hostname": "node1"}}`
+	req, err := http.NewRequest("PUT", url+"/api/v1/servers/"+testMAC+"/target", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the target to be set, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Didstopia/shoelaces/internal/polling"
+	"github.com/Didstopia/shoelaces/internal/server"
+	"github.com/Didstopia/shoelaces/internal/utils"
+	"github.com/gorilla/mux"
+)
+
+// maxReportLog is the size of the longest log kept from a report. Longer
+// ones keep their end, which usually explains what went wrong.
+const maxReportLog = 64 << 10
+
+// maxReportBody is the size of the largest request body accepted from an
+// installer.
+const maxReportBody = 16 << 20
+
+// ReportHandler is called by installers to report their progress. The
+// phase is started, progress, success or failure, the message query
+// parameter describes it and the body of the request, if any, holds the
+// log of the installer. Once a host reports success it boots from its
+// local disk.
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	env := envFromRequest(r)
+
+	// Reports must come from the address the host polled from, so the ip
+	// parameter isn't trusted here
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	installLog, err := readReportLog(http.MaxBytesReader(w, r.Body, maxReportBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	vars := mux.Vars(r)
+	mac := utils.MacDashToColon(vars["mac"])
+	if !utils.IsValidMAC(mac) {
+		http.Error(w, polling.ErrInvalidMAC.Error(), http.StatusBadRequest)
+		return
+	}
+
+	srv := server.New(mac, ip, resolveHostname(loggerFromRequest(r), ip))
+	srv.Attributes = hardwareAttributes(r)
+	err = polling.Report(loggerFromRequest(r), env.ServerStates, env.Inventory, env.EventLog.ForRequest(requestIDFromRequest(r)), srv,
+		vars["phase"], r.URL.Query().Get("message"), installLog)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, polling.ErrInvalidMAC) || errors.Is(err, polling.ErrUnknownPhase):
+			status = http.StatusBadRequest
+		case errors.Is(err, polling.ErrNoReportExpected):
+			status = http.StatusConflict
+		case errors.Is(err, polling.ErrReporterMismatch):
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readReportLog reads the log sent along with a report, keeping its last
+// maxReportLog bytes.
+func readReportLog(body io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxReportLog {
+		data = data[len(data)-maxReportLog:]
+		return "[...]\n" + strings.ToValidUTF8(string(data), ""), nil
+	}
+	return string(data), nil
+}
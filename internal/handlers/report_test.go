@@ -0,0 +1,163 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/inventory"
+	"github.com/Didstopia/shoelaces/internal/mappings"
+	"github.com/Didstopia/shoelaces/internal/polling"
+	"github.com/Didstopia/shoelaces/internal/proxy"
+)
+
+func TestReport(t *testing.T) {
+	env := newTestEnv(t)
+	handler := newTestRouter(env)
+	machine, err := env.Inventory.Add(inventory.Machine{MAC: testMAC, Name: "node1", Script: "test.ipxe", Mode: mappings.ModeUntilDone})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := do(t, handler, "POST", "/report/"+testMAC+"/started", "")
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), polling.ErrNoReportExpected.Error()) {
+		t.Errorf("Expected a report before booting to conflict, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := poll(t, handler); !strings.Contains(rec.Body.String(), "set hostname node1\n") {
+		t.Fatalf("Expected the script of the machine, got %d: %q", rec.Code, rec.Body)
+	}
+
+	testCases := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"invalid mac", "/report/not-a-mac/started", http.StatusBadRequest},
+		{"unknown phase", "/report/" + testMAC + "/finished", http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		if rec := do(t, handler, "POST", tc.target, ""); rec.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.status, rec.Code, rec.Body)
+		}
+	}
+
+	// Only the address the host polled from may report
+	req := newRequest("POST", "/report/"+testMAC+"/success", "")
+	req.RemoteAddr = "192.0.2.2:1234"
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a report from another address to be forbidden, got %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := do(t, handler, "GET", "/report/"+testMAC+"/started?message=Installing", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected the start to be reported, got %d: %s", rec.Code, rec.Body)
+	}
+	if m, _ := env.Inventory.Get(machine.ID); m.Mode != mappings.ModeUntilDone {
+		t.Errorf("Expected the machine to keep its script while installing, got %q", m.Mode)
+	}
+	if rec := do(t, handler, "POST", "/report/"+testMAC+"/success", "Installed\n"); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected the success to be reported, got %d: %s", rec.Code, rec.Body)
+	}
+	if m, _ := env.Inventory.Get(machine.ID); m.Mode != mappings.ModeLocalBoot {
+		t.Errorf("Expected the machine to boot from its local disk, got %q", m.Mode)
+	}
+	if rec := do(t, handler, "POST", "/report/"+testMAC+"/success", ""); rec.Code != http.StatusConflict {
+		t.Errorf("Expected a second success to conflict, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := poll(t, handler); strings.Contains(rec.Body.String(), "set hostname") {
+		t.Errorf("Expected the host to boot from its local disk, got %q", rec.Body)
+	}
+
+	// Rejected reports aren't logged
+	events, err := env.EventLog.ListEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reports []event.Event
+	for _, e := range events["52:54:00:12:34:56"] {
+		if e.Type == event.InstallStarted || e.Type == event.InstallSuccess {
+			reports = append(reports, e)
+		}
+	}
+	if len(reports) != 2 || reports[0].Params["message"] != "Installing" || reports[1].Params["log"] != "Installed\n" {
+		t.Errorf("Expected the start and the success to be logged, got %+v", reports)
+	}
+}
+
+func TestReportTrustIPParam(t *testing.T) {
+	env := newTestEnv(t)
+	env.TrustIPParam = true
+	proxies, err := proxy.ParseTrusted("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Proxies = proxies
+	handler := newTestRouter(env)
+	if _, err := env.Inventory.Add(inventory.Machine{MAC: testMAC, Name: "node1", Script: "test.ipxe", Mode: mappings.ModeUntilDone}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The relay polls for the host
+	do(t, handler, "GET", "/poll/1/"+testMAC+"?host=test&ip=10.0.0.5", "")
+	if boot, ok := env.ServerStates.FindBoot("52:54:00:12:34:56"); !ok || boot.IP != "10.0.0.5" || boot.Peer != "192.0.2.1" {
+		t.Errorf("Expected the boot of 10.0.0.5 through 192.0.2.1, got %+v", boot)
+	}
+
+	// Other peers can't claim an address
+	req := newRequest("GET", "/poll/1/52-54-00-00-00-01?host=test&ip=10.0.0.6", "")
+	req.RemoteAddr = "192.0.2.2:1234"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if servers := polling.ListServers(env.ServerStates); len(servers) != 1 || servers[0].IP != "192.0.2.2" {
+		t.Errorf("Expected the address of the peer, got %+v", servers)
+	}
+
+	// Posting the log as curl --data-binary does keeps the log in the body
+	installLog := "a=1&b=2\n"
+	req = newRequest("POST", "/report/"+testMAC+"/success?ip=10.0.0.7", installLog)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected the success to be reported, got %d: %s", rec.Code, rec.Body)
+	}
+	events, err := env.EventLog.ListEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reported := events["52:54:00:12:34:56"]
+	if last := reported[len(reported)-1]; last.Type != event.InstallSuccess || last.Params["log"] != installLog {
+		t.Errorf("Expected the success with the log %q, got %+v", installLog, last)
+	}
+}
+
+func TestReadReportLog(t *testing.T) {
+	short, err := readReportLog(strings.NewReader("done\n"))
+	if err != nil || short != "done\n" {
+		t.Errorf("Expected the log as sent, got %q: %v", short, err)
+	}
+
+	long, err := readReportLog(strings.NewReader(strings.Repeat("a", maxReportLog) + "error\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(long, "[...]\n") || !strings.HasSuffix(long, "error\n") || len(long) != len("[...]\n")+maxReportLog {
+		t.Errorf("Expected the end of the log, got %d bytes", len(long))
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/polling"
+	"github.com/Didstopia/shoelaces/internal/stream"
+)
+
+// streamKeepAlive is how often a comment is sent to idle clients, so
+// proxies don't close the connection.
+const streamKeepAlive = 30 * time.Second
+
+// APIStreamHandler pushes the new events, the servers that start or stop
+// waiting for a target and the configuration reloads as server-sent
+// events. The servers waiting when the client connects are sent first.
+func APIStreamHandler(w http.ResponseWriter, r *http.Request) {
+	env := envFromRequest(r)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	// Subscribing first means no change is lost between the initial state
+	// and the first message, at the cost of maybe sending a server twice.
+	messages, unsubscribe := env.Stream.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	// Keeps nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, srv := range polling.ListServers(env.ServerStates) {
+		if err := writeStreamMessage(w, stream.Message{Type: stream.ServerAddedMessage, Data: srv}); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+
+		case m, ok := <-messages:
+			if !ok {
+				// Disconnected for falling behind, or shutting down
+				return
+			}
+			if err := writeStreamMessage(w, m); err != nil {
+				loggerFromRequest(r).Debug("component", "stream", "msg", "Client went away", "err", err)
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeStreamMessage(w io.Writer, m stream.Message) error {
+	data, err := json.Marshal(m.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.Type, data)
+	return err
+}
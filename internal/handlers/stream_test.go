@@ -0,0 +1,125 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/stream"
+)
+
+// readStreamMessage reads the next message of a server-sent event stream,
+// returning its event and data lines.
+func readStreamMessage(t *testing.T, r *bufio.Reader) (string, string) {
+	t.Helper()
+
+	var eventType, data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Expected a message, got %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return eventType, data
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestAPIStream(t *testing.T) {
+	env := newTestEnv(t)
+	ts := httptest.NewServer(newTestRouter(env))
+	defer ts.Close()
+
+	if rec := poll(t, newTestRouter(env)); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the poll to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/api/v1/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d, %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	body := bufio.NewReader(resp.Body)
+
+	// The servers already waiting come first
+	eventType, data := readStreamMessage(t, body)
+	if eventType != stream.ServerAddedMessage || !strings.Contains(data, `"Mac":"52:54:00:12:34:56"`) {
+		t.Errorf("Expected the waiting server, got %q: %s", eventType, data)
+	}
+
+	// Then the changes, as they're published
+	env.Stream.Publish(stream.Message{Type: stream.ServerRemovedMessage, Data: map[string]string{"Mac": "52:54:00:12:34:56"}})
+	eventType, data = readStreamMessage(t, body)
+	if eventType != stream.ServerRemovedMessage || data != `{"Mac":"52:54:00:12:34:56"}` {
+		t.Errorf("Expected the published message, got %q: %s", eventType, data)
+	}
+
+	// Closing the broker, as when shutting down, ends the stream
+	env.Stream.Close()
+	if line, err := body.ReadString('\n'); err == nil {
+		t.Errorf("Expected the stream to end, got %q", line)
+	}
+}
+
+func TestAPIStreamDisconnect(t *testing.T) {
+	env := newTestEnv(t)
+	ts := httptest.NewServer(newTestRouter(env))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/api/v1/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if clients := env.Stream.Clients(); clients != 1 {
+		t.Fatalf("Expected a subscribed client, got %d", clients)
+	}
+
+	// Clients going away are unsubscribed
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for env.Stream.Clients() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the client to be unsubscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
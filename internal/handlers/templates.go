@@ -20,7 +20,9 @@ import (
 	"net/http"
 	"path/filepath"
 
+	"github.com/Didstopia/shoelaces/internal/templates"
 	"github.com/Didstopia/shoelaces/internal/utils"
+	"github.com/gorilla/mux"
 )
 
 // TemplateHandler handles templated config files
@@ -43,9 +45,10 @@ func (t *TemplateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	env := envFromRequest(r)
 	envName := envNameFromRequest(r)
+	variablesMap["baseScheme"] = env.BaseScheme
 	variablesMap["baseURL"] = utils.BaseURLforEnvName(env.BaseURL, envName)
 
-	configString, err := env.Templates.RenderTemplate(env.Logger, configName, variablesMap, envName)
+	configString, err := env.Config().Templates.RenderTemplate(loggerFromRequest(r), configName, variablesMap, envName)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	} else {
@@ -58,30 +61,22 @@ func TemplateServer() *TemplateHandler {
 	return &TemplateHandler{}
 }
 
-// GetTemplateParams receives a script name and returns the parameters
-// required for completing that template.
+// GetTemplateParams receives a script name and returns the names of the
+// parameters required for completing that template. APIScriptParamsHandler
+// returns their metadata as well.
 func GetTemplateParams(w http.ResponseWriter, r *http.Request) {
-	var vars []string
-	env := envFromRequest(r)
-
-	filterBlacklist := func(s string) bool {
-		return !utils.StringInSlice(s, env.ParamsBlacklist)
-	}
-
 	script := r.URL.Query().Get("script")
 	if script == "" {
 		http.Error(w, "Required script parameter", http.StatusInternalServerError)
 		return
 	}
 
-	envName := r.URL.Query().Get("environment")
-	if envName == "" {
-		envName = "default"
+	names := make([]string, 0)
+	for _, p := range scriptParams(r, script, r.URL.Query().Get("environment")) {
+		names = append(names, p.Name)
 	}
 
-	vars = utils.Filter(env.Templates.ListVariables(script, envName), filterBlacklist)
-
-	marshaled, err := json.Marshal(vars)
+	marshaled, err := json.Marshal(names)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -89,3 +84,26 @@ func GetTemplateParams(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(marshaled)
 }
+
+// APIScriptParamsHandler returns the parameters of a script, with their
+// type, default and allowed values, for the environment query parameter.
+func APIScriptParamsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, scriptParams(r, mux.Vars(r)["script"], r.URL.Query().Get("environment")))
+}
+
+// scriptParams returns the parameters of a script that aren't set by
+// Shoelaces.
+func scriptParams(r *http.Request, script, envName string) []templates.Param {
+	env := envFromRequest(r)
+	if envName == "" {
+		envName = "default"
+	}
+
+	params := make([]templates.Param, 0)
+	for _, p := range env.Config().Templates.ListParams(script, envName) {
+		if !utils.StringInSlice(p.Name, env.ParamsBlacklist) {
+			params = append(params, p)
+		}
+	}
+	return params
+}
@@ -0,0 +1,390 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package inventory keeps track of the machines known to Shoelaces, so
+// they always boot the script assigned to them, whatever the mappings say.
+package inventory
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/mappings"
+)
+
+var (
+	// ErrNotFound is returned when a machine isn't in the inventory.
+	ErrNotFound = errors.New("Machine not found")
+	// ErrConflict is returned when a MAC, UUID or serial number already
+	// identifies another machine.
+	ErrConflict = errors.New("Another machine has the same identifier")
+	// ErrInvalid is returned for machines with invalid fields.
+	ErrInvalid = errors.New("Invalid machine")
+	// ErrNoIdentifier is returned for machines without MAC, UUID or serial
+	// number.
+	ErrNoIdentifier = errors.New("A MAC address, UUID or serial number is required")
+)
+
+// placeholders are the serial numbers and UUIDs firmwares report when the
+// vendor didn't set one. They're shared by many hosts, so they identify
+// none.
+var placeholders = map[string]bool{
+	"to be filled by o.e.m.": true,
+	"to be filled by oem":    true,
+	"default string":         true,
+	"system serial number":   true,
+	"chassis serial number":  true,
+	"not specified":          true,
+	"not available":          true,
+	"not applicable":         true,
+	"n/a":                    true,
+	"none":                   true,
+	"null":                   true,
+	"unknown":                true,
+	"invalid":                true,
+	"0123456789":             true,
+	"123456789":              true,
+	"1234567890":             true,
+}
+
+// Machine is a host known to Shoelaces. It's identified by any of its MAC
+// address, UUID and serial number, and it boots Script when it polls, if
+// there's one, as long as Mode says.
+type Machine struct {
+	ID          string                 `json:"id"`
+	MAC         string                 `json:"mac,omitempty"`
+	UUID        string                 `json:"uuid,omitempty"`
+	Serial      string                 `json:"serial,omitempty"`
+	Name        string                 `json:"name"`
+	Labels      map[string]string      `json:"labels,omitempty"`
+	Script      string                 `json:"script,omitempty"`
+	Environment string                 `json:"environment,omitempty"`
+	Params      map[string]interface{} `json:"params,omitempty"`
+	Mode        mappings.Mode          `json:"mode,omitempty"`
+	Updated     time.Time              `json:"updated"`
+}
+
+// Inventory holds the known machines. It's safe for concurrent use, and
+// never hands out the machines it holds, only copies.
+type Inventory struct {
+	mu       sync.RWMutex
+	machines map[string]*Machine
+	store    Store
+}
+
+// New returns an Inventory. If a store is given, the machines saved in it
+// are restored and every change is persisted there.
+func New(store Store) (*Inventory, error) {
+	inv := &Inventory{machines: make(map[string]*Machine), store: store}
+	if store == nil {
+		return inv, nil
+	}
+
+	saved, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range saved {
+		m := saved[i]
+		inv.machines[m.ID] = &m
+	}
+	return inv, nil
+}
+
+// List returns the machines sorted by name.
+func (inv *Inventory) List() []Machine {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+
+	machines := make([]Machine, 0, len(inv.machines))
+	for _, m := range inv.machines {
+		machines = append(machines, m.copy())
+	}
+	sortMachines(machines)
+	return machines
+}
+
+// Get returns the machine with the given ID.
+func (inv *Inventory) Get(id string) (Machine, error) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+
+	m, ok := inv.machines[id]
+	if !ok {
+		return Machine{}, ErrNotFound
+	}
+	return m.copy(), nil
+}
+
+// Find returns the machine identified by mac, or else by the uuid or
+// serial attributes reported by iPXE, in that order. Placeholder UUIDs and
+// serial numbers, and those shared by several machines, identify none.
+func (inv *Inventory) Find(mac string, attributes map[string]string) (Machine, bool) {
+	inv.mu.RLock()
+	defer inv.mu.RUnlock()
+
+	if m := inv.find(mac, attributes); m != nil {
+		return m.copy(), true
+	}
+	return Machine{}, false
+}
+
+// Upsert calls update with the machine identified like in Find, or with a
+// new machine with the given MAC address if there's none, and stores the
+// result.
+func (inv *Inventory) Upsert(mac string, attributes map[string]string, update func(m *Machine)) (Machine, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	var m Machine
+	if found := inv.find(mac, attributes); found != nil {
+		m = found.copy()
+	} else {
+		id, err := newID()
+		if err != nil {
+			return Machine{}, err
+		}
+		m = Machine{ID: id, MAC: mac}
+	}
+	update(&m)
+	return inv.put(m)
+}
+
+// find returns the machine identified by mac, uuid or serial number. The
+// caller must hold the lock.
+func (inv *Inventory) find(mac string, attributes map[string]string) *Machine {
+	mac = normalizeMAC(mac)
+	uuid := strings.ToLower(strings.TrimSpace(attributes["uuid"]))
+	if isPlaceholder(uuid) {
+		uuid = ""
+	}
+	serial := strings.TrimSpace(attributes["serial"])
+	if isPlaceholder(serial) {
+		serial = ""
+	}
+
+	var byUUID, bySerial []*Machine
+	for _, m := range inv.machines {
+		if mac != "" && m.MAC == mac {
+			return m
+		}
+		if uuid != "" && m.UUID == uuid {
+			byUUID = append(byUUID, m)
+		}
+		if serial != "" && m.Serial == serial {
+			bySerial = append(bySerial, m)
+		}
+	}
+	// Machines restored from the store aren't validated, so an identifier
+	// may still be shared, and then it's ambiguous
+	if len(byUUID) == 1 {
+		return byUUID[0]
+	}
+	if len(bySerial) == 1 {
+		return bySerial[0]
+	}
+	return nil
+}
+
+// Add adds a machine to the inventory, with a new ID, and returns it.
+func (inv *Inventory) Add(m Machine) (Machine, error) {
+	id, err := newID()
+	if err != nil {
+		return Machine{}, err
+	}
+	m.ID = id
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.put(m)
+}
+
+// Update replaces the machine with the ID of m.
+func (inv *Inventory) Update(m Machine) (Machine, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if _, ok := inv.machines[m.ID]; !ok {
+		return Machine{}, ErrNotFound
+	}
+	return inv.put(m)
+}
+
+// Delete removes the machine with the given ID.
+func (inv *Inventory) Delete(id string) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	old, ok := inv.machines[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(inv.machines, id)
+	if err := inv.save(); err != nil {
+		inv.machines[id] = old
+		return err
+	}
+	return nil
+}
+
+// put validates and stores m. The caller must hold the lock.
+func (inv *Inventory) put(m Machine) (Machine, error) {
+	if err := m.normalize(); err != nil {
+		return Machine{}, err
+	}
+	for id, other := range inv.machines {
+		if id == m.ID {
+			continue
+		}
+		if (m.MAC != "" && m.MAC == other.MAC) || (m.UUID != "" && m.UUID == other.UUID) ||
+			(m.Serial != "" && m.Serial == other.Serial) {
+			return Machine{}, fmt.Errorf("%w: %s", ErrConflict, other.displayName())
+		}
+	}
+	m.Updated = time.Now().UTC()
+
+	old, existed := inv.machines[m.ID]
+	stored := m.copy()
+	inv.machines[m.ID] = &stored
+	if err := inv.save(); err != nil {
+		if existed {
+			inv.machines[m.ID] = old
+		} else {
+			delete(inv.machines, m.ID)
+		}
+		return Machine{}, err
+	}
+	return m, nil
+}
+
+// save persists the machines. The caller must hold the lock.
+func (inv *Inventory) save() error {
+	if inv.store == nil {
+		return nil
+	}
+	machines := make([]Machine, 0, len(inv.machines))
+	for _, m := range inv.machines {
+		machines = append(machines, *m)
+	}
+	sortMachines(machines)
+	return inv.store.Save(machines)
+}
+
+// normalize validates the identifiers of m and writes them in a canonical
+// form, so lookups don't depend on how they were typed.
+func (m *Machine) normalize() error {
+	m.MAC = strings.TrimSpace(m.MAC)
+	if m.MAC != "" {
+		hw, err := net.ParseMAC(m.MAC)
+		if err != nil || len(hw) != 6 {
+			return fmt.Errorf("%w: invalid MAC address %q", ErrInvalid, m.MAC)
+		}
+		m.MAC = hw.String()
+	}
+	m.UUID = strings.ToLower(strings.TrimSpace(m.UUID))
+	m.Serial = strings.TrimSpace(m.Serial)
+	m.Name = strings.TrimSpace(m.Name)
+
+	if m.UUID != "" && isPlaceholder(m.UUID) {
+		return fmt.Errorf("%w: %q is a placeholder UUID", ErrInvalid, m.UUID)
+	}
+	if m.Serial != "" && isPlaceholder(m.Serial) {
+		return fmt.Errorf("%w: %q is a placeholder serial number", ErrInvalid, m.Serial)
+	}
+
+	if m.MAC == "" && m.UUID == "" && m.Serial == "" {
+		return ErrNoIdentifier
+	}
+	if m.Mode == "" {
+		m.Mode = mappings.ModeAlways
+	}
+	if !m.Mode.Valid() {
+		return fmt.Errorf("%w: unknown mode %q", ErrInvalid, m.Mode)
+	}
+	if m.Script == "" && m.Environment != "" {
+		return fmt.Errorf("%w: an environment requires a script", ErrInvalid)
+	}
+	if m.Script == "" && (m.Mode == mappings.ModeOnce || m.Mode == mappings.ModeUntilDone) {
+		return fmt.Errorf("%w: the %s mode requires a script", ErrInvalid, m.Mode)
+	}
+	return nil
+}
+
+func (m *Machine) displayName() string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return m.ID
+}
+
+func (m *Machine) copy() Machine {
+	c := *m
+	if m.Labels != nil {
+		c.Labels = make(map[string]string, len(m.Labels))
+		for k, v := range m.Labels {
+			c.Labels[k] = v
+		}
+	}
+	if m.Params != nil {
+		c.Params = make(map[string]interface{}, len(m.Params))
+		for k, v := range m.Params {
+			c.Params[k] = v
+		}
+	}
+	return c
+}
+
+// isPlaceholder returns whether a UUID or serial number is empty, a known
+// placeholder, or a single repeated character, like the all-zero and
+// all-F UUIDs.
+func isPlaceholder(id string) bool {
+	id = strings.ToLower(strings.TrimSpace(id))
+	if id == "" || placeholders[id] {
+		return true
+	}
+	id = strings.ReplaceAll(id, "-", "")
+	return id == "" || strings.Count(id, id[:1]) == len(id)
+}
+
+func normalizeMAC(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return ""
+	}
+	return hw.String()
+}
+
+func sortMachines(machines []Machine) {
+	sort.Slice(machines, func(i, j int) bool {
+		if machines[i].Name != machines[j].Name {
+			return machines[i].Name < machines[j].Name
+		}
+		return machines[i].ID < machines[j].ID
+	})
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
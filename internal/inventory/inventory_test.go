@@ -0,0 +1,226 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/Didstopia/shoelaces/internal/mappings"
+)
+
+func TestInventoryFind(t *testing.T) {
+	inv, err := New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byMAC, err := inv.Add(Machine{MAC: "52-54-00-AA-BB-CC", Name: "by-mac"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byUUID, err := inv.Add(Machine{UUID: "4C4C4544-0042-3510-8052-B4C04F4E4B32", Name: "by-uuid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bySerial, err := inv.Add(Machine{Serial: "CN7475", Name: "by-serial"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byMAC.MAC != "52:54:00:aa:bb:cc" || byUUID.UUID != "4c4c4544-0042-3510-8052-b4c04f4e4b32" {
+		t.Errorf("Expected normalized identifiers, got %q and %q", byMAC.MAC, byUUID.UUID)
+	}
+
+	testCases := []struct {
+		name       string
+		mac        string
+		attributes map[string]string
+		want       string
+	}{
+		{"mac", "52:54:00:aa:bb:cc", map[string]string{"serial": "CN7475"}, byMAC.ID},
+		{"uuid", "52:54:00:00:00:01", map[string]string{"uuid": "4C4C4544-0042-3510-8052-B4C04F4E4B32", "serial": "CN7475"}, byUUID.ID},
+		{"serial", "52:54:00:00:00:01", map[string]string{"serial": "CN7475"}, bySerial.ID},
+		{"unknown", "52:54:00:00:00:01", nil, ""},
+	}
+	for _, tc := range testCases {
+		m, ok := inv.Find(tc.mac, tc.attributes)
+		if ok != (tc.want != "") || m.ID != tc.want {
+			t.Errorf("%s: expected machine %q, got %q", tc.name, tc.want, m.ID)
+		}
+	}
+}
+
+func TestInventoryFindPlaceholders(t *testing.T) {
+	inv, _ := New(nil)
+	for _, m := range []Machine{
+		{Serial: "To Be Filled By O.E.M."},
+		{Serial: "0123456789"},
+		{UUID: "00000000-0000-0000-0000-000000000000"},
+		{UUID: "FFFFFFFF-FFFF-FFFF-FFFF-FFFFFFFFFFFF"},
+	} {
+		if _, err := inv.Add(m); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Expected %+v to be rejected, got %v", m, err)
+		}
+	}
+
+	// Saved inventories aren't validated, so they may hold placeholders and
+	// shared identifiers
+	inv.machines["a"] = &Machine{ID: "a", Serial: "To Be Filled By O.E.M.", UUID: "4c4c4544-0042-3510-8052-b4c04f4e4b32"}
+	inv.machines["b"] = &Machine{ID: "b", Serial: "To Be Filled By O.E.M.", UUID: "4c4c4544-0042-3510-8052-b4c04f4e4b32"}
+	inv.machines["c"] = &Machine{ID: "c", Serial: "CN7475", UUID: "00000000-0000-0000-0000-000000000000"}
+
+	testCases := []struct {
+		name       string
+		attributes map[string]string
+		want       string
+	}{
+		{"placeholder serial", map[string]string{"serial": "To Be Filled By O.E.M."}, ""},
+		{"placeholder uuid", map[string]string{"uuid": "00000000-0000-0000-0000-000000000000"}, ""},
+		{"shared uuid", map[string]string{"uuid": "4C4C4544-0042-3510-8052-B4C04F4E4B32"}, ""},
+		{"unique serial", map[string]string{"uuid": "00000000-0000-0000-0000-000000000000", "serial": "CN7475"}, "c"},
+		{"shared uuid, unique serial", map[string]string{"uuid": "4C4C4544-0042-3510-8052-B4C04F4E4B32", "serial": "CN7475"}, "c"},
+	}
+	for _, tc := range testCases {
+		m, ok := inv.Find("52:54:00:00:00:01", tc.attributes)
+		if ok != (tc.want != "") || m.ID != tc.want {
+			t.Errorf("%s: expected machine %q, got %q", tc.name, tc.want, m.ID)
+		}
+	}
+
+	// Hosts reporting placeholders get machines of their own
+	added, err := inv.Upsert("52:54:00:00:00:02", map[string]string{"serial": "To Be Filled By O.E.M."}, func(m *Machine) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.ID == "a" || added.ID == "b" {
+		t.Errorf("Expected a new machine, got %q", added.ID)
+	}
+}
+
+func TestInventoryValidation(t *testing.T) {
+	inv, _ := New(nil)
+	existing, err := inv.Add(Machine{MAC: "52:54:00:aa:bb:cc", Serial: "CN7475"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		machine Machine
+		want    error
+	}{
+		{"no identifier", Machine{Name: "nothing"}, ErrNoIdentifier},
+		{"duplicate mac", Machine{MAC: "52-54-00-AA-BB-CC"}, ErrConflict},
+		{"duplicate serial", Machine{Serial: "CN7475"}, ErrConflict},
+		{"unknown mode", Machine{MAC: "52:54:00:00:00:02", Mode: "twice"}, ErrInvalid},
+		{"once without script", Machine{MAC: "52:54:00:00:00:02", Mode: mappings.ModeOnce}, ErrInvalid},
+	}
+	for _, tc := range testCases {
+		if _, err := inv.Add(tc.machine); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+	}
+	if _, err := inv.Add(Machine{MAC: "not a mac"}); err == nil {
+		t.Error("Expected an error for an invalid MAC")
+	}
+
+	existing.Name = "renamed"
+	if _, err := inv.Update(existing); err != nil {
+		t.Errorf("Expected a machine to keep its own identifiers, got %v", err)
+	}
+	if _, err := inv.Update(Machine{ID: "missing", MAC: "52:54:00:00:00:01"}); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if len(inv.List()) != 1 {
+		t.Errorf("Expected a single machine, got %d", len(inv.List()))
+	}
+}
+
+func TestInventoryUpsert(t *testing.T) {
+	inv, _ := New(nil)
+	existing, err := inv.Add(Machine{Serial: "CN7475", Name: "node1", Script: "coreos.ipxe", Mode: mappings.ModeUntilDone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing.Mode != mappings.ModeUntilDone {
+		t.Errorf("Expected the until-reported-done mode, got %q", existing.Mode)
+	}
+
+	toLocalBoot := func(m *Machine) { m.Mode = mappings.ModeLocalBoot }
+	updated, err := inv.Upsert("52:54:00:aa:bb:cc", map[string]string{"serial": "CN7475"}, toLocalBoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ID != existing.ID || updated.Mode != mappings.ModeLocalBoot || updated.Script != "coreos.ipxe" {
+		t.Errorf("Expected the existing machine to switch to local boot, got %+v", updated)
+	}
+
+	added, err := inv.Upsert("52-54-00-AA-BB-CD", nil, toLocalBoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.ID == existing.ID || added.MAC != "52:54:00:aa:bb:cd" || added.Mode != mappings.ModeLocalBoot {
+		t.Errorf("Expected a new machine booting from the local disk, got %+v", added)
+	}
+	if len(inv.List()) != 2 {
+		t.Errorf("Expected 2 machines, got %d", len(inv.List()))
+	}
+}
+
+func TestInventoryRestore(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "inventory.json"))
+	inv, err := New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := inv.Add(Machine{
+		MAC:         "52:54:00:aa:bb:cc",
+		Name:        "node1",
+		Labels:      map[string]string{"rack": "a1"},
+		Script:      "coreos.ipxe",
+		Environment: "production",
+		Params:      map[string]interface{}{"version": "666.0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, err := inv.Add(Machine{MAC: "52:54:00:aa:bb:cd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inv.Delete(gone.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machines := restored.List()
+	if len(machines) != 1 {
+		t.Fatalf("Expected 1 machine, got %d", len(machines))
+	}
+	got := machines[0]
+	if got.ID != m.ID || got.Name != "node1" || got.Labels["rack"] != "a1" || got.Script != "coreos.ipxe" ||
+		got.Environment != "production" || got.Params["version"] != "666.0" {
+		t.Errorf("Unexpected restored machine: %+v", got)
+	}
+
+	// Changing a returned machine doesn't change the inventory
+	got.Params["version"] = "changed"
+	if again, _ := restored.Get(m.ID); again.Params["version"] != "666.0" {
+		t.Error("Expected the inventory to hand out copies")
+	}
+}
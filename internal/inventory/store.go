@@ -0,0 +1,52 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"github.com/Didstopia/shoelaces/internal/utils"
+)
+
+// Store persists the inventory.
+type Store interface {
+	// Save replaces the stored machines with the given ones.
+	Save(machines []Machine) error
+	// Load returns the stored machines.
+	Load() ([]Machine, error)
+}
+
+// FileStore keeps the inventory in a JSON file.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore returns a FileStore that uses the file at path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Save writes the machines, never leaving the file half written.
+func (f *FileStore) Save(machines []Machine) error {
+	return utils.WriteJSON(f.path, machines)
+}
+
+// Load reads the machines from the file. A missing file means an empty
+// inventory.
+func (f *FileStore) Load() ([]Machine, error) {
+	machines := make([]Machine, 0)
+	if err := utils.ReadJSON(f.path, &machines); err != nil {
+		return nil, err
+	}
+	return machines, nil
+}
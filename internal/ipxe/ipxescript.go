@@ -37,6 +37,9 @@ type Script struct {
 	Name ScriptName
 	Env  EnvName
 	Path ScriptPath
+	// Description and Category come from the metadata of the template.
+	Description string
+	Category    string
 }
 
 // ScriptList receives the global environment and return a list of IPXE
@@ -48,13 +51,19 @@ func ScriptList(env *environment.Environment) []Script {
 		filepath.Join(env.DataDir, "ipxe"), "", "/configs/")
 
 	// Collect scripts from the config environments if any
-	if len(env.Environments) > 0 {
-		for _, e := range env.Environments {
+	if environments := env.Config().Environments; len(environments) > 0 {
+		for _, e := range environments {
 			ep := filepath.Join(env.DataDir, env.EnvDir, e, "ipxe")
 			ipxeScripts = appendScriptsFromDir(env.Logger, ipxeScripts, env.TemplateExtension, ep,
 				EnvName(e), ScriptPath("/env/"+e+"/configs/"))
 		}
 	}
+
+	for i, s := range ipxeScripts {
+		meta := env.Config().Templates.Metadata(string(s.Name), string(s.Env))
+		ipxeScripts[i].Description = meta.Description
+		ipxeScripts[i].Category = meta.Category
+	}
 	return ipxeScripts
 }
 
@@ -69,7 +78,7 @@ func appendScriptsFromDir(logger log.Logger, scripts []Script, templateExtension
 func scriptDirList(logger log.Logger, templateExtension string, datadir string) []ScriptName {
 	files, err := ioutil.ReadDir(datadir)
 	if err != nil {
-		logger.Info("component=ipxescript action=dir-list dir=%s err=\"%v\"", datadir, err.Error())
+		logger.Info("component", "ipxescript", "msg", "Failed to list scripts", "dir", datadir, "err", err)
 		return nil
 	}
 
@@ -15,12 +15,26 @@
 package log
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 )
 
+// Log formats.
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// Log levels. Every level includes the ones after it.
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelError = "error"
+)
+
 // Logger struct holds a log.Logger plus functions required for logging
 // with different levels. They functions are syntactic sugar to avoid
 // having to import "github.com/go-kit/kit/log/level" in every package that
@@ -30,32 +44,78 @@ type Logger struct {
 	Info  func(...interface{}) error
 	Debug func(...interface{}) error
 	Error func(...interface{}) error
+
+	allow level.Option
 }
 
-const callerLevel int = 6
+// callerLevel is the depth of the caller of Info, Debug and Error, which is
+// reported in every line.
+const callerLevel int = 5
 
 // MakeLogger receives a io.Writer and return a Logger struct.
 func MakeLogger(w io.Writer) Logger {
-	raw := log.NewLogfmtLogger(log.NewSyncWriter(w))
+	l, _ := New(w, FormatLogfmt, LevelInfo)
+	return l
+}
+
+// New returns a Logger writing to w in the given format, logfmt or json,
+// and discarding the lines below the given level.
+func New(w io.Writer, format, lvl string) (Logger, error) {
+	var raw log.Logger
+	switch format {
+	case FormatLogfmt:
+		raw = log.NewLogfmtLogger(log.NewSyncWriter(w))
+	case FormatJSON:
+		raw = log.NewJSONLogger(log.NewSyncWriter(w))
+	default:
+		return Logger{}, fmt.Errorf("unknown log format %q", format)
+	}
+
+	allow, err := parseLevel(lvl)
+	if err != nil {
+		return Logger{}, err
+	}
+
 	raw = log.With(raw, "ts", log.DefaultTimestampUTC, "caller", log.Caller(callerLevel))
-	filtered := level.NewFilter(raw, level.AllowInfo())
+	return newLogger(raw, allow), nil
+}
+
+func newLogger(raw log.Logger, allow level.Option) Logger {
+	filtered := level.NewFilter(raw, allow)
 
 	return Logger{
 		Raw:   raw,
 		Info:  level.Info(filtered).Log,
 		Debug: level.Debug(filtered).Log,
 		Error: level.Error(filtered).Log,
+		allow: allow,
+	}
+}
+
+func parseLevel(lvl string) (level.Option, error) {
+	switch lvl {
+	case LevelDebug:
+		return level.AllowDebug(), nil
+	case LevelInfo:
+		return level.AllowInfo(), nil
+	case LevelError:
+		return level.AllowError(), nil
+	default:
+		return nil, fmt.Errorf("unknown log level %q", lvl)
 	}
 }
 
 // AllowDebug receives a Logger and enables the debug logging level.
 func AllowDebug(l Logger) Logger {
-	filtered := level.NewFilter(l.Raw, level.AllowDebug())
+	return newLogger(l.Raw, level.AllowDebug())
+}
 
-	return Logger{
-		Raw:   l.Raw,
-		Info:  level.Info(filtered).Log,
-		Debug: level.Debug(filtered).Log,
-		Error: level.Error(filtered).Log,
+// With returns a Logger adding the given key/value pairs to every line,
+// like the ID of the request being handled.
+func (l Logger) With(keyvals ...interface{}) Logger {
+	allow := l.allow
+	if allow == nil {
+		allow = level.AllowInfo()
 	}
+	return newLogger(log.With(l.Raw, keyvals...), allow)
 }
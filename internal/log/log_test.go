@@ -0,0 +1,95 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	var b bytes.Buffer
+	logger, err := New(&b, FormatJSON, LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger = logger.With("request_id", "abc")
+
+	logger.Debug("component", "test", "msg", "Hidden")
+	logger.Info("component", "test", "msg", "Shown")
+
+	var line map[string]string
+	if err := json.Unmarshal(b.Bytes(), &line); err != nil {
+		t.Fatalf("Expected a single JSON line, got %q: %v", b.String(), err)
+	}
+	if line["msg"] != "Shown" || line["level"] != "info" || line["request_id"] != "abc" {
+		t.Errorf("Unexpected line: %v", line)
+	}
+	if !strings.HasPrefix(line["caller"], "log_test.go:") {
+		t.Errorf("Expected the caller to be the test, got %q", line["caller"])
+	}
+
+	b.Reset()
+	logger, _ = New(&b, FormatLogfmt, LevelError)
+	logger.Info("component", "test", "msg", "Hidden")
+	logger.Error("component", "test", "msg", "Shown")
+	if !strings.Contains(b.String(), `level=error component=test msg=Shown`) || strings.Contains(b.String(), "Hidden") {
+		t.Errorf("Unexpected output: %q", b.String())
+	}
+
+	if _, err := New(&b, "xml", LevelInfo); err == nil {
+		t.Error("Expected an error with an unknown format")
+	}
+	if _, err := New(&b, FormatJSON, "verbose"); err == nil {
+		t.Error("Expected an error with an unknown level")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shoelaces.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for p, want := range expected {
+		got, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: expected %q, got %q", filepath.Base(p), want, got)
+		}
+	}
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) != 2 {
+		t.Errorf("Expected 2 rotated files, got %v", matches)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const macLen = 6
+
+// MACRange is a contiguous range of MAC addresses. It's written as an
+// exact address ("52:54:00:12:34:56"), a prefix of up to five octets, like
+// an OUI ("52:54:00"), or two addresses separated by a dash
+// ("52:54:00:00:00:00-52:54:00:00:00:ff"). Octets can also be separated
+// by dashes, as iPXE does.
+type MACRange struct {
+	First uint64
+	Last  uint64
+	spec  string
+}
+
+// ParseMACRange parses a MAC address, prefix or range.
+func ParseMACRange(spec string) (MACRange, error) {
+	s := strings.ToLower(strings.TrimSpace(spec))
+
+	// With dashes as octet separators, a range has 11 dashes.
+	if from, to, ok := splitRange(s); ok {
+		first, n, err := parseMACOctets(from)
+		if err != nil || n != macLen {
+			return MACRange{}, fmt.Errorf("invalid MAC range %q", spec)
+		}
+		last, n, err := parseMACOctets(to)
+		if err != nil || n != macLen || last < first {
+			return MACRange{}, fmt.Errorf("invalid MAC range %q", spec)
+		}
+		return MACRange{First: first, Last: last, spec: spec}, nil
+	}
+
+	prefix, n, err := parseMACOctets(s)
+	if err != nil {
+		return MACRange{}, fmt.Errorf("invalid MAC address or prefix %q", spec)
+	}
+	shift := uint(8 * (macLen - n))
+	first := prefix << shift
+	return MACRange{First: first, Last: first | (1<<shift - 1), spec: spec}, nil
+}
+
+func splitRange(s string) (from, to string, ok bool) {
+	if strings.Contains(s, ":") {
+		parts := strings.Split(s, "-")
+		if len(parts) != 2 {
+			return "", "", false
+		}
+		return parts[0], parts[1], true
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2*macLen {
+		return "", "", false
+	}
+	return strings.Join(parts[:macLen], "-"), strings.Join(parts[macLen:], "-"), true
+}
+
+// parseMACOctets parses up to six hexadecimal octets separated by colons
+// or dashes, returning their value and how many there were.
+func parseMACOctets(s string) (value uint64, n int, err error) {
+	octets := strings.FieldsFunc(s, func(r rune) bool { return r == ':' || r == '-' })
+	if len(octets) == 0 || len(octets) > macLen || len(octets) != strings.Count(s, ":")+strings.Count(s, "-")+1 {
+		return 0, 0, fmt.Errorf("invalid MAC %q", s)
+	}
+	for _, o := range octets {
+		if len(o) != 2 {
+			return 0, 0, fmt.Errorf("invalid MAC octet %q", o)
+		}
+		b, err := strconv.ParseUint(o, 16, 8)
+		if err != nil {
+			return 0, 0, err
+		}
+		value = value<<8 | b
+	}
+	return value, len(octets), nil
+}
+
+// Contains returns whether mac, as accepted by net.ParseMAC, is in the
+// range.
+func (r MACRange) Contains(mac string) bool {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != macLen {
+		return false
+	}
+	var value uint64
+	for _, b := range hw {
+		value = value<<8 | uint64(b)
+	}
+	return value >= r.First && value <= r.Last
+}
+
+// Size returns how many addresses the range contains.
+func (r MACRange) Size() uint64 {
+	return r.Last - r.First + 1
+}
+
+func (r MACRange) String() string {
+	return r.spec
+}
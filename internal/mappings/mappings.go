@@ -20,11 +20,52 @@ import (
 	"strings"
 )
 
-// Script holds information related to a booting script.
+// Script holds information related to a booting script, and how long it
+// applies to the hosts it's assigned to. The scripts of the mappings are
+// shared by every request, so they must not be modified. The Find
+// functions return copies instead.
 type Script struct {
 	Name        string
 	Environment string
 	Params      map[string]interface{}
+	Mode        Mode
+}
+
+// Clone returns a deep copy of the script, which always has a Params map.
+func (s *Script) Clone() *Script {
+	c := *s
+	c.Params = cloneParams(s.Params)
+	return &c
+}
+
+// cloneParams copies a map of parameters, along with the maps and lists
+// they hold, like the ones decoded from YAML.
+func cloneParams(params map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		c[k] = cloneValue(v)
+	}
+	return c
+}
+
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return cloneParams(v)
+	case map[interface{}]interface{}:
+		c := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			c[k] = cloneValue(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = cloneValue(e)
+		}
+		return c
+	}
+	return v
 }
 
 // NetworkMap struct contains an association between a CIDR network and a
@@ -41,13 +82,78 @@ type HostnameMap struct {
 	Script   *Script
 }
 
+// MACMap struct contains an association between a MAC address, prefix or
+// range and a Script.
+type MACMap struct {
+	MAC    MACRange
+	Script *Script
+}
+
+// HardwareMap struct contains an association between a set of hardware
+// attribute regular expressions and a Script. All of them must match.
+type HardwareMap struct {
+	Match  map[string]*regexp.Regexp
+	Script *Script
+}
+
+// AttributeNames are the hardware attributes reported by iPXE that hardware
+// mappings can match on.
+var AttributeNames = []string{"manufacturer", "product", "serial", "uuid", "platform", "buildarch"}
+
+// IPXEAttributesQuery is the query string that makes iPXE report the
+// hardware attributes when polling, along with its IP address.
+const IPXEAttributesQuery = "?manufacturer=${manufacturer:uristring}&product=${product:uristring}" +
+	"&serial=${serial:uristring}&uuid=${uuid}&platform=${platform}&buildarch=${buildarch}&ip=${netX/ip}"
+
+// FindScriptForMAC receives a MACMap and a MAC address and returns a copy
+// of the script of the most specific mapping containing it: exact addresses win
+// over ranges, and smaller ranges over larger ones. Ties go to the first
+// mapping.
+func FindScriptForMAC(maps []MACMap, mac string) (script *Script, ok bool) {
+	var best *MACMap
+	for i, m := range maps {
+		if m.MAC.Contains(mac) && (best == nil || m.MAC.Size() < best.MAC.Size()) {
+			best = &maps[i]
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	return best.Script.Clone(), true
+}
+
+// FindScriptForHardware receives a HardwareMap and the attributes of a
+// host, and returns a copy of the script of the first mapping whose
+// expressions all match.
+func FindScriptForHardware(maps []HardwareMap, attributes map[string]string) (script *Script, ok bool) {
+	for _, m := range maps {
+		if matchAttributes(m.Match, attributes) {
+			return m.Script.Clone(), true
+		}
+	}
+	return nil, false
+}
+
+func matchAttributes(match map[string]*regexp.Regexp, attributes map[string]string) bool {
+	if len(match) == 0 {
+		return false
+	}
+	for name, regex := range match {
+		value, ok := attributes[name]
+		if !ok || !regex.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
 // FindScriptForHostname receives a HostnameMap and a string (that can be a
 // regular expression), and tries to find a match in that map. If it finds
-// a match, it returns the associated script.
+// a match, it returns a copy of the associated script.
 func FindScriptForHostname(maps []HostnameMap, hostname string) (script *Script, ok bool) {
 	for _, m := range maps {
 		if m.Hostname.MatchString(hostname) {
-			return m.Script, true
+			return m.Script.Clone(), true
 		}
 	}
 	return nil, false
@@ -55,22 +161,28 @@ func FindScriptForHostname(maps []HostnameMap, hostname string) (script *Script,
 
 // FindScriptForNetwork receives a NetworkMap and an IP and tries to see if
 // that IP belongs to any of the configured networks. If it finds a match,
-// it returns the associated script.
+// it returns a copy of the associated script.
 func FindScriptForNetwork(maps []NetworkMap, ip string) (script *Script, ok bool) {
 	for _, m := range maps {
 		if m.Network.Contains(net.ParseIP(ip)) {
-			return m.Script, true
+			return m.Script.Clone(), true
 		}
 	}
 	return nil, false
 }
 
 func (s Script) String() string {
+	if s.Name == "" && s.Mode == ModeLocalBoot {
+		return "local boot"
+	}
 	var result = s.Name + " : { "
 	elems := []string{}
 	if s.Environment != "" {
 		elems = append(elems, "environment: "+s.Environment)
 	}
+	if s.Mode != "" && s.Mode != ModeAlways {
+		elems = append(elems, "mode: "+string(s.Mode))
+	}
 	for key, value := range s.Params {
 		elems = append(elems, key+": "+value.(string))
 	}
@@ -67,6 +67,30 @@ func TestScript(t *testing.T) {
 	}
 }
 
+func TestParseMode(t *testing.T) {
+	testCases := []struct {
+		input string
+		want  Mode
+		ok    bool
+	}{
+		{"", ModeAlways, true},
+		{"once", ModeOnce, true},
+		{"until-reported-done", ModeUntilDone, true},
+		{"local-boot", ModeLocalBoot, true},
+		{"Once", "", false},
+		{"twice", "", false},
+	}
+	for _, tc := range testCases {
+		got, err := ParseMode(tc.input, ModeAlways)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%q: expected %q (ok: %v), got %q (%v)", tc.input, tc.want, tc.ok, got, err)
+		}
+	}
+	if Mode("").Valid() {
+		t.Error("Expected the empty mode to be invalid")
+	}
+}
+
 func TestFindScriptForHostname(t *testing.T) {
 	maps := []HostnameMap{mockHostNameMap1, mockHostNameMap2}
 	script, success := FindScriptForHostname(maps, "mock_host1")
@@ -98,3 +122,140 @@ func TestScriptForNetwork(t *testing.T) {
 		t.Error("IP shouildn't have matched the network map")
 	}
 }
+
+func TestParseMACRange(t *testing.T) {
+	testCases := []struct {
+		spec    string
+		first   uint64
+		last    uint64
+		invalid bool
+	}{
+		{spec: "52:54:00:12:34:56", first: 0x525400123456, last: 0x525400123456},
+		{spec: "52-54-00-12-34-56", first: 0x525400123456, last: 0x525400123456},
+		{spec: "52:54:00", first: 0x525400000000, last: 0x525400ffffff},
+		{spec: "52:54:00:00:00:00-52:54:00:00:00:FF", first: 0x525400000000, last: 0x5254000000ff},
+		{spec: "52-54-00-00-00-00-52-54-00-00-00-ff", first: 0x525400000000, last: 0x5254000000ff},
+		{spec: "52:54:00:00:00:ff-52:54:00:00:00:00", invalid: true},
+		{spec: "52:54:00-52:54:01", invalid: true},
+		{spec: "52:54:0", invalid: true},
+		{spec: "52::00", invalid: true},
+		{spec: "52:54:00:12:34:56:78", invalid: true},
+		{spec: "zz:54:00", invalid: true},
+		{spec: "", invalid: true},
+	}
+
+	for _, tc := range testCases {
+		r, err := ParseMACRange(tc.spec)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %x-%x", tc.spec, r.First, r.Last)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.spec, err)
+			continue
+		}
+		if r.First != tc.first || r.Last != tc.last {
+			t.Errorf("%q: expected %x-%x, got %x-%x", tc.spec, tc.first, tc.last, r.First, r.Last)
+		}
+	}
+}
+
+func TestFindScriptForMAC(t *testing.T) {
+	mustParse := func(spec string) MACRange {
+		r, err := ParseMACRange(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	oui := &Script{Name: "oui"}
+	rng := &Script{Name: "range"}
+	exact := &Script{Name: "exact"}
+	maps := []MACMap{
+		{MAC: mustParse("52:54:00"), Script: oui},
+		{MAC: mustParse("52:54:00:00:00:00-52:54:00:00:00:ff"), Script: rng},
+		{MAC: mustParse("52:54:00:00:00:10"), Script: exact},
+	}
+
+	testCases := []struct {
+		mac  string
+		want *Script
+	}{
+		{"52:54:00:00:00:10", exact},
+		{"52:54:00:00:00:11", rng},
+		{"52:54:00:00:01:00", oui},
+		{"52:54:01:00:00:00", nil},
+		{"not a mac", nil},
+	}
+	for _, tc := range testCases {
+		script, ok := FindScriptForMAC(maps, tc.mac)
+		if !sameScript(script, tc.want) || ok != (tc.want != nil) {
+			t.Errorf("%s: expected %v, got %v", tc.mac, tc.want, script)
+		}
+	}
+}
+
+func TestFindScriptForHardware(t *testing.T) {
+	dell := &Script{Name: "dell"}
+	efi := &Script{Name: "efi"}
+	maps := []HardwareMap{
+		{Match: map[string]*regexp.Regexp{
+			"manufacturer": regexp.MustCompile("^Dell"),
+			"product":      regexp.MustCompile("R6[0-9]0"),
+		}, Script: dell},
+		{Match: map[string]*regexp.Regexp{"platform": regexp.MustCompile("^efi$")}, Script: efi},
+	}
+
+	testCases := []struct {
+		name       string
+		attributes map[string]string
+		want       *Script
+	}{
+		{"all match", map[string]string{"manufacturer": "Dell Inc.", "product": "PowerEdge R640", "platform": "efi"}, dell},
+		{"first in order", map[string]string{"manufacturer": "Dell Inc.", "product": "PowerEdge R650"}, dell},
+		{"partial match", map[string]string{"manufacturer": "Dell Inc.", "product": "PowerEdge R740", "platform": "efi"}, efi},
+		{"missing attribute", map[string]string{"manufacturer": "Dell Inc."}, nil},
+		{"no attributes", nil, nil},
+	}
+	for _, tc := range testCases {
+		script, ok := FindScriptForHardware(maps, tc.attributes)
+		if !sameScript(script, tc.want) || ok != (tc.want != nil) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, script)
+		}
+	}
+}
+
+// sameScript compares scripts by name, as the Find functions return copies.
+func sameScript(a, b *Script) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Name == b.Name
+}
+
+func TestScriptClone(t *testing.T) {
+	script := &Script{Name: "coreos.ipxe", Params: map[string]interface{}{
+		"disks": []interface{}{"sda", map[interface{}]interface{}{"name": "sdb"}},
+	}}
+	c := script.Clone()
+	c.Params["hostname"] = "host1"
+	c.Params["disks"].([]interface{})[1].(map[interface{}]interface{})["name"] = "sdc"
+	if _, ok := script.Params["hostname"]; ok {
+		t.Error("Expected the parameters of the script to be left alone")
+	}
+	if name := script.Params["disks"].([]interface{})[1].(map[interface{}]interface{})["name"]; name != "sdb" {
+		t.Errorf("Expected the nested parameters to be copied, got %v", name)
+	}
+
+	if c := (&Script{Name: "coreos.ipxe"}).Clone(); c.Params == nil {
+		t.Error("Expected a clone to have parameters")
+	}
+
+	maps := []NetworkMap{{Network: mockNetwork1, Script: script}}
+	found, _ := FindScriptForNetwork(maps, "10.0.0.1")
+	if found == script {
+		t.Error("Expected a copy of the script")
+	}
+}
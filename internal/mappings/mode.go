@@ -0,0 +1,54 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mappings
+
+import "fmt"
+
+// Mode tells how long the assignment of a script to a host lasts.
+type Mode string
+
+const (
+	// ModeOnce boots the script a single time.
+	ModeOnce Mode = "once"
+	// ModeAlways boots the script every time the host boots.
+	ModeAlways Mode = "always"
+	// ModeUntilDone boots the script until the installer reports that it
+	// finished successfully, and boots from the local disk afterwards.
+	ModeUntilDone Mode = "until-reported-done"
+	// ModeLocalBoot boots from the local disk, without any script.
+	ModeLocalBoot Mode = "local-boot"
+)
+
+// Modes lists the valid assignment modes.
+var Modes = []Mode{ModeOnce, ModeAlways, ModeUntilDone, ModeLocalBoot}
+
+// ParseMode returns the Mode named s, or def if s is empty.
+func ParseMode(s string, def Mode) (Mode, error) {
+	if s == "" {
+		return def, nil
+	}
+	for _, m := range Modes {
+		if string(m) == s {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("unknown mode %q", s)
+}
+
+// Valid returns whether m is one of Modes.
+func (m Mode) Valid() bool {
+	_, err := ParseMode(string(m), "")
+	return err == nil && m != ""
+}
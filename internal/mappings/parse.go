@@ -15,18 +15,37 @@
 package mappings
 
 import (
+	"fmt"
 	"io/ioutil"
-	"os"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/Didstopia/shoelaces/internal/log"
 )
 
-// Mappings struct contains YamlNetworkMaps and YamlHostnameMaps.
+// Mappings struct contains YamlMACMaps, YamlHardwareMaps, YamlNetworkMaps
+// and YamlHostnameMaps, along with the YamlPollPolicies.
 type Mappings struct {
+	MACMaps      []YamlMACMap      `yaml:"macMaps"`
+	HardwareMaps []YamlHardwareMap `yaml:"hardwareMaps"`
 	NetworkMaps  []YamlNetworkMap  `yaml:"networkMaps"`
 	HostnameMaps []YamlHostnameMap `yaml:"hostnameMaps"`
+	PollPolicies []YamlPollPolicy  `yaml:"pollPolicies"`
+}
+
+// YamlMACMap struct contains an association between a MAC address, prefix
+// or range and a Script, as written in the mappings file.
+type YamlMACMap struct {
+	MAC    string
+	Script YamlScript
+}
+
+// YamlHardwareMap struct contains an association between hardware
+// attribute regular expressions and a Script, as written in the mappings
+// file.
+type YamlHardwareMap struct {
+	Match  map[string]string
+	Script YamlScript
 }
 
 // YamlNetworkMap struct contains an association between a CIDR network and a
@@ -45,34 +64,49 @@ type YamlHostnameMap struct {
 	Script   YamlScript
 }
 
-// YamlScript holds information regarding a script. Its name, its environment
-// and its parameters.
+// YamlPollPolicy struct contains how hosts without a target retry and
+// fall back when they poll from a network, for an environment, or both.
+// Unset fields keep the values of the global policy. Durations are
+// written like 30s or 5m.
+type YamlPollPolicy struct {
+	Network        string
+	Environment    string
+	MaxRetries     *int        `yaml:"maxRetries"`
+	PromptTimeout  string      `yaml:"promptTimeout"`
+	RetryDelay     string      `yaml:"retryDelay"`
+	MaxRetryDelay  string      `yaml:"maxRetryDelay"`
+	Fallback       string      `yaml:"fallback"`
+	FallbackScript *YamlScript `yaml:"fallbackScript"`
+}
+
+// YamlScript holds information regarding a script. Its name, its environment,
+// its parameters and its assignment mode.
 type YamlScript struct {
 	Name        string
 	Environment string
 	Params      map[string]string
+	Mode        string
 }
 
 // ParseYamlMappings parses the mappings yaml file into a Mappings struct.
-func ParseYamlMappings(logger log.Logger, mappingsFile string) *Mappings {
+func ParseYamlMappings(logger log.Logger, mappingsFile string) (*Mappings, error) {
 	var mappings Mappings
 
 	logger.Info("component", "config", "msg", "Reading mappings", "source", mappingsFile)
 	yamlFile, err := ioutil.ReadFile(mappingsFile)
-
 	if err != nil {
-		logger.Error(err)
-		os.Exit(1)
+		return nil, err
 	}
 
+	mappings.MACMaps = make([]YamlMACMap, 0)
+	mappings.HardwareMaps = make([]YamlHardwareMap, 0)
 	mappings.NetworkMaps = make([]YamlNetworkMap, 0)
 	mappings.HostnameMaps = make([]YamlHostnameMap, 0)
+	mappings.PollPolicies = make([]YamlPollPolicy, 0)
 
-	err = yaml.Unmarshal(yamlFile, &mappings)
-	if err != nil {
-		logger.Error(err)
-		os.Exit(1)
+	if err := yaml.Unmarshal(yamlFile, &mappings); err != nil {
+		return nil, fmt.Errorf("%s: %v", mappingsFile, err)
 	}
 
-	return &mappings
+	return &mappings, nil
 }
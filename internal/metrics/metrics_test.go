@@ -0,0 +1,72 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	polls := NewCounterVec(r, "test_polls_total", "Polls answered.", "outcome")
+	pending := NewGaugeFunc(r, "test_pending", "Pending servers.")
+	latency := NewHistogramVec(r, "test_duration_seconds", "Request duration.", []float64{0.1, 1}, "route")
+
+	polls.Inc("retry")
+	polls.Inc("retry")
+	polls.Inc(`say "hi"\n`)
+	pending.Set(func() float64 { return 3 })
+	latency.Observe(0.05, "/poll/1/{mac}")
+	latency.Observe(0.5, "/poll/1/{mac}")
+	latency.Observe(5, "/poll/1/{mac}")
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_polls_total Polls answered.
+# TYPE test_polls_total counter
+test_polls_total{outcome="retry"} 2
+test_polls_total{outcome="say \"hi\"\\n"} 1
+# HELP test_pending Pending servers.
+# TYPE test_pending gauge
+test_pending 3
+# HELP test_duration_seconds Request duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/poll/1/{mac}",le="0.1"} 1
+test_duration_seconds_bucket{route="/poll/1/{mac}",le="1"} 2
+test_duration_seconds_bucket{route="/poll/1/{mac}",le="+Inf"} 3
+test_duration_seconds_sum{route="/poll/1/{mac}"} 5.55
+test_duration_seconds_count{route="/poll/1/{mac}"} 3
+`
+	if b.String() != want {
+		t.Errorf("Expected:\n%s\nGot:\n%s", want, b.String())
+	}
+
+	if polls.Value("retry") != 2 || latency.Count("/poll/1/{mac}") != 3 || pending.Value() != 3 {
+		t.Error("Unexpected values")
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	c := NewCounterVec(NewRegistry(), "test_total", "Test.", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic with the wrong number of label values")
+		}
+	}()
+	c.Inc("only-one")
+}
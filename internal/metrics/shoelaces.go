@@ -0,0 +1,56 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+// Default is the registry served on /metrics.
+var Default = NewRegistry()
+
+// Poll outcomes, used as the outcome label of Polls.
+const (
+	PollInventory     = "inventory"
+	PollMACMatch      = "mac_match"
+	PollHardwareMatch = "hardware_match"
+	PollHostnameMatch = "hostname_match"
+	PollSubnetMatch   = "subnet_match"
+	PollManual        = "manual"
+	PollLocalBoot     = "local_boot"
+	PollRetry         = "retry"
+	PollTimeout       = "timeout"
+	PollError         = "error"
+)
+
+var (
+	// Polls counts the answers to the hosts polling for a script.
+	Polls = NewCounterVec(Default, "shoelaces_polls_total",
+		"Polls answered, by outcome.", "outcome")
+
+	// TemplateRenderErrors counts the templates that failed to render,
+	// including the missing variables.
+	TemplateRenderErrors = NewCounterVec(Default, "shoelaces_template_render_errors_total",
+		"Templates that failed to render, by template.", "template")
+
+	// ConfigReloads counts the configuration reloads, with a status of
+	// success or failure.
+	ConfigReloads = NewCounterVec(Default, "shoelaces_config_reloads_total",
+		"Configuration reloads, by status.", "status")
+
+	// PendingServers is the number of servers waiting for a target.
+	PendingServers = NewGaugeFunc(Default, "shoelaces_pending_servers",
+		"Servers waiting for a target to be selected.")
+
+	// HTTPRequestDuration measures the time taken to answer HTTP requests.
+	HTTPRequestDuration = NewHistogramVec(Default, "shoelaces_http_request_duration_seconds",
+		"Time taken to answer HTTP requests, by route.", DefaultBuckets, "route", "method", "code")
+)
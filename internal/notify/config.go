@@ -0,0 +1,148 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/event"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// KindGeneric sinks receive the event as JSON, unless their template
+	// says otherwise.
+	KindGeneric = "generic"
+	// KindSlack sinks are Slack incoming webhooks.
+	KindSlack = "slack"
+	// KindMattermost sinks are Mattermost incoming webhooks.
+	KindMattermost = "mattermost"
+)
+
+const (
+	defaultTimeout     = 10 * time.Second
+	defaultMaxAttempts = 5
+)
+
+// defaultTemplates are the payloads sent by each kind of sink when no
+// template is configured.
+var defaultTemplates = map[string]string{
+	KindGeneric:    `{"type": {{json .Type.String}}, "event": {{json .}}}`,
+	KindSlack:      `{"text": {{json .Message}}}`,
+	KindMattermost: `{"text": {{json .Message}}, "username": "Shoelaces"}`,
+}
+
+// Config holds the sinks notified of the events.
+type Config struct {
+	Webhooks []SinkConfig `yaml:"webhooks"`
+}
+
+// SinkConfig describes a webhook. Only the URL is required.
+type SinkConfig struct {
+	// Name identifies the sink in the logs. It defaults to the host of
+	// the URL.
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Kind is generic, slack or mattermost, and sets the default
+	// template.
+	Kind string `yaml:"kind"`
+	// Events lists the event types sent to the sink, like host-boot. Every
+	// event is sent when it's empty.
+	Events []string `yaml:"events"`
+	// Template is a text/template rendered with the event.Event to get
+	// the body of the request.
+	Template    string            `yaml:"template"`
+	ContentType string            `yaml:"contentType"`
+	Headers     map[string]string `yaml:"headers"`
+	// Timeout limits every attempt, and MaxAttempts how many are made
+	// before giving up on an event.
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"maxAttempts"`
+}
+
+// LoadConfig reads the sinks from a YAML file.
+func LoadConfig(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	var c Config
+	if err := yaml.UnmarshalStrict(data, &c); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// templateFuncs are available to the templates. json encodes a value,
+// so strings can be embedded safely in JSON payloads.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// newSink validates the configuration of a sink and fills in its
+// defaults.
+func newSink(c SinkConfig) (*sink, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		// The URL isn't shown, as webhook URLs often hold a secret
+		return nil, fmt.Errorf("webhook %q: invalid URL", c.Name)
+	}
+	if c.Name == "" {
+		c.Name = u.Host
+	}
+	if c.Kind == "" {
+		c.Kind = KindGeneric
+	}
+	text, ok := defaultTemplates[c.Kind]
+	if !ok {
+		return nil, fmt.Errorf("webhook %q: unknown kind %q", c.Name, c.Kind)
+	}
+	if c.Template != "" {
+		text = c.Template
+	}
+	tpl, err := template.New(c.Name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %q: %w", c.Name, err)
+	}
+
+	types := make(map[event.Type]bool, len(c.Events))
+	for _, name := range c.Events {
+		t, err := event.ParseType(name)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %q: %w", c.Name, err)
+		}
+		types[t] = true
+	}
+
+	if c.ContentType == "" {
+		c.ContentType = "application/json"
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = defaultTimeout
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = defaultMaxAttempts
+	}
+
+	return &sink{config: c, template: tpl, types: types}, nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package notify sends the events of the event log to webhooks, like the
+// incoming webhooks of Slack and Mattermost.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/log"
+)
+
+// queueSize is how many events can wait for delivery to a sink. Events
+// arriving when the queue is full are dropped.
+const queueSize = 100
+
+var (
+	// retryBackoff is the delay before the first retry, doubled after
+	// every failed attempt up to maxRetryBackoff.
+	retryBackoff    = time.Second
+	maxRetryBackoff = time.Minute
+)
+
+// Notifier delivers events to the configured sinks. Every sink has its
+// own queue and goroutine, so a slow or failing sink doesn't delay the
+// others.
+type Notifier struct {
+	logger log.Logger
+	client *http.Client
+	sinks  []*sink
+}
+
+type sink struct {
+	config   SinkConfig
+	template *template.Template
+	types    map[event.Type]bool
+	queue    chan event.Event
+}
+
+// New returns a Notifier for the given sinks. It fails if any of them is
+// misconfigured.
+func New(logger log.Logger, c Config) (*Notifier, error) {
+	n := &Notifier{logger: logger, client: &http.Client{}}
+	for _, sc := range c.Webhooks {
+		s, err := newSink(sc)
+		if err != nil {
+			return nil, err
+		}
+		s.queue = make(chan event.Event, queueSize)
+		n.sinks = append(n.sinks, s)
+	}
+	return n, nil
+}
+
+// Start delivers the queued events until ctx is done. Events still queued
+// then are dropped.
+func (n *Notifier) Start(ctx context.Context) {
+	for _, s := range n.sinks {
+		go n.run(ctx, s)
+	}
+}
+
+// Notify queues an event for delivery to the sinks that want it. It never
+// blocks, so it can be used with event.Log.OnAdd.
+func (n *Notifier) Notify(e event.Event) {
+	for _, s := range n.sinks {
+		if len(s.types) > 0 && !s.types[e.Type] {
+			continue
+		}
+		select {
+		case s.queue <- e:
+		default:
+			n.logger.Error("component", "notify", "msg", "Queue full, dropping event", "sink", s.config.Name, "type", e.Type, "mac", e.Server.Mac)
+		}
+	}
+}
+
+func (n *Notifier) run(ctx context.Context, s *sink) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-s.queue:
+			n.deliver(ctx, s, e)
+		}
+	}
+}
+
+// deliver sends an event to a sink, retrying with an exponential backoff
+// until it's accepted, it's rejected for good or the attempts run out.
+func (n *Notifier) deliver(ctx context.Context, s *sink, e event.Event) {
+	var body bytes.Buffer
+	if err := s.template.Execute(&body, e); err != nil {
+		n.logger.Error("component", "notify", "msg", "Failed to render payload", "sink", s.config.Name, "type", e.Type, "err", err)
+		return
+	}
+
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		retry, wait, err := n.send(ctx, s, body.Bytes())
+		if err == nil {
+			n.logger.Debug("component", "notify", "msg", "Event delivered", "sink", s.config.Name, "type", e.Type, "mac", e.Server.Mac, "attempt", attempt)
+			return
+		}
+		if !retry || attempt >= s.config.MaxAttempts {
+			n.logger.Error("component", "notify", "msg", "Failed to deliver event", "sink", s.config.Name, "type", e.Type, "mac", e.Server.Mac, "attempts", attempt, "err", err)
+			return
+		}
+		n.logger.Info("component", "notify", "msg", "Delivery failed, retrying", "sink", s.config.Name, "type", e.Type, "attempt", attempt, "err", err)
+
+		if wait < backoff {
+			wait = backoff
+		} else if wait > maxRetryBackoff {
+			wait = maxRetryBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// send makes a single attempt to deliver a payload. It returns whether a
+// failure is worth retrying, and how long the sink asked to wait before
+// doing so, if it did.
+func (n *Notifier) send(ctx context.Context, s *sink, payload []byte) (retry bool, wait time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, 0, err
+	}
+	req.Header.Set("Content-Type", s.config.ContentType)
+	req.Header.Set("User-Agent", "Shoelaces")
+	for k, v := range s.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		// The error includes the URL, which may hold a secret
+		if ctx.Err() != nil {
+			return true, 0, ctx.Err()
+		}
+		return true, 0, fmt.Errorf("request failed: %w", unwrapURLError(err))
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		return true, wait, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// unwrapURLError drops the method and the URL from the errors returned by
+// http.Client.
+func unwrapURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/log"
+	"github.com/Didstopia/shoelaces/internal/server"
+)
+
+type request struct {
+	body   string
+	header http.Header
+}
+
+// webhookServer records the requests it receives, answering them with the
+// given statuses in order, and 200 once they run out.
+func webhookServer(t *testing.T, statuses ...int) (*httptest.Server, <-chan request) {
+	t.Helper()
+
+	requests := make(chan request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{body: string(body), header: r.Header}
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func startNotifier(t *testing.T, sinks ...SinkConfig) *Notifier {
+	t.Helper()
+
+	n, err := New(log.MakeLogger(ioutil.Discard), Config{Webhooks: sinks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	n.Start(ctx)
+	return n
+}
+
+func expectRequest(t *testing.T, requests <-chan request) request {
+	t.Helper()
+
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a request")
+		return request{}
+	}
+}
+
+func expectNoRequest(t *testing.T, requests <-chan request) {
+	t.Helper()
+
+	select {
+	case r := <-requests:
+		t.Fatalf("Unexpected request: %s", r.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+var testServer = server.Server{Mac: "52:54:00:aa:bb:cc", IP: "10.0.0.1", Hostname: "node1"}
+
+func TestNotifyFilterAndTemplate(t *testing.T) {
+	srv, requests := webhookServer(t)
+	n := startNotifier(t, SinkConfig{
+		URL:      srv.URL,
+		Events:   []string{"host-boot", "host-timeout"},
+		Template: `{"mac": {{json .Server.Mac}}, "type": "{{.Type}}", "script": {{json .Script}}}`,
+		Headers:  map[string]string{"Authorization": "Bearer secret"},
+	})
+
+	n.Notify(event.New(event.HostPoll, testServer, "", "", nil))
+	n.Notify(event.New(event.HostBoot, testServer, event.MACMatchBoot, "coreos.ipxe", nil))
+
+	r := expectRequest(t, requests)
+	want := `{"mac": "52:54:00:aa:bb:cc", "type": "host-boot", "script": "coreos.ipxe"}`
+	if r.body != want {
+		t.Errorf("Expected %s\nGot: %s", want, r.body)
+	}
+	if r.header.Get("Authorization") != "Bearer secret" || r.header.Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected headers: %v", r.header)
+	}
+	expectNoRequest(t, requests)
+}
+
+func TestNotifyDefaultPayloads(t *testing.T) {
+	slack, slackRequests := webhookServer(t)
+	generic, genericRequests := webhookServer(t)
+	n := startNotifier(t,
+		SinkConfig{URL: slack.URL, Kind: KindSlack},
+		SinkConfig{URL: generic.URL},
+	)
+
+	e := event.New(event.HostTimeout, testServer, "", "", nil)
+	n.Notify(e)
+
+	var slackPayload map[string]string
+	if err := json.Unmarshal([]byte(expectRequest(t, slackRequests).body), &slackPayload); err != nil {
+		t.Fatal(err)
+	}
+	if slackPayload["text"] != e.Message {
+		t.Errorf("Expected the message as text, got %v", slackPayload)
+	}
+
+	var genericPayload struct {
+		Type  string
+		Event event.Event
+	}
+	if err := json.Unmarshal([]byte(expectRequest(t, genericRequests).body), &genericPayload); err != nil {
+		t.Fatal(err)
+	}
+	if genericPayload.Type != "host-timeout" || genericPayload.Event.Server.Mac != testServer.Mac {
+		t.Errorf("Unexpected payload: %+v", genericPayload)
+	}
+}
+
+func TestNotifyRetry(t *testing.T) {
+	defer func(d time.Duration) { retryBackoff = d }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	t.Run("server errors", func(t *testing.T) {
+		srv, requests := webhookServer(t, http.StatusInternalServerError, http.StatusTooManyRequests)
+		n := startNotifier(t, SinkConfig{URL: srv.URL})
+		n.Notify(event.New(event.HostPoll, testServer, "", "", nil))
+
+		for i := 0; i < 3; i++ {
+			expectRequest(t, requests)
+		}
+		expectNoRequest(t, requests)
+	})
+
+	t.Run("attempts run out", func(t *testing.T) {
+		srv, requests := webhookServer(t, 500, 500, 500, 500)
+		n := startNotifier(t, SinkConfig{URL: srv.URL, MaxAttempts: 2})
+		n.Notify(event.New(event.HostPoll, testServer, "", "", nil))
+
+		expectRequest(t, requests)
+		expectRequest(t, requests)
+		expectNoRequest(t, requests)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		srv, requests := webhookServer(t, http.StatusBadRequest)
+		n := startNotifier(t, SinkConfig{URL: srv.URL})
+		n.Notify(event.New(event.HostPoll, testServer, "", "", nil))
+
+		expectRequest(t, requests)
+		expectNoRequest(t, requests)
+	})
+}
+
+func TestNewSinkValidation(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  SinkConfig
+		problem string
+	}{
+		{"missing url", SinkConfig{Name: "ops"}, "invalid URL"},
+		{"bad scheme", SinkConfig{URL: "ftp://example.com/hook"}, "invalid URL"},
+		{"unknown kind", SinkConfig{URL: "https://example.com/hook", Kind: "irc"}, "irc"},
+		{"unknown event", SinkConfig{URL: "https://example.com/hook", Events: []string{"host-reboot"}}, "host-reboot"},
+		{"bad template", SinkConfig{URL: "https://example.com/hook", Template: "{{.Message"}, "unclosed action"},
+	}
+	for _, tc := range testCases {
+		if _, err := newSink(tc.config); err == nil || !strings.Contains(err.Error(), tc.problem) {
+			t.Errorf("%s: expected an error mentioning %q, got %v", tc.name, tc.problem, err)
+		}
+	}
+
+	s, err := newSink(SinkConfig{URL: "https://hooks.example.com/services/secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.config.Name != "hooks.example.com" || s.config.Kind != KindGeneric || s.config.MaxAttempts != defaultMaxAttempts {
+		t.Errorf("Expected the defaults to be filled in, got %+v", s.config)
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	c, err := LoadConfig("../../configs/webhooks.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(log.MakeLogger(ioutil.Discard), c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Webhooks) != 3 || c.Webhooks[2].Timeout != 5*time.Second {
+		t.Errorf("Unexpected webhooks: %+v", c.Webhooks)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package polling
+
+import (
+	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/inventory"
+	"github.com/Didstopia/shoelaces/internal/log"
+	"github.com/Didstopia/shoelaces/internal/mappings"
+	"github.com/Didstopia/shoelaces/internal/metrics"
+	"github.com/Didstopia/shoelaces/internal/server"
+	"github.com/Didstopia/shoelaces/internal/templates"
+	"github.com/Didstopia/shoelaces/internal/utils"
+)
+
+// localBootScript boots from the first local disk. UEFI firmwares move on
+// to the next boot option when iPXE exits, while BIOS ones need sanboot.
+const localBootScript = "#!ipxe\n" +
+	"iseq ${platform} efi && exit ||\n" +
+	"sanboot --no-describe --drive 0x80 || exit\n"
+
+// pollOutcomes maps the boot types to the outcome label of the polls
+// metric.
+var pollOutcomes = map[string]string{
+	event.InventoryBoot:     metrics.PollInventory,
+	event.MACMatchBoot:      metrics.PollMACMatch,
+	event.HardwareMatchBoot: metrics.PollHardwareMatch,
+	event.PtrMatchBoot:      metrics.PollHostnameMatch,
+	event.SubnetMatchBoot:   metrics.PollSubnetMatch,
+	event.ManualBoot:        metrics.PollManual,
+}
+
+// bootAssignment returns the boot script for a script assigned by the
+// inventory or a mapping, honoring its mode.
+func bootAssignment(logger log.Logger, serverStates *server.States, inv *inventory.Inventory, templateRenderer *templates.ShoelacesTemplates,
+	eventLog event.Recorder, baseScheme, baseURL string, srv server.Server, script *mappings.Script, bootType string) (string, error) {
+
+	if script.Mode == mappings.ModeLocalBoot {
+		logger.Debug("component", "polling", "msg", "Booting from the local disk", "mac", srv.Mac, "where", bootType)
+		eventLog.AddEvent(event.HostBoot, srv, bootType, "", map[string]interface{}{"mode": string(mappings.ModeLocalBoot)})
+		metrics.Polls.Inc(metrics.PollLocalBoot)
+		return localBootScript, nil
+	}
+
+	eventLog.AddEvent(event.HostBoot, srv, bootType, script.Name, templateRenderer.RedactSecrets(script.Name, script.Environment, script.Params))
+	scriptText, err := genBootScript(logger, templateRenderer, baseScheme, baseURL, script)
+	if err != nil {
+		return "", err
+	}
+	metrics.Polls.Inc(pollOutcomes[bootType])
+	recordBoot(logger, serverStates, srv, script, script.Mode)
+
+	// Hosts would get the script again on their next boot otherwise
+	if script.Mode == mappings.ModeOnce {
+		if err := switchToLocalBoot(logger, inv, srv); err != nil {
+			logger.Error("component", "polling", "msg", "Failed to switch host to local boot", "mac", srv.Mac, "err", err)
+		}
+	}
+	return scriptText, nil
+}
+
+// recordBoot remembers the script a host booted and the mode of its
+// assignment, which tell what to do once its installer reports success.
+func recordBoot(logger log.Logger, serverStates *server.States, srv server.Server, script *mappings.Script, mode mappings.Mode) {
+	boot := server.Boot{Server: srv, Script: script.Name, Environment: script.Environment, Mode: string(mode), Peer: srv.Peer}
+	if boot.Peer == "" {
+		boot.Peer = srv.IP
+	}
+	if err := serverStates.AddBoot(boot); err != nil {
+		logger.Error("component", "polling", "msg", "Failed to save boots", "mac", srv.Mac, "err", err)
+	}
+}
+
+// switchToLocalBoot makes the host boot from its local disk from now on,
+// adding it to the inventory if it isn't there yet.
+func switchToLocalBoot(logger log.Logger, inv *inventory.Inventory, srv server.Server) error {
+	machine, err := inv.Upsert(srv.Mac, srv.Attributes, func(m *inventory.Machine) {
+		m.Mode = mappings.ModeLocalBoot
+		if m.Name == "" {
+			m.Name = srv.Hostname
+		}
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("component", "polling", "msg", "Host switched to local boot", "mac", srv.Mac, "machine", machine.ID)
+	return nil
+}
+
+// reportEvents maps the phases installers report to their event types.
+var reportEvents = map[string]event.Type{
+	"started":  event.InstallStarted,
+	"progress": event.InstallProgress,
+	"success":  event.InstallSuccess,
+	"failure":  event.InstallFailure,
+}
+
+// Report records the progress of the installation of a host, as reported
+// by its installer. message is a short description and installLog the
+// output of the installer, both optional. A host that finished
+// successfully is switched to local boot, unless it always boots its
+// script. As anyone can report, reports are only accepted from hosts that
+// booted a script, and from the address they polled from.
+func Report(logger log.Logger, serverStates *server.States, inv *inventory.Inventory, eventLog event.Recorder,
+	srv server.Server, phase, message, installLog string) error {
+	if !utils.IsValidMAC(srv.Mac) {
+		return ErrInvalidMAC
+	}
+	eventType, ok := reportEvents[phase]
+	if !ok {
+		return ErrUnknownPhase
+	}
+	boot, found := serverStates.FindBoot(srv.Mac)
+	if !found {
+		logger.Info("component", "polling", "msg", "Report rejected, no script booted", "mac", srv.Mac, "ip", srv.IP, "phase", phase)
+		return ErrNoReportExpected
+	}
+	if boot.Peer != srv.IP {
+		logger.Info("component", "polling", "msg", "Report rejected, address mismatch", "mac", srv.Mac, "ip", srv.IP, "pollIP", boot.Peer, "phase", phase)
+		return ErrReporterMismatch
+	}
+
+	params := map[string]interface{}{"phase": phase}
+	if message != "" {
+		params["message"] = message
+	}
+	if installLog != "" {
+		params["log"] = installLog
+	}
+
+	if eventType == event.InstallSuccess {
+		switched, err := reportDone(logger, inv, srv, boot)
+		if err != nil {
+			return err
+		}
+		params["localBoot"] = switched
+	}
+	if eventType == event.InstallSuccess || eventType == event.InstallFailure {
+		if err := serverStates.RemoveBoot(srv.Mac); err != nil {
+			logger.Error("component", "polling", "msg", "Failed to save boots", "mac", srv.Mac, "err", err)
+		}
+	}
+
+	logger.Info("component", "polling", "msg", "Installer reported", "mac", srv.Mac, "phase", phase, "message", message)
+	eventLog.AddEvent(eventType, srv, "", "", params)
+	return nil
+}
+
+// reportDone switches a host that finished installing to local boot, when
+// the script it booted was assigned once or until reported done, by the
+// inventory, a mapping or the UI. It returns whether the host was
+// switched.
+func reportDone(logger log.Logger, inv *inventory.Inventory, srv server.Server, boot server.Boot) (switched bool, err error) {
+	if mode := mappings.Mode(boot.Mode); mode != mappings.ModeOnce && mode != mappings.ModeUntilDone {
+		logger.Info("component", "polling", "msg", "Host reported done, but boots its script", "mac", srv.Mac, "script", boot.Script, "mode", mode)
+		return false, nil
+	}
+	if err := switchToLocalBoot(logger, inv, srv); err != nil {
+		return false, err
+	}
+	return true, nil
+}
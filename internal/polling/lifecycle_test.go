@@ -0,0 +1,104 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package polling
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/inventory"
+	"github.com/Didstopia/shoelaces/internal/log"
+	"github.com/Didstopia/shoelaces/internal/mappings"
+	"github.com/Didstopia/shoelaces/internal/server"
+)
+
+func TestReportSuccessHonorsMode(t *testing.T) {
+	logger := log.MakeLogger(ioutil.Discard)
+	renderer := newTestRenderer(t, logger)
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+
+	for _, mode := range []mappings.Mode{mappings.ModeAlways, mappings.ModeUntilDone} {
+		states, _ := server.NewStates(nil)
+		inv, _ := inventory.New(nil)
+		eventLog := event.NewLog(logger, nil)
+		networkMaps := []mappings.NetworkMap{{Network: network, Script: &mappings.Script{Name: "test.ipxe", Mode: mode}}}
+		srv := server.New(testMAC(1), "10.0.0.1", "")
+		poll := func() string {
+			text, err := Poll(logger, states, inv, nil, nil, nil, networkMaps, DefaultPolicy, eventLog, renderer, "http", "localhost", "", srv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return text
+		}
+
+		if text := poll(); !strings.Contains(text, "set hostname") {
+			t.Fatalf("%s: expected the mapped script, got %q", mode, text)
+		}
+		if err := Report(logger, states, inv, eventLog, srv, "success", "", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		text := poll()
+		if mode == mappings.ModeAlways && text == localBootScript {
+			t.Errorf("%s: expected the host to keep booting its script after reporting success", mode)
+		}
+		if mode == mappings.ModeUntilDone && text != localBootScript {
+			t.Errorf("%s: expected the host to boot from its local disk after reporting success, got %q", mode, text)
+		}
+		if _, found := inv.Find(srv.Mac, nil); found != (mode == mappings.ModeUntilDone) {
+			t.Errorf("%s: unexpected inventory entry: %v", mode, found)
+		}
+	}
+}
+
+func TestReportRejected(t *testing.T) {
+	logger := log.MakeLogger(ioutil.Discard)
+	renderer := newTestRenderer(t, logger)
+	states, _ := server.NewStates(nil)
+	inv, _ := inventory.New(nil)
+	eventLog := event.NewLog(logger, nil)
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	networkMaps := []mappings.NetworkMap{{Network: network, Script: &mappings.Script{Name: "test.ipxe", Mode: mappings.ModeUntilDone}}}
+
+	srv := server.New(testMAC(1), "10.0.0.1", "")
+	if err := Report(logger, states, inv, eventLog, srv, "success", "", ""); !errors.Is(err, ErrNoReportExpected) {
+		t.Errorf("Expected a report without a booted script to be rejected, got %v", err)
+	}
+
+	if _, err := Poll(logger, states, inv, nil, nil, nil, networkMaps, DefaultPolicy, eventLog, renderer, "http", "localhost", "", srv); err != nil {
+		t.Fatal(err)
+	}
+	spoofed := server.New(srv.Mac, "10.0.0.66", "")
+	if err := Report(logger, states, inv, eventLog, spoofed, "success", "", ""); !errors.Is(err, ErrReporterMismatch) {
+		t.Errorf("Expected a report from another address to be rejected, got %v", err)
+	}
+	if _, found := inv.Find(srv.Mac, nil); found {
+		t.Error("Expected rejected reports to leave the inventory alone")
+	}
+	if events, _ := eventLog.ListEvents(); len(events) != 1 {
+		t.Errorf("Expected only the boot event, got %v", events)
+	}
+
+	if err := Report(logger, states, inv, eventLog, srv, "failure", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := Report(logger, states, inv, eventLog, srv, "success", "", ""); !errors.Is(err, ErrNoReportExpected) {
+		t.Errorf("Expected reports after a failure to be rejected until the next boot, got %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package polling
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/mappings"
+)
+
+// Fallback tells what hosts without a target boot once they are done
+// retrying.
+type Fallback string
+
+const (
+	// FallbackExit makes iPXE exit, so the firmware tries the next boot
+	// device.
+	FallbackExit Fallback = "exit"
+	// FallbackLocalBoot boots from the first local disk.
+	FallbackLocalBoot Fallback = "local-boot"
+	// FallbackScript boots the fallback script of the policy.
+	FallbackScript Fallback = "script"
+	// FallbackWait keeps the hosts retrying until a target is chosen.
+	FallbackWait Fallback = "wait"
+)
+
+// ParseFallback returns the Fallback named s.
+func ParseFallback(s string) (Fallback, error) {
+	switch f := Fallback(s); f {
+	case FallbackExit, FallbackLocalBoot, FallbackScript, FallbackWait:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown fallback %q", s)
+}
+
+// Policy tells how long hosts without a target wait for one, and what
+// they boot when they stop waiting.
+type Policy struct {
+	// MaxRetries is the number of times hosts are told to poll again
+	// before falling back.
+	MaxRetries int
+	// PromptTimeout is how long the retry script offers to choose a script
+	// from the menu with Ctrl-B. There's no prompt when it's zero.
+	PromptTimeout time.Duration
+	// RetryDelay is how long hosts sleep before polling again. It doubles
+	// with every retry, up to MaxRetryDelay.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	Fallback      Fallback
+	// FallbackScript is the script booted with FallbackScript.
+	FallbackScript *mappings.Script
+}
+
+// DefaultPolicy makes hosts retry 10 times, with a 10 seconds prompt and
+// no delay, and exit afterwards.
+var DefaultPolicy = Policy{
+	MaxRetries:    10,
+	PromptTimeout: 10 * time.Second,
+	MaxRetryDelay: time.Minute,
+	Fallback:      FallbackExit,
+}
+
+// Validate checks that the policy makes sense, and that hosts poll again
+// before being forgotten after expire.
+func (p Policy) Validate(expire time.Duration) error {
+	switch {
+	case p.MaxRetries < 1:
+		return errors.New("the maximum number of retries must be at least 1")
+	case p.PromptTimeout < 0 || p.RetryDelay < 0 || p.MaxRetryDelay < 0:
+		return errors.New("negative durations are not allowed")
+	case p.PromptTimeout+p.maxDelay() >= expire:
+		return fmt.Errorf("hosts would be forgotten between polls, the prompt and the longest delay must be shorter than %v", expire)
+	}
+	if _, err := ParseFallback(string(p.Fallback)); err != nil {
+		return err
+	}
+	if p.Fallback == FallbackScript && (p.FallbackScript == nil || p.FallbackScript.Name == "") {
+		return errors.New("the script fallback needs a script")
+	}
+	return nil
+}
+
+// maxDelay returns the longest delay between polls.
+func (p Policy) maxDelay() time.Duration {
+	if p.RetryDelay == 0 || p.MaxRetryDelay < p.RetryDelay {
+		return p.RetryDelay
+	}
+	return p.MaxRetryDelay
+}
+
+// retryDelay returns how long hosts sleep before their next poll, retry
+// being the number of times they were told to retry, starting from 1.
+func (p Policy) retryDelay(retry int) time.Duration {
+	delay, max := p.RetryDelay, p.maxDelay()
+	for i := 1; i < retry && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// PolicyMap assigns a Policy to the hosts polling from a network, for an
+// environment, or both.
+type PolicyMap struct {
+	// Network is nil when it matches any address.
+	Network *net.IPNet
+	// Environment is empty when it matches any environment.
+	Environment string
+	Policy      Policy
+}
+
+func (m PolicyMap) matches(ip net.IP, envName string) bool {
+	if m.Network != nil && (ip == nil || !m.Network.Contains(ip)) {
+		return false
+	}
+	return m.Environment == "" || m.Environment == envName
+}
+
+// FindPolicy returns the policy of the first map matching the address of
+// a host and the environment it polls for, or def when none does.
+func FindPolicy(maps []PolicyMap, ip, envName string, def Policy) Policy {
+	addr := net.ParseIP(ip)
+	for _, m := range maps {
+		if m.matches(addr, envName) {
+			return m.Policy
+		}
+	}
+	return def
+}
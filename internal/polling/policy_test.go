@@ -0,0 +1,145 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package polling
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/inventory"
+	"github.com/Didstopia/shoelaces/internal/log"
+	"github.com/Didstopia/shoelaces/internal/mappings"
+	"github.com/Didstopia/shoelaces/internal/server"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := Policy{RetryDelay: 5 * time.Second, MaxRetryDelay: 30 * time.Second}
+	for retry, expected := range map[int]time.Duration{
+		1:   5 * time.Second,
+		2:   10 * time.Second,
+		3:   20 * time.Second,
+		4:   30 * time.Second,
+		100: 30 * time.Second,
+	} {
+		if got := p.retryDelay(retry); got != expected {
+			t.Errorf("Retry %d: expected %v, got %v", retry, expected, got)
+		}
+	}
+
+	// The delay doesn't grow without a higher maximum
+	p.MaxRetryDelay = 0
+	if got := p.retryDelay(3); got != 5*time.Second {
+		t.Errorf("Expected a constant delay, got %v", got)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy Policy
+		ok     bool
+	}{
+		{"default", DefaultPolicy, true},
+		{"no retries", Policy{Fallback: FallbackExit}, false},
+		{"longer than expire", Policy{MaxRetries: 1, RetryDelay: time.Minute, MaxRetryDelay: 5 * time.Minute, Fallback: FallbackExit}, false},
+		{"unknown fallback", Policy{MaxRetries: 1, Fallback: "reboot"}, false},
+		{"missing script", Policy{MaxRetries: 1, Fallback: FallbackScript}, false},
+		{"script", Policy{MaxRetries: 1, Fallback: FallbackScript, FallbackScript: &mappings.Script{Name: "test.ipxe"}}, true},
+	}
+	for _, tc := range testCases {
+		if err := tc.policy.Validate(3 * time.Minute); (err == nil) != tc.ok {
+			t.Errorf("%s: expected ok: %v, got %v", tc.name, tc.ok, err)
+		}
+	}
+}
+
+func TestFindPolicy(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	maps := []PolicyMap{
+		{Network: network, Environment: "staging", Policy: Policy{MaxRetries: 1}},
+		{Network: network, Policy: Policy{MaxRetries: 2}},
+		{Environment: "staging", Policy: Policy{MaxRetries: 3}},
+	}
+	testCases := []struct {
+		ip, envName string
+		expected    int
+	}{
+		{"10.0.0.1", "staging", 1},
+		{"10.0.0.1", "", 2},
+		{"10.0.1.1", "staging", 3},
+		{"10.0.1.1", "", 10},
+	}
+	for _, tc := range testCases {
+		if got := FindPolicy(maps, tc.ip, tc.envName, DefaultPolicy); got.MaxRetries != tc.expected {
+			t.Errorf("%s %q: expected the policy with %d retries, got %d", tc.ip, tc.envName, tc.expected, got.MaxRetries)
+		}
+	}
+}
+
+func TestPollFallback(t *testing.T) {
+	logger := log.MakeLogger(ioutil.Discard)
+	renderer := newTestRenderer(t, logger)
+
+	testCases := []struct {
+		fallback Fallback
+		expected string
+	}{
+		{FallbackExit, timeoutScript},
+		{FallbackLocalBoot, localBootScript},
+		{FallbackScript, "set hostname rescue-52-54-00-00-00-01\n"},
+		{FallbackWait, "poll/1/52-54-00-00-00-01"},
+	}
+	for _, tc := range testCases {
+		states, _ := server.NewStates(nil)
+		inv, _ := inventory.New(nil)
+		eventLog := event.NewLog(logger, nil)
+		policy := Policy{
+			MaxRetries:     2,
+			RetryDelay:     time.Second,
+			MaxRetryDelay:  time.Second,
+			Fallback:       tc.fallback,
+			FallbackScript: &mappings.Script{Name: "test.ipxe", Params: map[string]interface{}{"hostnamePrefix": "rescue-"}},
+		}
+		srv := server.New(testMAC(1), "10.0.0.1", "")
+		poll := func() string {
+			text, err := Poll(logger, states, inv, nil, nil, nil, nil, policy, eventLog, renderer, "http", "localhost", "staging", srv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return text
+		}
+
+		for i := 0; i < policy.MaxRetries; i++ {
+			text := poll()
+			if !strings.Contains(text, "sleep 1 ||\n") || strings.Contains(text, "prompt") {
+				t.Errorf("%s: expected a retry without prompt, got %q", tc.fallback, text)
+			}
+			if !strings.Contains(text, "localhost/env/staging/poll/1/") {
+				t.Errorf("%s: expected the host to poll again for its environment, got %q", tc.fallback, text)
+			}
+		}
+		if text := poll(); !strings.Contains(text, tc.expected) {
+			t.Errorf("%s: expected %q in the script, got %q", tc.fallback, tc.expected, text)
+		}
+
+		if waiting := len(ListServers(states)) == 1; waiting != (tc.fallback == FallbackWait) {
+			t.Errorf("%s: expected the host to be waiting: %v, got %v", tc.fallback, !waiting, waiting)
+		}
+	}
+}
@@ -18,28 +18,52 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"sort"
 	"text/template"
 	"time"
 
 	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/inventory"
 	"github.com/Didstopia/shoelaces/internal/log"
 	"github.com/Didstopia/shoelaces/internal/mappings"
+	"github.com/Didstopia/shoelaces/internal/metrics"
 	"github.com/Didstopia/shoelaces/internal/server"
 	"github.com/Didstopia/shoelaces/internal/templates"
 	"github.com/Didstopia/shoelaces/internal/utils"
 )
 
+var retryTemplate = template.Must(template.New("retry").Parse(retryScript))
+
+// retrySaveInterval is how often, at most, the retry counters of the
+// waiting hosts are saved.
+var retrySaveInterval = 5 * time.Second
+
 // ManualAction represent an action taken when no automatic boot is available.
 type ManualAction int
 
-const (
-	maxRetry = 10
+var (
+	// ErrInvalidMAC is returned when a malformed MAC address is received.
+	ErrInvalidMAC = errors.New("Invalid MAC")
+	// ErrUnknownPhase is returned when an installer reports an unknown
+	// phase.
+	ErrUnknownPhase = errors.New("Unknown phase")
+	// ErrNotBooting is returned when a MAC address is not in the booting state.
+	ErrNotBooting = errors.New("MAC is not in the booting state")
+	// ErrNoReportExpected is returned when a host reports its installation
+	// without having booted a script.
+	ErrNoReportExpected = errors.New("MAC has not booted a script waiting for a report")
+	// ErrReporterMismatch is returned when a report doesn't come from the
+	// address the host polled from.
+	ErrReporterMismatch = errors.New("Report does not come from the address of the host")
+)
 
+const (
 	retryScript = "#!ipxe\n" +
-		"prompt --key 0x02 --timeout 10000 shoelaces: Press Ctrl-B for manual override... && " +
-		"chain -ar http://{{.baseURL}}/ipxemenu || " +
-		"chain -ar http://{{.baseURL}}/poll/1/{{.macAddress}}\n"
+		"{{if .retryDelay}}sleep {{.retryDelay}} ||\n{{end}}" +
+		"{{if .promptTimeout}}prompt --key 0x02 --timeout {{.promptTimeout}} shoelaces: Press Ctrl-B for manual override... && " +
+		"chain -ar {{.baseScheme}}://{{.baseURL}}/ipxemenu || {{end}}" +
+		"chain -ar {{.baseScheme}}://{{.baseURL}}/poll/1/{{.macAddress}}{{.attributesQuery}}\n"
 
 	timeoutScript = "#!ipxe\n" +
 		"exit\n"
@@ -51,7 +75,8 @@ const (
 	// RetryAction is used when a server polling does not yet have a script
 	// selected by the user, hence it has to retry.
 	RetryAction ManualAction = 1
-	// TimeoutAction is used when a server polling is timing out.
+	// TimeoutAction is used when a server polling is timing out, so it
+	// boots the fallback of its policy.
 	TimeoutAction ManualAction = 2
 )
 
@@ -66,7 +91,7 @@ func ListServers(serverStates *server.States) server.Servers {
 			ret = append(ret, s.Server)
 		}
 	}
-	defer serverStates.RUnlock()
+	serverStates.RUnlock()
 	sort.Sort(server.Servers(ret))
 
 	return ret
@@ -75,102 +100,290 @@ func ListServers(serverStates *server.States) server.Servers {
 // UpdateTarget receives parameters for booting manually. When a host
 // didn't match any of the automatic methods for booting, it's going to be
 // put on hold. This method is called when something is finally chosen for
-// that host.
-func UpdateTarget(logger log.Logger, serverStates *server.States,
-	templateRenderer *templates.ShoelacesTemplates, eventLog *event.Log, baseURL string, srv server.Server,
-	scriptName string, envName string, params map[string]interface{}) (inputErr bool, err error) {
+// that host. Targets in the once mode are used for the next boot only, as
+// the host is forgotten afterwards, while the ones in other modes last, so
+// they are kept in the inventory.
+func UpdateTarget(logger log.Logger, serverStates *server.States, inv *inventory.Inventory,
+	templateRenderer *templates.ShoelacesTemplates, eventLog event.Recorder, baseScheme, baseURL string, srv server.Server,
+	scriptName string, envName string, params map[string]interface{}, mode mappings.Mode) (inputErr bool, err error) {
 
 	if !utils.IsValidMAC(srv.Mac) {
-		return true, errors.New("Invalid MAC")
+		return true, ErrInvalidMAC
+	}
+	// The host is looked up before the inputs are checked, so an unknown
+	// host is reported as such whatever was chosen for it.
+	serverStates.RLock()
+	_, booting := serverStates.Servers[srv.Mac]
+	serverStates.RUnlock()
+	if !booting {
+		return true, ErrNotBooting
+	}
+	if mode == "" {
+		mode = mappings.ModeOnce
+	}
+	if !mode.Valid() {
+		return true, fmt.Errorf("Unknown mode %q", mode)
 	}
-	// Test the template with user inputs
-	setHostName(params, srv.Mac)
 
-	params["baseURL"] = utils.BaseURLforEnvName(baseURL, envName)
-	_, err = templateRenderer.RenderTemplate(logger, scriptName, params, envName)
-	if err != nil {
-		inputErr = true
-		return
+	if mode != mappings.ModeLocalBoot {
+		// Test the template with user inputs
+		testParams := make(map[string]interface{}, len(params)+3)
+		for k, v := range params {
+			testParams[k] = v
+		}
+		setHostName(testParams, srv.Mac)
+		testParams["baseScheme"] = baseScheme
+		testParams["baseURL"] = utils.BaseURLforEnvName(baseURL, envName)
+		_, err = templateRenderer.RenderTemplate(logger, scriptName, testParams, envName)
+		if err != nil {
+			inputErr = true
+			return
+		}
+	} else {
+		scriptName, envName, params = "", "", nil
 	}
 
 	serverStates.Lock()
 	defer serverStates.Unlock()
 	servers := serverStates.Servers
-	if servers[srv.Mac] == nil {
-		return true, errors.New("MAC is not in the booting state")
+	state := servers[srv.Mac]
+	if state == nil {
+		// The host went away while the template was rendered
+		return true, ErrNotBooting
 	}
 
-	hostname := servers[srv.Mac].Server.Hostname
-	logger.Debug("component", "polling", "msg", "Setting server override", "server", srv.Mac, "target", scriptName, "environment", envName, "hostname", hostname, "params", params)
-	eventLog.AddEvent(event.UserSelection, srv, "", scriptName, nil)
-	servers[srv.Mac].Target = scriptName
-	servers[srv.Mac].Environment = envName
-	servers[srv.Mac].Params = params
+	hostname := state.Server.Hostname
+	logger.Debug("component", "polling", "msg", "Setting server override", "server", srv.Mac, "target", scriptName, "environment", envName, "hostname", hostname, "params", templateRenderer.RedactSecrets(scriptName, envName, params), "mode", mode)
+	selection := scriptName
+	if selection == "" {
+		selection = string(mode)
+	}
+	eventLog.AddEvent(event.UserSelection, srv, "", selection, nil)
+
+	if mode == mappings.ModeOnce {
+		state.Target = scriptName
+		state.Environment = envName
+		state.Params = params
+		saveStates(logger, serverStates)
+		return false, nil
+	}
+
+	// The inventory is looked up before the waiting servers, so the host
+	// gets its target from there on its next boot.
+	_, err = inv.Upsert(srv.Mac, state.Attributes, func(m *inventory.Machine) {
+		m.Script = scriptName
+		m.Environment = envName
+		m.Params = params
+		m.Mode = mode
+		if m.Name == "" {
+			m.Name = hostname
+		}
+	})
+	if err != nil {
+		return false, err
+	}
+	serverStates.DeleteServer(srv.Mac)
+	saveStates(logger, serverStates)
 	return false, nil
 }
 
+// ClearTarget removes the script chosen for a booting server, putting it
+// back in the list of servers waiting for a target.
+func ClearTarget(logger log.Logger, serverStates *server.States, mac string) error {
+	if !utils.IsValidMAC(mac) {
+		return ErrInvalidMAC
+	}
+
+	serverStates.Lock()
+	defer serverStates.Unlock()
+	state := serverStates.Servers[mac]
+	if state == nil {
+		return ErrNotBooting
+	}
+
+	logger.Debug("component", "polling", "msg", "Clearing server override", "server", mac, "target", state.Target)
+	state.Target = server.InitTarget
+	state.Environment = ""
+	state.Params = nil
+	saveStates(logger, serverStates)
+	return nil
+}
+
 // Poll contains the main logic of Shoelaces. It uses several heuristics to find
-// the right script to return, as network maps, hostname maps and manual
-// selection.
-func Poll(logger log.Logger, serverStates *server.States,
+// the right script to return, in this order: the inventory, MAC maps,
+// hardware maps, hostname maps, network maps and manual selection. Hosts
+// waiting for a manual selection retry as their policy says, polling again
+// for envName.
+func Poll(logger log.Logger, serverStates *server.States, inv *inventory.Inventory,
+	macMaps []mappings.MACMap, hardwareMaps []mappings.HardwareMap,
+	hostnameMaps []mappings.HostnameMap, networkMaps []mappings.NetworkMap, policy Policy,
+	eventLog event.Recorder, templateRenderer *templates.ShoelacesTemplates,
+	baseScheme, baseURL, envName string, srv server.Server) (scriptText string, err error) {
+
+	defer func() {
+		if err != nil {
+			metrics.Polls.Inc(metrics.PollError)
+		}
+	}()
+
+	if script, found, err := attemptInventoryBoot(logger, serverStates, inv, templateRenderer, eventLog, baseScheme, baseURL, srv); found || err != nil {
+		return script, err
+	}
+
+	script, found, err := attemptAutomaticBoot(logger, serverStates, inv, macMaps, hardwareMaps, hostnameMaps, networkMaps, templateRenderer, eventLog, baseScheme, baseURL, srv)
+	if found || err != nil {
+		return script, err
+	}
+
+	return manualAction(logger, serverStates, templateRenderer, eventLog, policy, baseScheme, baseURL, envName, srv)
+}
+
+// attemptInventoryBoot boots the script assigned to the host in the
+// inventory. Machines without a script go through the mappings like
+// unknown hosts, unless they boot from the local disk.
+func attemptInventoryBoot(logger log.Logger, serverStates *server.States, inv *inventory.Inventory,
+	templateRenderer *templates.ShoelacesTemplates, eventLog event.Recorder,
+	baseScheme, baseURL string, srv server.Server) (scriptText string, found bool, err error) {
+
+	machine, found := inv.Find(srv.Mac, srv.Attributes)
+	if !found || (machine.Script == "" && machine.Mode != mappings.ModeLocalBoot) {
+		logger.Debug("component", "polling", "msg", "Host not found", "where", "inventory", "mac", srv.Mac)
+		return "", false, nil
+	}
+	logger.Debug("component", "polling", "msg", "Host found", "where", "inventory", "mac", srv.Mac, "machine", machine.ID)
+
+	script := machineScript(machine)
+	srv.Hostname = setHostName(script.Params, srv.Mac)
+
+	scriptText, err = bootAssignment(logger, serverStates, inv, templateRenderer, eventLog, baseScheme, baseURL, srv, script, event.InventoryBoot)
+	return scriptText, true, err
+}
+
+// machineScript returns the script assigned to a machine, with its name as
+// hostname unless the parameters say otherwise. The parameters are copied,
+// as rendering adds some.
+func machineScript(machine inventory.Machine) *mappings.Script {
+	params := make(map[string]interface{}, len(machine.Params)+1)
+	for k, v := range machine.Params {
+		params[k] = v
+	}
+	if params["hostname"] == nil && machine.Name != "" {
+		params["hostname"] = machine.Name
+	}
+	return &mappings.Script{Name: machine.Script, Environment: machine.Environment, Params: params, Mode: machine.Mode}
+}
+
+// ValidateMachine checks that the script assigned to a machine renders, so
+// mistakes are reported when the inventory is edited instead of when the
+// machine boots.
+func ValidateMachine(logger log.Logger, templateRenderer *templates.ShoelacesTemplates,
+	baseScheme, baseURL string, machine inventory.Machine) error {
+
+	if machine.Script == "" {
+		return nil
+	}
+	if !templateRenderer.HasTemplate(machine.Script, machine.Environment) {
+		return fmt.Errorf("Unknown script %q", machine.Script)
+	}
+
+	script := machineScript(machine)
+	mac := machine.MAC
+	if mac == "" {
+		mac = "00:00:00:00:00:00"
+	}
+	setHostName(script.Params, mac)
+	_, err := genBootScript(logger, templateRenderer, baseScheme, baseURL, script)
+	return err
+}
+
+func attemptAutomaticBoot(logger log.Logger, serverStates *server.States, inv *inventory.Inventory, macMaps []mappings.MACMap, hardwareMaps []mappings.HardwareMap,
 	hostnameMaps []mappings.HostnameMap, networkMaps []mappings.NetworkMap,
-	eventLog *event.Log, templateRenderer *templates.ShoelacesTemplates,
-	baseURL string, srv server.Server) (scriptText string, err error) {
+	templateRenderer *templates.ShoelacesTemplates, eventLog event.Recorder,
+	baseScheme, baseURL string, srv server.Server) (scriptText string, found bool, err error) {
 
-	script, found := attemptAutomaticBoot(logger, hostnameMaps, networkMaps, templateRenderer, eventLog, baseURL, srv)
-	if found {
-		return script, nil
+	script, bootType := findMapping(logger, macMaps, hardwareMaps, hostnameMaps, networkMaps, srv)
+	if script == nil {
+		return "", false, nil
+	}
+
+	if bootType == event.PtrMatchBoot {
+		script.Params["hostname"] = srv.Hostname
+	} else {
+		srv.Hostname = setHostName(script.Params, srv.Mac)
 	}
 
-	return manualAction(logger, serverStates, templateRenderer, eventLog, baseURL, srv)
+	scriptText, err = bootAssignment(logger, serverStates, inv, templateRenderer, eventLog, baseScheme, baseURL, srv, script, bootType)
+	return scriptText, true, err
 }
 
-func attemptAutomaticBoot(logger log.Logger, hostnameMaps []mappings.HostnameMap, networkMaps []mappings.NetworkMap,
-	templateRenderer *templates.ShoelacesTemplates, eventLog *event.Log,
-	baseURL string, srv server.Server) (scriptText string, found bool) {
+// findMapping returns the script of the first mapping matching the host,
+// along with the boot type telling which kind of mapping it was.
+func findMapping(logger log.Logger, macMaps []mappings.MACMap, hardwareMaps []mappings.HardwareMap,
+	hostnameMaps []mappings.HostnameMap, networkMaps []mappings.NetworkMap, srv server.Server) (*mappings.Script, string) {
+
+	// Find with the MAC address in the MAC ranges
+	if script, found := mappings.FindScriptForMAC(macMaps, srv.Mac); found {
+		logger.Debug("component", "polling", "msg", "Host found", "where", "mac-mapping", "mac", srv.Mac)
+		return script, event.MACMatchBoot
+	}
+	logger.Debug("component", "polling", "msg", "Host not found", "where", "mac-mapping", "mac", srv.Mac)
+
+	// Find with the hardware attributes reported by iPXE
+	if script, found := mappings.FindScriptForHardware(hardwareMaps, srv.Attributes); found {
+		logger.Debug("component", "polling", "msg", "Host found", "where", "hardware-mapping", "attributes", fmt.Sprint(srv.Attributes))
+		return script, event.HardwareMatchBoot
+	}
+	logger.Debug("component", "polling", "msg", "Host not found", "where", "hardware-mapping", "attributes", fmt.Sprint(srv.Attributes))
 
 	// Find with reverse hostname matched with the hostname regexps
 	if script, found := mappings.FindScriptForHostname(hostnameMaps, srv.Hostname); found {
 		logger.Debug("component", "polling", "msg", "Host found", "where", "hostname-mapping", "host", srv.Hostname)
-		eventLog.AddEvent(event.HostBoot, srv, event.PtrMatchBoot, script.Name, script.Params)
-		script.Params["hostname"] = srv.Hostname
-
-		return genBootScript(logger, templateRenderer, baseURL, script), found
+		return script, event.PtrMatchBoot
 	}
 	logger.Debug("component", "polling", "msg", "Host not found", "where", "hostname-mapping", "host", srv.Hostname)
 
 	// Find with IP belonging to a configured subnet
 	if script, found := mappings.FindScriptForNetwork(networkMaps, srv.IP); found {
 		logger.Debug("component", "polling", "msg", "Host found", "where", "network-mapping", "ip", srv.IP)
-		setHostName(script.Params, srv.Mac)
-		srv.Hostname = script.Params["hostname"].(string)
-		eventLog.AddEvent(event.HostBoot, srv, event.SubnetMatchBoot, script.Name, script.Params)
-
-		return genBootScript(logger, templateRenderer, baseURL, script), found
+		return script, event.SubnetMatchBoot
 	}
 	logger.Debug("component", "polling", "msg", "Host not found", "where", "network-mapping", "ip", srv.IP)
 
-	return "", false
+	return nil, ""
 }
 
 func manualAction(logger log.Logger, serverStates *server.States, templateRenderer *templates.ShoelacesTemplates,
-	eventLog *event.Log, baseURL string, srv server.Server) (scriptText string, err error) {
+	eventLog event.Recorder, policy Policy, baseScheme, baseURL, envName string, srv server.Server) (scriptText string, err error) {
 
-	script, action := chooseManualAction(logger, serverStates, eventLog, srv)
-	logger.Debug("component", "polling", "target-script-name", script, "action", action)
+	script, action, retry := chooseManualAction(logger, serverStates, eventLog, policy, srv)
+	logger.Debug("component", "polling", "msg", "Manual action chosen", "mac", srv.Mac, "script", script, "action", action)
 
 	switch action {
 	case BootAction:
-		setHostName(script.Params, srv.Mac)
-		srv.Hostname = script.Params["hostname"].(string)
-		eventLog.AddEvent(event.HostBoot, srv, event.ManualBoot, script.Name, script.Params)
-		return genBootScript(logger, templateRenderer, baseURL, script), nil
+		srv.Hostname = setHostName(script.Params, srv.Mac)
+		eventLog.AddEvent(event.HostBoot, srv, event.ManualBoot, script.Name, templateRenderer.RedactSecrets(script.Name, script.Environment, script.Params))
+		scriptText, err = genBootScript(logger, templateRenderer, baseScheme, baseURL, script)
+		if err == nil {
+			metrics.Polls.Inc(metrics.PollManual)
+			// The UI only keeps the targets booted once here, the others
+			// are in the inventory
+			recordBoot(logger, serverStates, srv, script, mappings.ModeOnce)
+		}
+		return scriptText, err
 
 	case RetryAction:
-		return genRetryScript(logger, baseURL, srv.Mac), nil
+		scriptText, err = genRetryScript(logger, policy, baseScheme, utils.BaseURLforEnvName(baseURL, envName), srv.Mac, retry)
+		if err == nil {
+			metrics.Polls.Inc(metrics.PollRetry)
+		}
+		return scriptText, err
 
 	case TimeoutAction:
-		return timeoutScript, nil
+		scriptText, err = fallback(logger, serverStates, templateRenderer, eventLog, policy, baseScheme, baseURL, srv)
+		if err == nil {
+			metrics.Polls.Inc(metrics.PollTimeout)
+		}
+		return scriptText, err
 
 	default:
 		logger.Info("component", "polling", "msg", "Unknown action")
@@ -178,8 +391,11 @@ func manualAction(logger log.Logger, serverStates *server.States, templateRender
 	}
 }
 
+// chooseManualAction tells whether a host boots the target chosen for
+// it, retries, or stops waiting. Along with a retry, it returns the number
+// of times the host was told to retry so far.
 func chooseManualAction(logger log.Logger, serverStates *server.States,
-	eventLog *event.Log, srv server.Server) (*mappings.Script, ManualAction) {
+	eventLog event.Recorder, policy Policy, srv server.Server) (*mappings.Script, ManualAction, int) {
 
 	serverStates.Lock()
 	defer serverStates.Unlock()
@@ -187,71 +403,125 @@ func chooseManualAction(logger log.Logger, serverStates *server.States,
 	if m := serverStates.Servers[srv.Mac]; m != nil {
 		if m.Target != server.InitTarget {
 			serverStates.DeleteServer(srv.Mac)
+			saveStates(logger, serverStates)
 			logger.Debug("component", "polling", "msg", "Server boot", "mac", srv.Mac)
-			return &mappings.Script{
+			// The parameters come from the API and may be nil, or still
+			// referenced by it
+			script := &mappings.Script{
 				Name:        m.Target,
 				Environment: m.Environment,
-				Params:      m.Params}, BootAction
-		} else if m.Retry <= maxRetry {
+				Params:      m.Params}
+			return script.Clone(), BootAction, 0
+		} else if m.Retry < policy.MaxRetries || policy.Fallback == FallbackWait {
 			m.Retry++
 			m.LastAccess = int(time.Now().UTC().Unix())
+			// Retries only bump the counters of the host, which aren't worth
+			// rewriting the states on every poll
+			if err := serverStates.SaveEvery(retrySaveInterval); err != nil {
+				logger.Error("component", "polling", "msg", "Failed to save server states", "err", err)
+			}
 			logger.Debug("component", "polling", "msg", "Retrying reboot", "mac", srv.Mac)
-			return nil, RetryAction
+			return nil, RetryAction, m.Retry
 		} else {
 			serverStates.DeleteServer(srv.Mac)
+			saveStates(logger, serverStates)
 			logger.Debug("component", "polling", "msg", "Timing out server", "mac", srv.Mac)
-			return nil, TimeoutAction
+			return nil, TimeoutAction, 0
 		}
 	}
 
 	serverStates.AddServer(srv)
+	saveStates(logger, serverStates)
 	logger.Debug("component", "polling", "msg", "New server", "mac", srv.Mac)
 	eventLog.AddEvent(event.HostPoll, srv, "", "", nil)
 
-	return nil, RetryAction
+	return nil, RetryAction, 1
 }
 
-func setHostName(params map[string]interface{}, mac string) {
-	if _, ok := params["hostname"]; !ok {
-		hostname := utils.MacColonToDash(mac)
-		if hnPrefix, ok := params["hostnamePrefix"]; ok {
-			hnPrefixStr, isString := hnPrefix.(string)
-			if !isString {
-				hnPrefixStr = ""
-			}
-			params["hostname"] = hnPrefixStr + hostname
-		} else {
-			params["hostname"] = hostname
+// fallback returns the boot script of a host that stopped waiting for a
+// target. The host is forgotten, so it starts over on its next boot.
+func fallback(logger log.Logger, serverStates *server.States, templateRenderer *templates.ShoelacesTemplates, eventLog event.Recorder,
+	policy Policy, baseScheme, baseURL string, srv server.Server) (string, error) {
+
+	eventLog.AddEvent(event.HostTimeout, srv, "", "", map[string]interface{}{"fallback": string(policy.Fallback)})
+
+	switch policy.Fallback {
+	case FallbackLocalBoot:
+		return localBootScript, nil
+
+	case FallbackScript:
+		script := policy.FallbackScript.Clone()
+		srv.Hostname = setHostName(script.Params, srv.Mac)
+		eventLog.AddEvent(event.HostBoot, srv, event.FallbackBoot, script.Name, templateRenderer.RedactSecrets(script.Name, script.Environment, script.Params))
+		scriptText, err := genBootScript(logger, templateRenderer, baseScheme, baseURL, script)
+		if err == nil {
+			recordBoot(logger, serverStates, srv, script, script.Mode)
 		}
+		return scriptText, err
 	}
+	return timeoutScript, nil
 }
 
-func genBootScript(logger log.Logger, templateRenderer *templates.ShoelacesTemplates, baseURL string, script *mappings.Script) string {
-	script.Params["baseURL"] = utils.BaseURLforEnvName(baseURL, script.Environment)
-	text, err := templateRenderer.RenderTemplate(logger, script.Name, script.Params, script.Environment)
-	if err != nil {
-		panic(err)
+// saveStates persists the server states. The caller must hold the lock.
+func saveStates(logger log.Logger, serverStates *server.States) {
+	if err := serverStates.Save(); err != nil {
+		logger.Error("component", "polling", "msg", "Failed to save server states", "err", err)
 	}
-	return text
 }
 
-func genRetryScript(logger log.Logger, baseURL string, mac string) string {
-	variablesMap := map[string]interface{}{}
-	parsedTemplate := &bytes.Buffer{}
+// setHostName makes sure the hostname parameter is a string, setting it to
+// the MAC address, with the optional hostnamePrefix, when it's missing. It
+// returns the hostname.
+func setHostName(params map[string]interface{}, mac string) string {
+	switch hostname := params["hostname"].(type) {
+	case string:
+		return hostname
+	case nil:
+		// missing, or null in JSON
+	default:
+		// The parameters come from JSON or YAML, where hostnames may be
+		// numbers
+		params["hostname"] = fmt.Sprint(hostname)
+		return fmt.Sprint(hostname)
+	}
 
-	tmpl, err := template.New("retry").Parse(retryScript)
-	if err != nil {
-		logger.Info("component", "polling", "msg", "Error parsing retry template", "mac", mac)
-		panic(err)
+	hostname := utils.MacColonToDash(mac)
+	if hnPrefix, ok := params["hostnamePrefix"].(string); ok {
+		hostname = hnPrefix + hostname
+	}
+	params["hostname"] = hostname
+	return hostname
+}
+
+// genBootScript renders the script. The parameters are copied before
+// adding the base URL, as they are shared with the boot event.
+func genBootScript(logger log.Logger, templateRenderer *templates.ShoelacesTemplates, baseScheme, baseURL string, script *mappings.Script) (string, error) {
+	params := make(map[string]interface{}, len(script.Params)+2)
+	for k, v := range script.Params {
+		params[k] = v
 	}
+	params["baseScheme"] = baseScheme
+	params["baseURL"] = utils.BaseURLforEnvName(baseURL, script.Environment)
+	return templateRenderer.RenderTemplate(logger, script.Name, params, script.Environment)
+}
 
+// genRetryScript renders the script making a host poll again, after
+// offering the menu and sleeping as the policy says. iPXE sleeps in
+// seconds and prompts in milliseconds.
+func genRetryScript(logger log.Logger, policy Policy, baseScheme, baseURL string, mac string, retry int) (string, error) {
+	variablesMap := map[string]interface{}{}
+	parsedTemplate := &bytes.Buffer{}
+
+	variablesMap["baseScheme"] = baseScheme
 	variablesMap["baseURL"] = baseURL
 	variablesMap["macAddress"] = utils.MacColonToDash(mac)
-	err = tmpl.Execute(parsedTemplate, variablesMap)
-	if err != nil {
-		logger.Info("component", "polling", "msg", "Error executing retry template", "mac", mac)
-		panic(err)
+	variablesMap["attributesQuery"] = mappings.IPXEAttributesQuery
+	variablesMap["retryDelay"] = int64(math.Ceil(policy.retryDelay(retry).Seconds()))
+	variablesMap["promptTimeout"] = policy.PromptTimeout.Milliseconds()
+	if err := retryTemplate.Execute(parsedTemplate, variablesMap); err != nil {
+		logger.Info("component", "polling", "msg", "Error executing retry template", "mac", mac, "err", err)
+		return "", err
 	}
 
-	return parsedTemplate.String()
+	return parsedTemplate.String(), nil
 }
@@ -0,0 +1,246 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package polling
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/event"
+	"github.com/Didstopia/shoelaces/internal/inventory"
+	"github.com/Didstopia/shoelaces/internal/log"
+	"github.com/Didstopia/shoelaces/internal/mappings"
+	"github.com/Didstopia/shoelaces/internal/server"
+	"github.com/Didstopia/shoelaces/internal/templates"
+)
+
+const testHosts = 50
+
+func newTestRenderer(t *testing.T, logger log.Logger) *templates.ShoelacesTemplates {
+	t.Helper()
+	dataDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dataDir, "ipxe"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tpl := "{{define \"test.ipxe\" -}}\n#!ipxe\nset hostname {{.hostname}}\n{{end}}\n"
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "ipxe", "test.ipxe.slc"), []byte(tpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	renderer := templates.New()
+	if err := renderer.ParseTemplates(logger, dataDir, "env_overrides", nil, ".slc"); err != nil {
+		t.Fatal(err)
+	}
+	return renderer
+}
+
+func testMAC(i int) string {
+	return fmt.Sprintf("52:54:00:00:00:%02x", i)
+}
+
+func TestPollConcurrentMappings(t *testing.T) {
+	logger := log.MakeLogger(ioutil.Discard)
+	renderer := newTestRenderer(t, logger)
+	states, _ := server.NewStates(nil)
+	inv, _ := inventory.New(nil)
+	eventLog := event.NewLog(logger, nil)
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	script := &mappings.Script{
+		Name:   "test.ipxe",
+		Params: map[string]interface{}{"hostnamePrefix": "node-"},
+		Mode:   mappings.ModeAlways,
+	}
+	networkMaps := []mappings.NetworkMap{{Network: network, Script: script}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < testHosts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			srv := server.New(testMAC(i), fmt.Sprintf("10.0.0.%d", i+1), "")
+			text, err := Poll(logger, states, inv, nil, nil, nil, networkMaps, DefaultPolicy, eventLog, renderer, "http", "localhost", "", srv)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			expected := fmt.Sprintf("set hostname node-52-54-00-00-00-%02x\n", i)
+			if !strings.Contains(text, expected) {
+				t.Errorf("%s: expected %q in the script, got %q", srv.Mac, expected, text)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(script.Params) != 1 {
+		t.Errorf("Expected the parameters of the mapping to be left alone, got %v", script.Params)
+	}
+	events, _ := eventLog.ListEvents()
+	if len(events) != testHosts {
+		t.Errorf("Expected events for %d hosts, got %d", testHosts, len(events))
+	}
+}
+
+func TestPollConcurrentManualSelection(t *testing.T) {
+	logger := log.MakeLogger(ioutil.Discard)
+	renderer := newTestRenderer(t, logger)
+	states, _ := server.NewStates(nil)
+	inv, _ := inventory.New(nil)
+	eventLog := event.NewLog(logger, nil)
+
+	poll := func(srv server.Server) (string, error) {
+		return Poll(logger, states, inv, nil, nil, nil, nil, DefaultPolicy, eventLog, renderer, "http", "localhost", "", srv)
+	}
+
+	done := make(chan struct{})
+	readers := sync.WaitGroup{}
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			ListServers(states)
+			eventLog.ListEvents()
+			states.RemoveExpired(0)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < testHosts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			srv := server.New(testMAC(i), "10.0.0.1", "")
+			if _, err := poll(srv); err != nil {
+				t.Error(err)
+				return
+			}
+			// The API sends no parameters when there are none
+			if _, err := UpdateTarget(logger, states, inv, renderer, eventLog, "http", "localhost", srv, "test.ipxe", "", nil, mappings.ModeOnce); err != nil {
+				t.Error(err)
+				return
+			}
+			text, err := poll(srv)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			expected := fmt.Sprintf("set hostname 52-54-00-00-00-%02x\n", i)
+			if !strings.Contains(text, expected) {
+				t.Errorf("%s: expected %q in the script, got %q", srv.Mac, expected, text)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	if servers := ListServers(states); len(servers) != 0 {
+		t.Errorf("Expected no servers waiting, got %v", servers)
+	}
+}
+
+// countingStore counts the times the server states are saved.
+type countingStore struct {
+	saves int
+}
+
+func (s *countingStore) Save(states map[string]*server.State) error {
+	s.saves++
+	return nil
+}
+
+func (s *countingStore) Load() (map[string]*server.State, error) {
+	return nil, nil
+}
+
+func (s *countingStore) SaveBoots(boots map[string]*server.Boot) error {
+	return nil
+}
+
+func (s *countingStore) LoadBoots() (map[string]*server.Boot, error) {
+	return nil, nil
+}
+
+func TestPollSavesRetries(t *testing.T) {
+	defer func(interval time.Duration) { retrySaveInterval = interval }(retrySaveInterval)
+	retrySaveInterval = 0
+
+	logger := log.MakeLogger(ioutil.Discard)
+	renderer := newTestRenderer(t, logger)
+	store := server.NewFileStateStore(filepath.Join(t.TempDir(), "servers.json"))
+	states, err := server.NewStates(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, _ := inventory.New(nil)
+	eventLog := event.NewLog(logger, nil)
+	srv := server.New(testMAC(1), "10.0.0.1", "")
+
+	for i := 0; i < 3; i++ {
+		if _, err := Poll(logger, states, inv, nil, nil, nil, nil, DefaultPolicy, eventLog, renderer, "http", "localhost", "", srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The retries count after a restart
+	restored, err := server.NewStates(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := restored.Servers[srv.Mac]; state == nil || state.Retry != 3 {
+		t.Errorf("Expected the 3 retries to be restored, got %+v", state)
+	}
+}
+
+func TestPollSavesOnlyChanges(t *testing.T) {
+	logger := log.MakeLogger(ioutil.Discard)
+	renderer := newTestRenderer(t, logger)
+	store := &countingStore{}
+	states, _ := server.NewStates(store)
+	inv, _ := inventory.New(nil)
+	eventLog := event.NewLog(logger, nil)
+	srv := server.New(testMAC(1), "10.0.0.1", "")
+
+	poll := func() {
+		if _, err := Poll(logger, states, inv, nil, nil, nil, nil, DefaultPolicy, eventLog, renderer, "http", "localhost", "", srv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		poll()
+	}
+	if store.saves != 1 {
+		t.Errorf("Expected the states to be saved once for the new server, got %d saves", store.saves)
+	}
+	if _, err := UpdateTarget(logger, states, inv, renderer, eventLog, "http", "localhost", srv, "test.ipxe", "", nil, mappings.ModeOnce); err != nil {
+		t.Fatal(err)
+	}
+	poll()
+	if store.saves != 3 {
+		t.Errorf("Expected the states to be saved for the target and the boot, got %d saves", store.saves)
+	}
+}
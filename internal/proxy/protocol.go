@@ -0,0 +1,187 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headerTimeout limits how long a trusted proxy takes to send the PROXY
+// protocol header.
+const headerTimeout = 10 * time.Second
+
+// v2Signature starts the headers of the version 2 of the PROXY protocol.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrInvalidHeader is returned when reading from a connection whose PROXY
+// protocol header is malformed.
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// NewListener returns a listener understanding the PROXY protocol, both
+// versions 1 and 2, in the connections of trusted proxies. Their header
+// sets the remote address of the connection. The connections of other
+// peers, and those of trusted proxies sending no header, are left alone.
+func NewListener(l net.Listener, t Trusted) net.Listener {
+	return &listener{Listener: l, trusted: t}
+}
+
+type listener struct {
+	net.Listener
+	trusted Trusted
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.trusted.Contains(addr.IP) {
+		return c, nil
+	}
+	// The header is read by the first call to Read or RemoteAddr, so
+	// Accept doesn't wait for it.
+	return &conn{Conn: c}, nil
+}
+
+type conn struct {
+	net.Conn
+
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *conn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		c.reader = bufio.NewReader(c.Conn)
+		c.remote, c.err = readHeader(c.reader)
+	})
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the PROXY protocol header, if any, returning the
+// source address it holds. It returns a nil address when there's no
+// header, or when it doesn't hold an address, like health checks do.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		// Nothing was sent, it's up to the server to handle that
+		return nil, nil
+	}
+	switch first[0] {
+	case 'P':
+		if prefix, err := r.Peek(6); err != nil || string(prefix) != "PROXY " {
+			return nil, nil
+		}
+		return readV1Header(r)
+	case v2Signature[0]:
+		if prefix, err := r.Peek(len(v2Signature)); err != nil || !bytes.Equal(prefix, v2Signature) {
+			return nil, nil
+		}
+		return readV2Header(r)
+	}
+	return nil, nil
+}
+
+// readV1Header reads a header like "PROXY TCP4 10.0.0.1 10.0.0.2 5000 80".
+func readV1Header(r *bufio.Reader) (net.Addr, error) {
+	// The longest header is 107 bytes long
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readV2Header reads a binary header, made of the signature, the version
+// and command, the address family and the length of the addresses that
+// follow.
+func readV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	versionCommand, family := header[12], header[13]
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	switch versionCommand {
+	case 0x20:
+		// LOCAL command, sent by the proxy on its own behalf
+		return nil, nil
+	case 0x21:
+	default:
+		return nil, fmt.Errorf("%w: unsupported version or command %#x", ErrInvalidHeader, versionCommand)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(addresses) < 12 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(addresses) < 36 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:]))}, nil
+	}
+	// Other families don't carry a usable address
+	return nil, nil
+}
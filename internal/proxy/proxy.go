@@ -0,0 +1,113 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxy finds the address of the clients behind trusted reverse
+// proxies and load balancers, from the X-Forwarded-For and X-Real-IP
+// headers or the PROXY protocol.
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Trusted is a list of networks whose proxies are trusted to report the
+// address of their clients.
+type Trusted []*net.IPNet
+
+// ParseTrusted parses a comma separated list of CIDRs and IP addresses.
+func ParseTrusted(s string) (Trusted, error) {
+	var t Trusted
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			t = append(t, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", field)
+		}
+		t = append(t, network)
+	}
+	return t, nil
+}
+
+// Contains returns whether ip is in any of the trusted networks.
+func (t Trusted) Contains(ip net.IP) bool {
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAddr is like Contains, for an IP address as a string.
+func (t Trusted) containsAddr(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && t.Contains(ip)
+}
+
+// ClientIP returns the IP address of the client that made the request.
+// When the request comes from a trusted proxy, that's the last address of
+// X-Forwarded-For not belonging to a trusted proxy, or X-Real-IP when
+// there's no X-Forwarded-For. Otherwise it's the address of the peer.
+func (t Trusted) ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !t.containsAddr(ip) {
+		return ip
+	}
+
+	// Every proxy appends the address of its peer, so the addresses are
+	// walked back until one wasn't added by a trusted proxy.
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		ip = addr
+		if !t.containsAddr(addr) {
+			return ip
+		}
+	}
+	if len(forwarded) > 0 {
+		return ip
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return ip
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTrusted(t *testing.T) {
+	trusted, err := ParseTrusted("10.0.0.0/8, 192.168.1.1,2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"2001:db8::1": true,
+		"2001:db8::2": false,
+	} {
+		if got := trusted.Contains(net.ParseIP(addr)); got != want {
+			t.Errorf("%s: expected %v, got %v", addr, want, got)
+		}
+	}
+
+	if _, err := ParseTrusted("10.0.0.0/33"); err == nil {
+		t.Error("Expected an error with an invalid CIDR")
+	}
+	if _, err := ParseTrusted("proxy.example.com"); err == nil {
+		t.Error("Expected an error with a hostname")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := ParseTrusted("10.0.0.0/24")
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"direct", "192.168.0.5:5000", nil, "192.168.0.5"},
+		{"untrusted proxy", "192.168.0.5:5000", map[string]string{"X-Forwarded-For": "172.16.0.1"}, "192.168.0.5"},
+		{"trusted proxy", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "172.16.0.1"}, "172.16.0.1"},
+		{"proxy chain", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "1.2.3.4, 172.16.0.1, 10.0.0.2"}, "172.16.0.1"},
+		{"only proxies", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"garbage", "10.0.0.1:5000", map[string]string{"X-Forwarded-For": "unknown, 10.0.0.2"}, "10.0.0.2"},
+		{"real ip", "10.0.0.1:5000", map[string]string{"X-Real-IP": "172.16.0.1"}, "172.16.0.1"},
+		{"no header", "10.0.0.1:5000", nil, "10.0.0.1"},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest("GET", "/poll/1/52-54-00-aa-bb-cc", nil)
+		r.RemoteAddr = tc.remoteAddr
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		if got := trusted.ClientIP(r); got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	v2 := func(family byte, addresses ...byte) string {
+		return string(v2Signature) + string([]byte{0x21, family, 0, byte(len(addresses))}) + string(addresses)
+	}
+
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+		err      bool
+	}{
+		{"none", "GET / HTTP/1.1\r\n", "", false},
+		{"post", "POST / HTTP/1.1\r\n", "", false},
+		{"v1 ipv4", "PROXY TCP4 172.16.0.1 10.0.0.1 5000 80\r\nGET / HTTP/1.1\r\n", "172.16.0.1:5000", false},
+		{"v1 ipv6", "PROXY TCP6 2001:db8::5 2001:db8::1 5000 80\r\nGET / HTTP/1.1\r\n", "[2001:db8::5]:5000", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n", "", false},
+		{"v1 malformed", "PROXY TCP4 172.16.0.1\r\nGET / HTTP/1.1\r\n", "", true},
+		{"v2 ipv4", v2(0x11, 172, 16, 0, 1, 10, 0, 0, 1, 0x13, 0x88, 0, 80) + "GET / HTTP/1.1\r\n", "172.16.0.1:5000", false},
+		{"v2 truncated", v2(0x11, 172, 16, 0, 1), "", true},
+	}
+	for _, tc := range testCases {
+		r := bufio.NewReader(strings.NewReader(tc.input))
+		addr, err := readHeader(r)
+		if tc.err {
+			if !errors.Is(err, ErrInvalidHeader) {
+				t.Errorf("%s: expected an invalid header, got %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if got := addrString(addr); got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, got)
+		}
+		if rest, _ := io.ReadAll(r); strings.HasPrefix(string(rest), "PROXY") || !strings.HasSuffix(string(rest), " / HTTP/1.1\r\n") {
+			t.Errorf("%s: expected the request to be left unread, got %q", tc.name, rest)
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, _ := ParseTrusted("127.0.0.1")
+	l = NewListener(l, trusted)
+	defer l.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "PROXY TCP4 172.16.0.1 10.0.0.1 5000 80\r\nhello\n")
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.RemoteAddr().String(); got != "172.16.0.1:5000" {
+		t.Errorf("Expected the address of the header, got %s", got)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Errorf("Expected the data after the header, got %q (%v)", line, err)
+	}
+}
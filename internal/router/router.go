@@ -25,6 +25,8 @@ import (
 // ShoelacesRouter sets up all routes and handlers for shoelaces
 func ShoelacesRouter(env *environment.Environment) http.Handler {
 	r := mux.NewRouter()
+	// Latency of every matched route
+	r.Use(handlers.MetricsMiddleware)
 
 	// Main UI page
 	r.Handle("/", handlers.RenderDefaultTemplate("index")).Methods("GET")
@@ -32,15 +34,42 @@ func ShoelacesRouter(env *environment.Environment) http.Handler {
 	r.Handle("/events", handlers.RenderDefaultTemplate("events")).Methods("GET")
 	// Currently configured mappings page
 	r.Handle("/mappings", handlers.RenderDefaultTemplate("mappings")).Methods("GET")
+	// Inventory of known machines page
+	r.Handle("/inventory", handlers.RenderDefaultTemplate("inventory")).Methods("GET")
 	// Static files used by the UI
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/",
 		http.FileServer(http.Dir(env.StaticDir))))
-	// Manual boot parameters POST endpoint
+	// Versioned JSON API
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(handlers.APINotFoundHandler)
+	api.MethodNotAllowedHandler = http.HandlerFunc(handlers.APIMethodNotAllowedHandler)
+	// Servers that tried to boot but did not match any mapping
+	api.HandleFunc("/servers", handlers.APIServerListHandler).Methods("GET")
+	// Sets or clears the script a waiting server boots next
+	api.HandleFunc("/servers/{mac}/target", handlers.APISetTargetHandler).Methods("PUT")
+	api.HandleFunc("/servers/{mac}/target", handlers.APIClearTargetHandler).Methods("DELETE")
+	// Event log, filterable by MAC, type and date
+	api.HandleFunc("/events", handlers.APIEventListHandler).Methods("GET")
+	// Server-sent events with the changes in servers, events and reloads
+	api.HandleFunc("/stream", handlers.APIStreamHandler).Methods("GET")
+	// Mappings currently in use
+	api.HandleFunc("/mappings", handlers.APIMappingsHandler).Methods("GET")
+	// Parameters of a script, with their metadata
+	api.HandleFunc("/scripts/{script}/params", handlers.APIScriptParamsHandler).Methods("GET")
+	// Inventory of known machines
+	api.HandleFunc("/machines", handlers.APIMachineListHandler).Methods("GET")
+	api.HandleFunc("/machines", handlers.APIAddMachineHandler).Methods("POST")
+	api.HandleFunc("/machines/{id}", handlers.APIMachineHandler).Methods("GET")
+	api.HandleFunc("/machines/{id}", handlers.APIUpdateMachineHandler).Methods("PUT")
+	api.HandleFunc("/machines/{id}", handlers.APIDeleteMachineHandler).Methods("DELETE")
+
+	// Metrics in the Prometheus text format
+	r.HandleFunc("/metrics", handlers.MetricsHandler).Methods("GET")
+
+	// Manual boot parameters POST endpoint, kept for plain HTML forms
 	r.HandleFunc("/update/target", handlers.UpdateTargetHandler).Methods("POST")
-	// Provides a list of the servers that tried to boot but did not match
-	// the hostname regex or network mappings
-	r.HandleFunc("/ajax/servers", handlers.ServerListHandler).Methods("GET")
-	// Event Log History JSON endpoint
+	// Legacy endpoints, superseded by the JSON API
+	r.HandleFunc("/ajax/servers", handlers.APIServerListHandler).Methods("GET")
 	r.HandleFunc("/ajax/events", handlers.ListEvents).Methods("GET")
 	// Provides the list of possible parameters for a given template
 	r.HandleFunc("/ajax/script/params", handlers.GetTemplateParams)
@@ -60,6 +89,8 @@ func ShoelacesRouter(env *environment.Environment) http.Handler {
 	// Serves a generated iPXE boot script providing a selection
 	// of all of the boot scripts available on the filesystem for that environment.
 	r.HandleFunc("/ipxemenu", handlers.IPXEMenu).Methods("GET")
+	// Called by installers to report their progress
+	r.HandleFunc("/report/{mac}/{phase}", handlers.ReportHandler).Methods("GET", "POST")
 
 	return r
 }
@@ -0,0 +1,101 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+)
+
+// BootExpiry is how long the script booted by a host waits for the report
+// of its installer.
+const BootExpiry = 24 * time.Hour
+
+// Boot holds the script a host booted, from the inventory, a mapping or
+// the UI, until its installer reports the installation is over.
+type Boot struct {
+	Server
+	Script      string
+	Environment string
+	// Mode is the mode of the assignment, like "once" or "always".
+	Mode string
+	// Peer is the address the host polled from, which reports must come
+	// from as well.
+	Peer string
+	Time int
+}
+
+// AddBoot records the script a host booted, replacing the previous one.
+func (m *States) AddBoot(boot Boot) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if boot.Time == 0 {
+		boot.Time = int(time.Now().UTC().Unix())
+	}
+	m.boots[boot.Mac] = &boot
+	return m.saveBoots()
+}
+
+// FindBoot returns the script the host booted last, unless it's waiting
+// for a report for longer than BootExpiry.
+func (m *States) FindBoot(mac string) (Boot, bool) {
+	m.RLock()
+	defer m.RUnlock()
+
+	boot, ok := m.boots[mac]
+	if !ok || boot.expired(time.Now()) {
+		return Boot{}, false
+	}
+	return *boot, true
+}
+
+// RemoveBoot forgets the script a host booted, once it's done installing.
+func (m *States) RemoveBoot(mac string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.boots[mac]; !ok {
+		return nil
+	}
+	delete(m.boots, mac)
+	return m.saveBoots()
+}
+
+func (b *Boot) expired(now time.Time) bool {
+	return int64(b.Time) <= now.Add(-BootExpiry).Unix()
+}
+
+// removeExpiredBoots forgets the boots that stopped waiting for a report.
+// It returns whether any was removed. The caller must hold the lock.
+func (m *States) removeExpiredBoots() bool {
+	now := time.Now()
+	removed := false
+	for mac, boot := range m.boots {
+		if boot.expired(now) {
+			delete(m.boots, mac)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// saveBoots persists the boots in the configured store, if any. The caller
+// must hold the lock.
+func (m *States) saveBoots() error {
+	if m.store == nil {
+		return nil
+	}
+	return m.store.SaveBoots(m.boots)
+}
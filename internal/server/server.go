@@ -15,6 +15,8 @@
 package server
 
 import (
+	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -31,6 +33,12 @@ type Server struct {
 	Mac      string
 	IP       string
 	Hostname string
+	// Attributes holds the hardware attributes reported by iPXE, like the
+	// manufacturer or the serial number, when there are any.
+	Attributes map[string]string `json:",omitempty"`
+	// Peer is the address the requests of the server come from. It differs
+	// from IP when a relay trusted to send the ip parameter polls for it.
+	Peer string `json:"-"`
 }
 
 // Servers is an array of Server
@@ -65,7 +73,59 @@ type State struct {
 // States. It provides a mutex for thread-safety.
 type States struct {
 	sync.RWMutex
-	Servers map[string]*State
+	Servers  map[string]*State
+	store    StateStore
+	onChange func(added, removed Servers)
+	// waiting holds the servers that were waiting for a target when the
+	// states were last saved.
+	waiting map[string]Server
+	// waits holds the channels of WaitTarget, by MAC address.
+	waits    map[string]map[chan struct{}]bool
+	released bool
+	// boots holds the scripts booted by the hosts, by MAC address.
+	boots map[string]*Boot
+	// saved is when the states were last persisted.
+	saved time.Time
+}
+
+// NewStates returns a States struct. If a store is given, the states saved
+// in it are restored and every call to Save persists them there.
+func NewStates(store StateStore) (*States, error) {
+	states := &States{
+		Servers: make(map[string]*State),
+		store:   store,
+		waiting: make(map[string]Server),
+		waits:   make(map[string]map[chan struct{}]bool),
+		boots:   make(map[string]*Boot),
+	}
+	if store == nil {
+		return states, nil
+	}
+
+	boots, err := store.LoadBoots()
+	if err != nil {
+		return nil, err
+	}
+	for mac, boot := range boots {
+		states.boots[mac] = boot
+	}
+
+	saved, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	// Restored servers get a fresh expiry window, as they had no chance
+	// to poll while Shoelaces was down.
+	now := int(time.Now().UTC().Unix())
+	for mac, state := range saved {
+		state.LastAccess = now
+		states.Servers[mac] = state
+		if state.Target == InitTarget {
+			states.waiting[mac] = state.Server
+		}
+	}
+
+	return states, nil
 }
 
 // New returns a Server with is values initialized
@@ -92,32 +152,178 @@ func (m *States) DeleteServer(mac string) {
 	delete(m.Servers, mac)
 }
 
-// StartStateCleaner spawns a goroutine that cleans MAC addresses that
-// have been inactive in Shoelaces for more than 3 minutes.
-func StartStateCleaner(logger log.Logger, serverStates *States) {
-	const (
-		// 3 minutes
-		expireAfterSec = 3 * 60
-		cleanInterval  = time.Minute
-	)
-	// Clean up the server states. Expire after 3 minutes
+// OnChange sets a function called when servers start or stop waiting for
+// a target, with the ones that did. It's called by Save, with the lock
+// held, so it must not block.
+func (m *States) OnChange(fn func(added, removed Servers)) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.onChange = fn
+}
+
+// Save persists the current states in the configured store, if any, and
+// reports the servers that started or stopped waiting for a target since
+// the last call. The caller must hold the lock.
+func (m *States) Save() error {
+	m.notifyChanges()
+	if m.store == nil {
+		return nil
+	}
+	m.saved = time.Now()
+	return m.store.Save(m.Servers)
+}
+
+// SaveEvery is like Save, unless the states were saved less than interval
+// ago. It's meant for frequent changes that are fine to lose for a while,
+// like retry counters, until the next call to Save. The caller must hold
+// the lock.
+func (m *States) SaveEvery(interval time.Duration) error {
+	if time.Since(m.saved) < interval {
+		return nil
+	}
+	return m.Save()
+}
+
+func (m *States) notifyChanges() {
+	var added, removed Servers
+	for mac, state := range m.Servers {
+		if _, ok := m.waiting[mac]; !ok && state.Target == InitTarget {
+			added = append(added, state.Server)
+			m.waiting[mac] = state.Server
+		}
+	}
+	for mac, srv := range m.waiting {
+		if state, ok := m.Servers[mac]; !ok || state.Target != InitTarget {
+			removed = append(removed, srv)
+			delete(m.waiting, mac)
+		}
+	}
+	for _, srv := range removed {
+		m.wake(srv.Mac)
+	}
+	if m.onChange != nil && len(added)+len(removed) > 0 {
+		sort.Sort(added)
+		sort.Sort(removed)
+		m.onChange(added, removed)
+	}
+}
+
+// Waiting returns whether the server is waiting for a target.
+func (m *States) Waiting(mac string) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	state, ok := m.Servers[mac]
+	return ok && state.Target == InitTarget
+}
+
+// WaitTarget returns a channel closed once the server stops waiting for a
+// target, because one was chosen or the server was removed, as reported by
+// Save. It's closed as well by ReleaseWaits. The server doesn't need to be
+// waiting yet, so the wait can start before its first poll. cancel must be
+// called once done waiting.
+func (m *States) WaitTarget(mac string) (wait <-chan struct{}, cancel func()) {
+	m.Lock()
+	defer m.Unlock()
+
+	ch := make(chan struct{})
+	if m.released {
+		close(ch)
+		return ch, func() {}
+	}
+	if m.waits[mac] == nil {
+		m.waits[mac] = make(map[chan struct{}]bool)
+	}
+	m.waits[mac][ch] = true
+
+	return ch, func() {
+		m.Lock()
+		defer m.Unlock()
+
+		if m.waits[mac][ch] {
+			delete(m.waits[mac], ch)
+			if len(m.waits[mac]) == 0 {
+				delete(m.waits, mac)
+			}
+		}
+	}
+}
+
+// ReleaseWaits closes the channels of every wait, current and future, like
+// when shutting down.
+func (m *States) ReleaseWaits() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.released = true
+	for mac := range m.waits {
+		m.wake(mac)
+	}
+}
+
+// wake closes the channels of the waits of a server. The caller must hold
+// the lock.
+func (m *States) wake(mac string) {
+	for ch := range m.waits[mac] {
+		close(ch)
+	}
+	delete(m.waits, mac)
+}
+
+// RemoveExpired removes the servers that haven't polled since expire, a
+// Unix timestamp, saving the states when any was removed. It returns the
+// MAC addresses of the removed servers. The boots waiting for a report for
+// longer than BootExpiry are removed too.
+func (m *States) RemoveExpired(expire int) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.removeExpiredBoots() {
+		if err := m.saveBoots(); err != nil {
+			return nil, err
+		}
+	}
+
+	var removed []string
+	for mac, state := range m.Servers {
+		if state.LastAccess <= expire {
+			delete(m.Servers, mac)
+			removed = append(removed, mac)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	sort.Strings(removed)
+	return removed, m.Save()
+}
+
+// StartStateCleaner spawns a goroutine that cleans, every interval, the
+// MAC addresses that have been inactive in Shoelaces for longer than
+// expireAfter. It stops when ctx is done.
+func StartStateCleaner(ctx context.Context, logger log.Logger, serverStates *States, expireAfter, interval time.Duration) {
 	go func() {
-		for {
-			time.Sleep(cleanInterval)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 
-			servers := serverStates.Servers
-			expire := int(time.Now().UTC().Unix()) - expireAfterSec
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
 
+			expire := int(time.Now().UTC().Add(-expireAfter).Unix())
 			logger.Debug("component", "polling", "msg", "Cleaning", "before", time.Unix(int64(expire), 0))
 
-			serverStates.Lock()
-			for mac, state := range servers {
-				if state.LastAccess <= expire {
-					delete(servers, mac)
-					logger.Debug("component", "polling", "msg", "Mac cleaned", "mac", mac)
-				}
+			removed, err := serverStates.RemoveExpired(expire)
+			for _, mac := range removed {
+				logger.Debug("component", "polling", "msg", "Mac cleaned", "mac", mac)
+			}
+			if err != nil {
+				logger.Error("component", "polling", "msg", "Failed to save server states", "err", err)
 			}
-			serverStates.Unlock()
 		}
 	}()
 }
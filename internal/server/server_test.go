@@ -0,0 +1,130 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestStatesOnChange(t *testing.T) {
+	states, _ := NewStates(nil)
+	var added, removed Servers
+	states.OnChange(func(a, r Servers) {
+		added = append(added, a...)
+		removed = append(removed, r...)
+	})
+
+	states.AddServer(New("ff:ff:ff:ff:ff:01", "10.0.0.1", "host1"))
+	states.AddServer(New("ff:ff:ff:ff:ff:02", "10.0.0.2", "host2"))
+	states.Save()
+	if len(added) != 2 || added[0].Mac != "ff:ff:ff:ff:ff:01" || len(removed) != 0 {
+		t.Fatalf("Expected 2 servers added, got %v added and %v removed", added, removed)
+	}
+
+	// Servers with a target aren't waiting anymore
+	added, removed = nil, nil
+	states.Servers["ff:ff:ff:ff:ff:01"].Target = "coreos.ipxe"
+	states.DeleteServer("ff:ff:ff:ff:ff:02")
+	states.Save()
+	if len(added) != 0 || len(removed) != 2 {
+		t.Fatalf("Expected 2 servers removed, got %v added and %v removed", added, removed)
+	}
+
+	// Saving without changes reports nothing
+	removed = nil
+	states.Save()
+	if len(added)+len(removed) != 0 {
+		t.Errorf("Expected no changes, got %v added and %v removed", added, removed)
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	states, _ := NewStates(nil)
+	for i := 0; i < 10; i++ {
+		states.AddServer(New(fmt.Sprintf("ff:ff:ff:ff:ff:%02x", i), "10.0.0.1", ""))
+		states.Servers[fmt.Sprintf("ff:ff:ff:ff:ff:%02x", i)].LastAccess = i
+	}
+
+	// The cleaner runs along with the polls
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			states.Lock()
+			defer states.Unlock()
+			states.AddServer(New(fmt.Sprintf("ee:ee:ee:ee:ee:%02x", i), "10.0.0.2", ""))
+		}(i)
+		go func() {
+			defer wg.Done()
+			if _, err := states.RemoveExpired(4); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	removed, err := states.RemoveExpired(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || removed[0] != "ff:ff:ff:ff:ff:05" || removed[1] != "ff:ff:ff:ff:ff:06" {
+		t.Errorf("Expected the servers 5 and 6 removed, got %v", removed)
+	}
+	if len(states.Servers) != 13 {
+		t.Errorf("Expected 13 servers left, got %d", len(states.Servers))
+	}
+}
+
+func TestWaitTarget(t *testing.T) {
+	const mac = "ff:ff:ff:ff:ff:01"
+	states, _ := NewStates(nil)
+	closed := func(wait <-chan struct{}) bool {
+		select {
+		case <-wait:
+			return true
+		default:
+			return false
+		}
+	}
+
+	wait, cancel := states.WaitTarget(mac)
+	defer cancel()
+	other, cancelOther := states.WaitTarget("ff:ff:ff:ff:ff:02")
+	cancelOther()
+
+	// Starting to wait isn't a change worth waking up for
+	states.AddServer(New(mac, "10.0.0.1", "host1"))
+	states.Save()
+	if closed(wait) || !states.Waiting(mac) {
+		t.Fatal("Expected the server to be waiting")
+	}
+
+	states.Servers[mac].Target = "coreos.ipxe"
+	states.Save()
+	if !closed(wait) || states.Waiting(mac) {
+		t.Error("Expected the wait to be over once a target is chosen")
+	}
+	if closed(other) {
+		t.Error("Expected the waits of other servers to go on")
+	}
+
+	states.ReleaseWaits()
+	if wait, _ := states.WaitTarget(mac); !closed(wait) {
+		t.Error("Expected the waits to be over once released")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/Didstopia/shoelaces/internal/utils"
+)
+
+// StateStore persists the states of the servers that are booting, and the
+// scripts they booted, so they can be restored after a restart.
+type StateStore interface {
+	// Save replaces the stored states with the given ones.
+	Save(states map[string]*State) error
+	// Load returns the stored states.
+	Load() (map[string]*State, error)
+	// SaveBoots replaces the stored boots with the given ones.
+	SaveBoots(boots map[string]*Boot) error
+	// LoadBoots returns the stored boots.
+	LoadBoots() (map[string]*Boot, error)
+}
+
+// FileStateStore keeps the server states in a JSON file, and the boots in
+// another one next to it, named like it with a "-boots" suffix.
+type FileStateStore struct {
+	path      string
+	bootsPath string
+}
+
+// NewFileStateStore returns a FileStateStore that uses the file at path.
+func NewFileStateStore(path string) *FileStateStore {
+	ext := filepath.Ext(path)
+	return &FileStateStore{path: path, bootsPath: strings.TrimSuffix(path, ext) + "-boots" + ext}
+}
+
+// Save writes the states.
+func (f *FileStateStore) Save(states map[string]*State) error {
+	return utils.WriteJSON(f.path, states)
+}
+
+// Load reads the states from the file. A missing file means there are no
+// stored states.
+func (f *FileStateStore) Load() (map[string]*State, error) {
+	states := make(map[string]*State)
+	return states, utils.ReadJSON(f.path, &states)
+}
+
+// SaveBoots writes the boots.
+func (f *FileStateStore) SaveBoots(boots map[string]*Boot) error {
+	return utils.WriteJSON(f.bootsPath, boots)
+}
+
+// LoadBoots reads the boots from their file. A missing file means there
+// are no stored boots.
+func (f *FileStateStore) LoadBoots() (map[string]*Boot, error) {
+	boots := make(map[string]*Boot)
+	return boots, utils.ReadJSON(f.bootsPath, &boots)
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStatesRestore(t *testing.T) {
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "servers.json"))
+
+	states, err := NewStates(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states.AddServer(New("ff:ff:ff:ff:ff:ff", "10.0.0.1", "host1"))
+	state := states.Servers["ff:ff:ff:ff:ff:ff"]
+	state.Target = "coreos.ipxe"
+	state.Environment = "production"
+	state.Params = map[string]interface{}{"version": "666.0"}
+	state.Retry = 3
+	state.LastAccess = 0
+	if err := states.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewStates(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := restored.Servers["ff:ff:ff:ff:ff:ff"]
+	if !ok {
+		t.Fatal("Expected the server state to be restored")
+	}
+	if got.Target != "coreos.ipxe" || got.Environment != "production" || got.Retry != 3 {
+		t.Errorf("Unexpected restored state: %+v", got)
+	}
+	if got.Params["version"] != "666.0" {
+		t.Errorf("Expected param version: 666.0\nGot: %v", got.Params["version"])
+	}
+	if got.LastAccess == 0 {
+		t.Error("Expected the restored state to get a fresh LastAccess")
+	}
+}
+
+func TestBootsRestore(t *testing.T) {
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "servers.json"))
+
+	states, err := NewStates(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New("ff:ff:ff:ff:ff:ff", "10.0.0.1", "host1")
+	if err := states.AddBoot(Boot{Server: srv, Script: "coreos.ipxe", Mode: "until-reported-done"}); err != nil {
+		t.Fatal(err)
+	}
+	expired := New("ff:ff:ff:ff:ff:fe", "10.0.0.2", "host2")
+	if err := states.AddBoot(Boot{Server: expired, Script: "coreos.ipxe", Time: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewStates(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boot, ok := restored.FindBoot(srv.Mac)
+	if !ok || boot.Script != "coreos.ipxe" || boot.Mode != "until-reported-done" || boot.IP != "10.0.0.1" {
+		t.Errorf("Unexpected restored boot: %+v", boot)
+	}
+	if _, ok := restored.FindBoot(expired.Mac); ok {
+		t.Error("Expected the expired boot to be ignored")
+	}
+
+	if _, err := restored.RemoveExpired(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.RemoveBoot(srv.Mac); err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewStates(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.boots) != 0 {
+		t.Errorf("Expected the removed boots to be gone, got %v", again.boots)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stream
+
+import "sync"
+
+const (
+	// EventMessage carries a new event of the event log.
+	EventMessage = "event"
+	// ReloadMessage carries the event of a configuration reload.
+	ReloadMessage = "reload"
+	// ServerAddedMessage carries a server that started waiting for a
+	// target.
+	ServerAddedMessage = "server-added"
+	// ServerRemovedMessage carries a server that isn't waiting for a
+	// target anymore, because it got one, booted or timed out.
+	ServerRemovedMessage = "server-removed"
+)
+
+// clientBuffer is how many messages a client can fall behind before it's
+// disconnected.
+const clientBuffer = 64
+
+// Message is a change pushed to the clients of the stream.
+type Message struct {
+	Type string
+	Data interface{}
+}
+
+// Broker fans out the published messages to every subscribed client.
+// Clients that can't keep up are disconnected instead of slowing down the
+// publishers, so they can reconnect and start over from a fresh state.
+type Broker struct {
+	mu      sync.Mutex
+	clients map[chan Message]struct{}
+	closed  bool
+}
+
+// NewBroker returns a Broker without clients.
+func NewBroker() *Broker {
+	return &Broker{clients: make(map[chan Message]struct{})}
+}
+
+// Subscribe returns a channel receiving the messages published from now
+// on, and a function to stop receiving them. The channel is closed when
+// the client is disconnected or the broker is closed.
+func (b *Broker) Subscribe() (<-chan Message, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Message, clientBuffer)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.clients[ch] = struct{}{}
+	return ch, func() { b.unsubscribe(ch) }
+}
+
+// Publish sends a message to every client. It never blocks.
+func (b *Broker) Publish(m Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.clients {
+		select {
+		case ch <- m:
+		default:
+			delete(b.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// Clients returns the number of subscribed clients.
+func (b *Broker) Clients() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.clients)
+}
+
+// Close disconnects every client. Later subscriptions get a closed
+// channel.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.clients {
+		delete(b.clients, ch)
+		close(ch)
+	}
+	b.closed = true
+}
+
+func (b *Broker) unsubscribe(ch chan Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.clients[ch]; ok {
+		delete(b.clients, ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stream
+
+import "testing"
+
+func TestBrokerPublish(t *testing.T) {
+	b := NewBroker()
+	first, unsubscribe := b.Subscribe()
+	second, _ := b.Subscribe()
+
+	b.Publish(Message{Type: EventMessage, Data: 1})
+	for _, ch := range []<-chan Message{first, second} {
+		if m := <-ch; m.Type != EventMessage || m.Data != 1 {
+			t.Errorf("Unexpected message: %+v", m)
+		}
+	}
+
+	unsubscribe()
+	if _, ok := <-first; ok {
+		t.Error("Expected the channel to be closed after unsubscribing")
+	}
+	unsubscribe()
+	if b.Clients() != 1 {
+		t.Errorf("Expected 1 client, got %d", b.Clients())
+	}
+}
+
+func TestBrokerSlowClient(t *testing.T) {
+	b := NewBroker()
+	ch, _ := b.Subscribe()
+
+	for i := 0; i <= clientBuffer; i++ {
+		b.Publish(Message{Type: EventMessage, Data: i})
+	}
+	if b.Clients() != 0 {
+		t.Fatal("Expected the slow client to be disconnected")
+	}
+	received := 0
+	for range ch {
+		received++
+	}
+	if received != clientBuffer {
+		t.Errorf("Expected %d buffered messages, got %d", clientBuffer, received)
+	}
+}
+
+func TestBrokerClose(t *testing.T) {
+	b := NewBroker()
+	ch, _ := b.Subscribe()
+	b.Close()
+	if _, ok := <-ch; ok {
+		t.Error("Expected the channel to be closed")
+	}
+	late, _ := b.Subscribe()
+	if _, ok := <-late; ok {
+		t.Error("Expected subscriptions after closing to get a closed channel")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/Didstopia/shoelaces/internal/utils"
+)
+
+// Types of the template parameters.
+const (
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeBool   = "bool"
+)
+
+// SecretMask replaces the values of secret parameters in logs, events and
+// API responses.
+const SecretMask = "********"
+
+// metadataRegex finds the metadata block of a template file, a YAML
+// document in a template comment like:
+//
+//	{{/*---
+//	description: Installs Debian
+//	---*/}}
+var metadataRegex = regexp.MustCompile(`(?s)\{\{(?:- )?/\*---[ \t]*\r?\n(.*?)\r?\n[ \t]*---\*/(?: -)?\}\}`)
+
+// Metadata describes a template and its parameters.
+type Metadata struct {
+	Description string  `yaml:"description" json:"description,omitempty"`
+	Category    string  `yaml:"category" json:"category,omitempty"`
+	Params      []Param `yaml:"params" json:"params,omitempty"`
+}
+
+// Param describes a parameter of a template. Parameters are strings unless
+// their type says otherwise. Missing parameters get their default, and
+// are an error when they are required and have none.
+type Param struct {
+	Name        string   `yaml:"name" json:"name"`
+	Type        string   `yaml:"type" json:"type"`
+	Description string   `yaml:"description" json:"description,omitempty"`
+	Default     string   `yaml:"default" json:"default,omitempty"`
+	Required    bool     `yaml:"required" json:"required"`
+	Allowed     []string `yaml:"allowed" json:"allowed,omitempty"`
+	Secret      bool     `yaml:"secret" json:"secret,omitempty"`
+}
+
+// parseMetadata returns the metadata block of a template file, or empty
+// metadata when it has none.
+func parseMetadata(content []byte) (Metadata, error) {
+	var meta Metadata
+	m := metadataRegex.FindSubmatch(content)
+	if m == nil {
+		return meta, nil
+	}
+	if err := yaml.UnmarshalStrict(m[1], &meta); err != nil {
+		return meta, fmt.Errorf("metadata: %v", err)
+	}
+
+	names := make([]string, 0, len(meta.Params))
+	for i := range meta.Params {
+		p := &meta.Params[i]
+		if p.Name == "" {
+			return meta, fmt.Errorf("metadata: parameter %d has no name", i+1)
+		}
+		if utils.StringInSlice(p.Name, names) {
+			return meta, fmt.Errorf("metadata: duplicate parameter %q", p.Name)
+		}
+		names = append(names, p.Name)
+		if p.Type == "" {
+			p.Type = TypeString
+		}
+		if err := p.validate(); err != nil {
+			return meta, fmt.Errorf("metadata: parameter %q: %v", p.Name, err)
+		}
+	}
+	return meta, nil
+}
+
+// validate checks that the type is known, and that the default and the
+// allowed values are valid.
+func (p Param) validate() error {
+	switch p.Type {
+	case TypeString, TypeInt, TypeBool:
+	default:
+		return fmt.Errorf("unknown type %q", p.Type)
+	}
+	for _, v := range p.Allowed {
+		if err := p.checkType(v); err != nil {
+			return fmt.Errorf("allowed value %q: %v", v, err)
+		}
+	}
+	if p.Default != "" {
+		if err := p.check(p.Default); err != nil {
+			return fmt.Errorf("default %q: %v", p.Default, err)
+		}
+	}
+	return nil
+}
+
+func (p Param) checkType(value string) error {
+	switch p.Type {
+	case TypeInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return errors.New("not an integer")
+		}
+	case TypeBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return errors.New("not a boolean")
+		}
+	}
+	return nil
+}
+
+// check returns whether value, as received from a form or a mapping, is
+// valid for the parameter.
+func (p Param) check(value string) error {
+	if err := p.checkType(value); err != nil {
+		return err
+	}
+	if len(p.Allowed) > 0 && !utils.StringInSlice(value, p.Allowed) {
+		return fmt.Errorf("must be one of %s", strings.Join(p.Allowed, ", "))
+	}
+	return nil
+}
+
+// apply checks the parameters given to render a template, returning them
+// along with the defaults of the missing ones. The given map is left
+// alone.
+func (meta Metadata) apply(params map[string]interface{}) (map[string]interface{}, error) {
+	if len(meta.Params) == 0 {
+		return params, nil
+	}
+
+	applied := make(map[string]interface{}, len(params)+len(meta.Params))
+	for k, v := range params {
+		applied[k] = v
+	}
+	var missing, invalid []string
+	for _, p := range meta.Params {
+		value, ok := params[p.Name]
+		if !ok || value == "" {
+			switch {
+			case p.Default != "":
+				applied[p.Name] = p.Default
+			case p.Required:
+				missing = append(missing, p.Name)
+			}
+			continue
+		}
+		if err := p.check(fmt.Sprint(value)); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %v", p.Name, err))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.New("Missing variables in request: " + strings.Join(missing, ", "))
+	}
+	if len(invalid) > 0 {
+		return nil, errors.New("Invalid variables in request: " + strings.Join(invalid, "; "))
+	}
+	return applied, nil
+}
+
+func (meta Metadata) declares(name string) bool {
+	for _, p := range meta.Params {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// redact returns the parameters with the values of the secret ones
+// masked, or the same map when there are none.
+func (meta Metadata) redact(params map[string]interface{}) map[string]interface{} {
+	var redacted map[string]interface{}
+	for _, p := range meta.Params {
+		if _, ok := params[p.Name]; !ok || !p.Secret {
+			continue
+		}
+		if redacted == nil {
+			redacted = make(map[string]interface{}, len(params))
+			for k, v := range params {
+				redacted[k] = v
+			}
+		}
+		redacted[p.Name] = SecretMask
+	}
+	if redacted == nil {
+		return params
+	}
+	return redacted
+}
+
+// restore returns the parameters with the secret ones that are still
+// masked set back to their value in stored.
+func (meta Metadata) restore(params, stored map[string]interface{}) map[string]interface{} {
+	for _, p := range meta.Params {
+		value, ok := stored[p.Name]
+		if !p.Secret || !ok || params[p.Name] != SecretMask {
+			continue
+		}
+		params[p.Name] = value
+	}
+	return params
+}
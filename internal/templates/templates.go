@@ -15,28 +15,27 @@
 package templates
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/Didstopia/shoelaces/internal/log"
+	"github.com/Didstopia/shoelaces/internal/metrics"
 	"github.com/Didstopia/shoelaces/internal/utils"
 )
 
 const defaultEnvironment = "default"
 
-var varRegex = regexp.MustCompile(`{{\.(.*?)}}`)
-var configNameRegex = regexp.MustCompile(`{{define\s+"(.*?)".*}}`)
-
 // ShoelacesTemplates holds the core attributes for handling the dyanmic configurations
 // in Shoelaces.
 type ShoelacesTemplates struct {
+	sync.RWMutex
 	envTemplates map[string]shoelacesTemplateEnvironment
 	dataDir      string
 	envDir       string
@@ -45,85 +44,116 @@ type ShoelacesTemplates struct {
 
 type shoelacesTemplateEnvironment struct {
 	templateObj  *template.Template
-	templateVars map[string][]string
+	templateInfo map[string]shoelacesTemplateInfo
 }
 
 type shoelacesTemplateInfo struct {
 	name      string
 	variables []string
+	// optional holds the variables only tested by if, with and range.
+	optional map[string]bool
+	metadata Metadata
 }
 
 // New creates and initializes a new ShoelacesTemplates instance a returns a pointer to
 // it.
 func New() *ShoelacesTemplates {
+	return &ShoelacesTemplates{envTemplates: newEnvTemplates()}
+}
+
+func newEnvTemplates() map[string]shoelacesTemplateEnvironment {
 	e := make(map[string]shoelacesTemplateEnvironment)
 	e[defaultEnvironment] = shoelacesTemplateEnvironment{
 		templateObj:  template.New(""),
-		templateVars: make(map[string][]string),
+		templateInfo: make(map[string]shoelacesTemplateInfo),
 	}
-	return &ShoelacesTemplates{envTemplates: e}
+	return e
 }
 
-func (s *ShoelacesTemplates) parseTemplateInfo(logger log.Logger, path string) shoelacesTemplateInfo {
-	fh, err := os.Open(path)
+// parseTemplateInfo returns the name and the metadata of a template file.
+// The file is named by its first {{define}} action, which may come after
+// the metadata block. The variables are found once all the files are
+// parsed, by discoverVariables.
+func parseTemplateInfo(path string, content []byte) (shoelacesTemplateInfo, error) {
+	metadata, err := parseMetadata(content)
 	if err != nil {
-		logger.Error("component", "template", "err", err.Error())
-		os.Exit(1)
-	}
-
-	defer fh.Close()
-
-	templateVars := make([]string, 0)
-	scanner := bufio.NewScanner(fh)
-	templateName := ""
-	i := 0
-	for scanner.Scan() {
-		// find variables
-		result := varRegex.FindAllStringSubmatch(scanner.Text(), -1)
-		if varRegex.MatchString(scanner.Text()) {
-			for _, v := range result {
-				// we only want the actual match, being second in the group
-				if !utils.StringInSlice(v[1], templateVars) {
-					templateVars = append(templateVars, v[1])
-				}
-			}
+		return shoelacesTemplateInfo{}, fmt.Errorf("%s: %v", path, err)
+	}
+
+	t, err := template.New(filepath.Base(path)).Parse(string(content))
+	if err != nil {
+		return shoelacesTemplateInfo{}, err
+	}
+	var first *template.Template
+	for _, d := range t.Templates() {
+		if d.Name() == t.Name() || d.Tree == nil {
+			continue
 		}
-		// if first line get name of template
-		if i == 0 {
-			nameResult := configNameRegex.FindAllStringSubmatch(scanner.Text(), -1)
-			templateName = nameResult[0][1]
+		if first == nil || d.Tree.Root.Pos < first.Tree.Root.Pos {
+			first = d
 		}
-		i++
+	}
+	if first == nil {
+		return shoelacesTemplateInfo{}, fmt.Errorf("%s: missing {{define}} action", path)
 	}
 
-	return shoelacesTemplateInfo{name: templateName, variables: templateVars}
+	return shoelacesTemplateInfo{name: first.Name(), metadata: metadata}, nil
 }
 
-func (s *ShoelacesTemplates) checkAddEnvironment(logger log.Logger, environment string) {
+func (s *ShoelacesTemplates) checkAddEnvironment(environment string) error {
 	if _, ok := s.envTemplates[environment]; !ok {
-		c, e := s.envTemplates[defaultEnvironment].templateObj.Clone()
-		if e != nil {
-			logger.Error("component", "template", "msg", "Template for environment already executed", "environment", environment)
-			os.Exit(1)
+		c, err := s.envTemplates[defaultEnvironment].templateObj.Clone()
+		if err != nil {
+			return fmt.Errorf("cloning templates for environment %s: %v", environment, err)
 		}
 		s.envTemplates[environment] = shoelacesTemplateEnvironment{
 			templateObj:  c,
-			templateVars: make(map[string][]string),
+			templateInfo: make(map[string]shoelacesTemplateInfo),
 		}
 	}
+	return nil
 }
 
-func (s *ShoelacesTemplates) addTemplate(logger log.Logger, path string, environment string) error {
-	s.checkAddEnvironment(logger, environment)
-	i := s.parseTemplateInfo(logger, path)
-	_, err := s.envTemplates[environment].templateObj.ParseFiles(path)
+func (s *ShoelacesTemplates) addTemplate(path string, environment string) error {
+	if err := s.checkAddEnvironment(environment); err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	i, err := parseTemplateInfo(path, content)
 	if err != nil {
 		return err
 	}
-	s.envTemplates[environment].templateVars[i.name] = i.variables
+	// Same as ParseFiles, without reading the file again
+	_, err = s.envTemplates[environment].templateObj.New(filepath.Base(path)).Parse(string(content))
+	if err != nil {
+		return err
+	}
+	s.envTemplates[environment].templateInfo[i.name] = i
 	return nil
 }
 
+// discoverVariables finds the variables of every template, following the
+// templates they include, so it runs once all the files are parsed. The
+// environments get the default templates too, since they may include
+// overridden fragments needing other variables.
+func (s *ShoelacesTemplates) discoverVariables() {
+	defaults := s.envTemplates[defaultEnvironment].templateInfo
+	for _, e := range s.envTemplates {
+		for name, i := range defaults {
+			if _, ok := e.templateInfo[name]; !ok {
+				e.templateInfo[name] = i
+			}
+		}
+		for name, i := range e.templateInfo {
+			i.variables, i.optional = findVariables(e.templateObj, name)
+			e.templateInfo[name] = i
+		}
+	}
+}
+
 func (s *ShoelacesTemplates) getEnvFromPath(path string) string {
 	envPath := filepath.Join(s.dataDir, s.envDir)
 	if strings.HasPrefix(path, envPath) {
@@ -133,49 +163,63 @@ func (s *ShoelacesTemplates) getEnvFromPath(path string) string {
 }
 
 // ParseTemplates travels the dataDir and loads in an internal structure
-// all the templates found.
-func (s *ShoelacesTemplates) ParseTemplates(logger log.Logger, dataDir string, envDir string, envs []string, tplExt string) {
-	s.dataDir = dataDir
-	s.envDir = envDir
-	s.tplExt = tplExt
+// all the templates found. The templates in use are only replaced when
+// all of them parse successfully, so a broken template doesn't stop
+// Shoelaces from serving the previous ones.
+func (s *ShoelacesTemplates) ParseTemplates(logger log.Logger, dataDir string, envDir string, envs []string, tplExt string) error {
+	parsed := &ShoelacesTemplates{
+		envTemplates: newEnvTemplates(),
+		dataDir:      dataDir,
+		envDir:       envDir,
+		tplExt:       tplExt,
+	}
 
 	logger.Debug("component", "template", "msg", "Template parsing started", "dir", dataDir)
 
 	tplScannerDefault := func(p string, info os.FileInfo, err error) error {
-		if strings.HasPrefix(p, path.Join(dataDir, envDir)) {
+		if err != nil || strings.HasPrefix(p, path.Join(dataDir, envDir)) {
 			return err
 		}
 		if strings.HasSuffix(p, tplExt) {
 			logger.Info("component", "template", "msg", "Parsing file", "file", p)
-			if err := s.addTemplate(logger, p, defaultEnvironment); err != nil {
-				logger.Error("component", "template", "err", err.Error())
-				os.Exit(1)
-			}
+			return parsed.addTemplate(p, defaultEnvironment)
 		}
-		return err
+		return nil
 	}
 
 	tplScannerOverride := func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if strings.HasSuffix(p, tplExt) {
-			env := s.getEnvFromPath(p)
+			env := parsed.getEnvFromPath(p)
 			logger.Info("component", "template", "msg", "Parsing ovveride", "environment", env, "file", p)
-
-			if err := s.addTemplate(logger, p, env); err != nil {
-				logger.Error("component", "template", "err", err.Error())
-				os.Exit(1)
-			}
+			return parsed.addTemplate(p, env)
 		}
-		return err
+		return nil
 	}
 
 	if err := filepath.Walk(dataDir, tplScannerDefault); err != nil {
-		panic(err)
+		return err
 	}
-	logger.Info("component", "template", "msg", "Parsing override files", "dir", path.Join(dataDir, envDir))
-	if err := filepath.Walk(path.Join(dataDir, envDir), tplScannerOverride); err != nil {
+	overridesDir := path.Join(dataDir, envDir)
+	logger.Info("component", "template", "msg", "Parsing override files", "dir", overridesDir)
+	if _, err := os.Stat(overridesDir); os.IsNotExist(err) {
 		logger.Info("component", "template", "msg", "No overrides found")
+	} else if err := filepath.Walk(overridesDir, tplScannerOverride); err != nil {
+		return err
 	}
+	parsed.discoverVariables()
+
+	s.Lock()
+	s.envTemplates = parsed.envTemplates
+	s.dataDir = dataDir
+	s.envDir = envDir
+	s.tplExt = tplExt
+	s.Unlock()
+
 	logger.Debug("component", "template", "msg", "Parsing ended")
+	return nil
 }
 
 // RenderTemplate receives a name and a map of parameters, among other
@@ -185,20 +229,34 @@ func (s *ShoelacesTemplates) RenderTemplate(logger log.Logger, configName string
 	if envName == "" {
 		envName = defaultEnvironment
 	}
-	logger.Info("component", "template", "action", "template-request", "template", configName, "env", envName, "parameters", utils.MapToString(paramMap))
 
-	requiredVariables := s.envTemplates[envName].templateVars[configName]
+	s.RLock()
+	defer s.RUnlock()
+
+	info := s.templateInfo(configName, envName)
+	logger.Info("component", "template", "msg", "Rendering template", "template", configName, "env", envName, "parameters", utils.MapToString(info.metadata.redact(paramMap)))
+
+	if _, ok := s.envTemplates[envName]; !ok {
+		envName = defaultEnvironment
+	}
+	requiredVariables := info.variables
+	paramMap, err := info.metadata.apply(paramMap)
+	if err != nil {
+		logger.Info("component", "template", "msg", "Invalid variables in request", "template", configName, "env", envName, "err", err)
+		metrics.TemplateRenderErrors.Inc(s.metricLabel(configName, envName))
+		return "", err
+	}
 
 	var b bytes.Buffer
-	err := s.envTemplates[envName].templateObj.ExecuteTemplate(&b, configName, paramMap)
+	err = s.envTemplates[envName].templateObj.ExecuteTemplate(&b, configName, paramMap)
 	// Fall back to default template in case this is non default environment
 	// XXX: this is temporary and will be simplified to reduce the code duplication
 	if err != nil && envName != defaultEnvironment {
-		requiredVariables = s.envTemplates[defaultEnvironment].templateVars[configName]
 		err = s.envTemplates[defaultEnvironment].templateObj.ExecuteTemplate(&b, configName, paramMap)
 	}
 	if err != nil {
-		logger.Info("component", "template", "action", "render-template", "err", err.Error())
+		logger.Info("component", "template", "msg", "Failed to render template", "template", configName, "env", envName, "err", err)
+		metrics.TemplateRenderErrors.Inc(s.metricLabel(configName, envName))
 		return "", err
 	}
 	r := b.String()
@@ -212,22 +270,112 @@ func (s *ShoelacesTemplates) RenderTemplate(logger log.Logger, configName string
 				missingVariables += requiredVariable
 			}
 		}
-		logger.Info("component", "template", "msg", "Missing variables in request", "variables", missingVariables)
+		logger.Info("component", "template", "msg", "Missing variables in request", "template", configName, "env", envName, "variables", missingVariables)
+		metrics.TemplateRenderErrors.Inc(s.metricLabel(configName, envName))
 		return "", errors.New("Missing variables in request: " + missingVariables)
 	}
 
 	return r, nil
 }
 
+// metricLabel returns the template label of the render errors metric.
+// Names of templates that don't exist come from the requested URLs, so
+// they are all counted as unknown. The caller must hold the lock.
+func (s *ShoelacesTemplates) metricLabel(name, envName string) string {
+	if s.envTemplates[envName].templateObj.Lookup(name) == nil &&
+		s.envTemplates[defaultEnvironment].templateObj.Lookup(name) == nil {
+		return "unknown"
+	}
+	return name
+}
+
+// HasTemplate returns whether the named template can be rendered in the
+// given environment, either from its overrides or from the defaults.
+func (s *ShoelacesTemplates) HasTemplate(name, envName string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	if e, ok := s.envTemplates[envName]; ok && e.templateObj.Lookup(name) != nil {
+		return true
+	}
+	return s.envTemplates[defaultEnvironment].templateObj.Lookup(name) != nil
+}
+
+// Count returns the number of templates available in the default
+// environment.
+func (s *ShoelacesTemplates) Count() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.envTemplates[defaultEnvironment].templateInfo)
+}
+
+// templateInfo returns the variables and the metadata of a template, from
+// the overrides of the environment or else from the defaults. The caller
+// must hold the lock.
+func (s *ShoelacesTemplates) templateInfo(name, envName string) shoelacesTemplateInfo {
+	if e, ok := s.envTemplates[envName]; ok {
+		if i, ok := e.templateInfo[name]; ok {
+			return i
+		}
+	}
+	return s.envTemplates[defaultEnvironment].templateInfo[name]
+}
+
 // ListVariables receives a template name and return the list of variables
-// that belong to it. It's mainly used by the web frontend to provide a
-// list of dynamic fields to complete before rendering a template.
+// that belong to it: the parameters of its metadata first, and then the
+// ones only found in the template.
 func (s *ShoelacesTemplates) ListVariables(templateName, envName string) []string {
-	if e, ok := s.envTemplates[envName]; ok {
-		if v, ok := e.templateVars[templateName]; ok {
-			return v
+	var names []string
+	for _, p := range s.ListParams(templateName, envName) {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// ListParams is like ListVariables, with the description of every
+// parameter. Variables missing from the metadata are strings, required
+// unless they are only tested by if, with or range.
+// It's mainly used by the web frontend to provide a list of dynamic
+// fields to complete before rendering a template.
+func (s *ShoelacesTemplates) ListParams(templateName, envName string) []Param {
+	s.RLock()
+	defer s.RUnlock()
+
+	info := s.templateInfo(templateName, envName)
+	params := make([]Param, 0, len(info.metadata.Params)+len(info.variables))
+	params = append(params, info.metadata.Params...)
+	for _, v := range info.variables {
+		if !info.metadata.declares(v) {
+			params = append(params, Param{Name: v, Type: TypeString, Required: !info.optional[v]})
 		}
 	}
-	var empty []string
-	return empty
+	return params
+}
+
+// Metadata returns the metadata of a template.
+func (s *ShoelacesTemplates) Metadata(templateName, envName string) Metadata {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.templateInfo(templateName, envName).metadata
+}
+
+// RedactSecrets returns the parameters of a template with the values of
+// the secret ones masked, so they can be logged or recorded in events.
+func (s *ShoelacesTemplates) RedactSecrets(templateName, envName string, params map[string]interface{}) map[string]interface{} {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.templateInfo(templateName, envName).metadata.redact(params)
+}
+
+// RestoreSecrets sets the secret parameters of a template that are still
+// masked, like when a redacted object is sent back, to their stored value.
+// It returns params.
+func (s *ShoelacesTemplates) RestoreSecrets(templateName, envName string, params, stored map[string]interface{}) map[string]interface{} {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.templateInfo(templateName, envName).metadata.restore(params, stored)
 }
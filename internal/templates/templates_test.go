@@ -0,0 +1,221 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package templates
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Didstopia/shoelaces/internal/log"
+)
+
+func writeTemplate(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseTemplatesKeepsLastGood(t *testing.T) {
+	logger := log.MakeLogger(ioutil.Discard)
+	dataDir := t.TempDir()
+	tplPath := filepath.Join(dataDir, "ipxe", "test.ipxe.slc")
+
+	writeTemplate(t, tplPath, "{{define \"test.ipxe\" -}}\nboot {{.version}}\n{{end}}\n")
+	s := New()
+	if err := s.ParseTemplates(logger, dataDir, "env_overrides", nil, ".slc"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTemplate(t, tplPath, "{{define \"test.ipxe\" -}}\nboot {{.version\n{{end}}\n")
+	if err := s.ParseTemplates(logger, dataDir, "env_overrides", nil, ".slc"); err == nil {
+		t.Fatal("Expected an error for a broken template")
+	}
+
+	text, err := s.RenderTemplate(logger, "test.ipxe", map[string]interface{}{"version": "1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "boot 1\n" {
+		t.Errorf("Expected the previous template to be rendered, got %q", text)
+	}
+	if vars := s.ListVariables("test.ipxe", defaultEnvironment); len(vars) != 1 || vars[0] != "version" {
+		t.Errorf("Expected variables [version], got %v", vars)
+	}
+}
+
+func TestParseTemplatesMissingDefine(t *testing.T) {
+	dataDir := t.TempDir()
+	writeTemplate(t, filepath.Join(dataDir, "ipxe", "test.ipxe.slc"), "boot {{.version}}\n")
+
+	if err := New().ParseTemplates(log.MakeLogger(ioutil.Discard), dataDir, "env_overrides", nil, ".slc"); err == nil {
+		t.Fatal("Expected an error for a template without a {{define}} action")
+	}
+}
+
+func TestRenderTemplateUnknownEnvironment(t *testing.T) {
+	logger := log.MakeLogger(ioutil.Discard)
+	dataDir := t.TempDir()
+	writeTemplate(t, filepath.Join(dataDir, "ipxe", "test.ipxe.slc"), "{{define \"test.ipxe\" -}}\nboot\n{{end}}\n")
+
+	s := New()
+	if err := s.ParseTemplates(logger, dataDir, "env_overrides", nil, ".slc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RenderTemplate(logger, "test.ipxe", map[string]interface{}{}, "missing"); err != nil {
+		t.Errorf("Expected the default environment to be used, got %v", err)
+	}
+}
+
+const metadataTemplate = `{{/*---
+description: Installs Debian
+category: Linux
+params:
+  - name: release
+    description: Debian release
+    default: bookworm
+    allowed: [bullseye, bookworm]
+  - name: disks
+    type: int
+    required: true
+  - name: password
+    secret: true
+---*/ -}}
+{{define "debian.ipxe" -}}
+install {{.release}} {{.disks}} {{.password}} {{.hostname}}
+{{end}}
+`
+
+func TestTemplateMetadata(t *testing.T) {
+	logger := log.MakeLogger(ioutil.Discard)
+	dataDir := t.TempDir()
+	writeTemplate(t, filepath.Join(dataDir, "ipxe", "debian.ipxe.slc"), metadataTemplate)
+
+	s := New()
+	if err := s.ParseTemplates(logger, dataDir, "env_overrides", nil, ".slc"); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := s.Metadata("debian.ipxe", "missing")
+	if meta.Description != "Installs Debian" || meta.Category != "Linux" || len(meta.Params) != 3 {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+	vars := s.ListVariables("debian.ipxe", defaultEnvironment)
+	if strings.Join(vars, ",") != "release,disks,password,hostname" {
+		t.Errorf("Expected the declared parameters first, got %v", vars)
+	}
+	if p := s.ListParams("debian.ipxe", defaultEnvironment)[3]; p.Type != TypeString || !p.Required {
+		t.Errorf("Expected undeclared variables to be required strings, got %+v", p)
+	}
+
+	params := map[string]interface{}{"disks": "2", "password": "hunter2", "hostname": "host1"}
+	text, err := s.RenderTemplate(logger, "debian.ipxe", params, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "install bookworm 2 hunter2 host1\n" {
+		t.Errorf("Expected the default release to be used, got %q", text)
+	}
+	if _, ok := params["release"]; ok {
+		t.Error("Expected the parameters of the caller to be left alone")
+	}
+	redacted := s.RedactSecrets("debian.ipxe", "", params)
+	if redacted["password"] != SecretMask || params["password"] != "hunter2" {
+		t.Errorf("Expected a redacted copy, got %v", redacted)
+	}
+	if restored := s.RestoreSecrets("debian.ipxe", "", redacted, params); restored["password"] != "hunter2" {
+		t.Errorf("Expected the secret to be restored, got %v", restored)
+	}
+
+	for _, tc := range []struct {
+		params map[string]interface{}
+		err    string
+	}{
+		{map[string]interface{}{"hostname": "host1"}, "Missing variables in request: disks"},
+		{map[string]interface{}{"disks": "two", "hostname": "host1"}, "Invalid variables in request: disks: not an integer"},
+		{map[string]interface{}{"disks": "2", "release": "sid", "hostname": "host1"}, "Invalid variables in request: release: must be one of bullseye, bookworm"},
+	} {
+		if _, err := s.RenderTemplate(logger, "debian.ipxe", tc.params, ""); err == nil || err.Error() != tc.err {
+			t.Errorf("Expected %q for %v, got %v", tc.err, tc.params, err)
+		}
+	}
+}
+
+func TestTemplateMetadataInvalid(t *testing.T) {
+	for _, meta := range []string{
+		"params:\n  - type: int\n",
+		"params:\n  - name: a\n  - name: a\n",
+		"params:\n  - name: a\n    type: float\n",
+		"params:\n  - name: a\n    type: int\n    default: one\n",
+		"params:\n  - name: a\n    default: c\n    allowed: [a, b]\n",
+		"descripton: typo\n",
+	} {
+		dataDir := t.TempDir()
+		writeTemplate(t, filepath.Join(dataDir, "ipxe", "test.ipxe.slc"), "{{/*---\n"+meta+"---*/}}\n{{define \"test.ipxe\" -}}\nboot\n{{end}}\n")
+		if err := New().ParseTemplates(log.MakeLogger(ioutil.Discard), dataDir, "env_overrides", nil, ".slc"); err == nil {
+			t.Errorf("Expected an error for the metadata %q", meta)
+		}
+	}
+}
+
+func TestListVariablesIncludes(t *testing.T) {
+	logger := log.MakeLogger(ioutil.Discard)
+	dataDir := t.TempDir()
+	writeTemplate(t, filepath.Join(dataDir, "ipxe", "debian.ipxe.slc"),
+		"{{/* Debian installer */}}\n{{define \"debian.ipxe\" -}}\n"+
+			"kernel {{.baseURL}}/linux hostname={{ .hostname | printf \"%s\" }}\n"+
+			"{{if .console}}console={{.console}}{{end}}\n"+
+			"{{range .disks}}disk={{.name}}{{$.diskOpts}}{{end}}\n"+
+			"{{with .proxy}}proxy={{.}}{{else}}{{.mirror}}{{end}}\n"+
+			"{{template \"preseed\" .}}{{template \"debian.ipxe\" .}}{{template \"disk\" .disk}}\n"+
+			"{{end}}\n")
+	writeTemplate(t, filepath.Join(dataDir, "preseed", "common.preseed.slc"),
+		"{{define \"preseed\"}}d-i mirror {{.mirror}} {{.user}}{{end}}\n{{define \"disk\"}}{{.ignored}}{{end}}\n")
+	writeTemplate(t, filepath.Join(dataDir, "env_overrides", "testing", "preseed", "common.preseed.slc"),
+		"{{define \"preseed\"}}d-i mirror {{.testMirror}}{{end}}\n")
+
+	s := New()
+	if err := s.ParseTemplates(logger, dataDir, "env_overrides", []string{"testing"}, ".slc"); err != nil {
+		t.Fatal(err)
+	}
+
+	for env, want := range map[string]string{
+		defaultEnvironment: "baseURL,hostname,console,disks,diskOpts,proxy,mirror,user,disk",
+		"testing":          "baseURL,hostname,console,disks,diskOpts,proxy,mirror,testMirror,disk",
+	} {
+		if vars := s.ListVariables("debian.ipxe", env); strings.Join(vars, ",") != want {
+			t.Errorf("Expected the variables %s in %s, got %v", want, env, vars)
+		}
+	}
+
+	required := make(map[string]bool)
+	for _, p := range s.ListParams("debian.ipxe", defaultEnvironment) {
+		required[p.Name] = p.Required
+	}
+	for name, want := range map[string]bool{"hostname": true, "console": true, "disks": false, "proxy": false, "mirror": true} {
+		if required[name] != want {
+			t.Errorf("Expected %s to be required: %v", name, want)
+		}
+	}
+	if vars := s.ListVariables("preseed", defaultEnvironment); strings.Join(vars, ",") != "mirror,user" {
+		t.Errorf("Expected the variables of the fragment, got %v", vars)
+	}
+}
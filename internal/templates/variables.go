@@ -0,0 +1,135 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package templates
+
+import (
+	"text/template"
+	"text/template/parse"
+)
+
+// variableWalker finds the variables a template reads from its parameters,
+// in the order they appear. Variables only tested by if, with and range
+// are optional.
+type variableWalker struct {
+	tmpl      *template.Template
+	variables []string
+	optional  map[string]bool
+	visited   map[string]bool
+}
+
+// findVariables returns the variables of the template called name, and
+// the optional ones among them. The templates it includes with the same
+// parameters are followed.
+func findVariables(tmpl *template.Template, name string) ([]string, map[string]bool) {
+	w := &variableWalker{
+		tmpl:      tmpl,
+		variables: make([]string, 0),
+		optional:  make(map[string]bool),
+		visited:   make(map[string]bool),
+	}
+	w.walkTemplate(name)
+	return w.variables, w.optional
+}
+
+func (w *variableWalker) walkTemplate(name string) {
+	if w.visited[name] {
+		return
+	}
+	w.visited[name] = true
+	if t := w.tmpl.Lookup(name); t != nil && t.Tree != nil {
+		w.walk(t.Tree.Root, true, false)
+	}
+}
+
+func (w *variableWalker) add(name string, optional bool) {
+	if _, ok := w.optional[name]; !ok {
+		w.variables = append(w.variables, name)
+		w.optional[name] = optional
+	} else if !optional {
+		w.optional[name] = false
+	}
+}
+
+// walk visits node. rootDot tells whether the dot holds the parameters,
+// which $ always does in the templates that are followed.
+func (w *variableWalker) walk(node parse.Node, rootDot, optional bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			w.walk(c, rootDot, optional)
+		}
+	case *parse.ActionNode:
+		w.walk(n.Pipe, rootDot, optional)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			w.walk(c, rootDot, optional)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			w.walk(a, rootDot, optional)
+		}
+	case *parse.ChainNode:
+		w.walk(n.Node, rootDot, optional)
+	case *parse.FieldNode:
+		if rootDot {
+			w.add(n.Ident[0], optional)
+		}
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			w.add(n.Ident[1], optional)
+		}
+	case *parse.IfNode:
+		w.walkBranch(&n.BranchNode, rootDot, rootDot, optional)
+	case *parse.RangeNode:
+		w.walkBranch(&n.BranchNode, false, rootDot, optional)
+	case *parse.WithNode:
+		w.walkBranch(&n.BranchNode, false, rootDot, optional)
+	case *parse.TemplateNode:
+		if passesParams(n.Pipe, rootDot) {
+			w.walkTemplate(n.Name)
+		} else {
+			w.walk(n.Pipe, rootDot, optional)
+		}
+	}
+}
+
+// walkBranch visits an if, with or range. listDot tells whether the dot
+// still holds the parameters in its list.
+func (w *variableWalker) walkBranch(n *parse.BranchNode, listDot, rootDot, optional bool) {
+	w.walk(n.Pipe, rootDot, true)
+	w.walk(n.List, listDot, optional)
+	w.walk(n.ElseList, rootDot, optional)
+}
+
+// passesParams returns whether the pipeline of a {{template}} action is
+// the parameters, as in {{template "name" .}} or {{template "name" $}}.
+func passesParams(pipe *parse.PipeNode, rootDot bool) bool {
+	if pipe == nil || len(pipe.Decl) > 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+	switch a := pipe.Cmds[0].Args[0].(type) {
+	case *parse.DotNode:
+		return rootDot
+	case *parse.VariableNode:
+		return len(a.Ident) == 1 && a.Ident[0] == "$"
+	}
+	return false
+}
@@ -0,0 +1,488 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tftp implements a read-only TFTP server (RFC 1350), including the
+// blksize, tsize and timeout options (RFC 2347, 2348 and 2349). It's meant
+// for handing iPXE binaries to PXE clients for chainloading.
+package tftp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/log"
+)
+
+const (
+	opRRQ   uint16 = 1
+	opWRQ   uint16 = 2
+	opDATA  uint16 = 3
+	opACK   uint16 = 4
+	opERROR uint16 = 5
+	opOACK  uint16 = 6
+
+	errNotDefined    uint16 = 0
+	errNotFound      uint16 = 1
+	errAccess        uint16 = 2
+	errIllegalOp     uint16 = 4
+	errOptionRefused uint16 = 8
+
+	defaultBlockSize = 512
+	maxBlockSize     = 65464
+	minBlockSize     = 8
+	maxPacketSize    = 65536
+
+	defaultTimeout = 3 * time.Second
+	defaultRetries = 5
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to
+// Shutdown.
+var ErrServerClosed = errors.New("tftp: Server closed")
+
+// Server serves the files found in Root over TFTP.
+type Server struct {
+	Root    string
+	Logger  log.Logger
+	Timeout time.Duration
+	Retries int
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.PacketConn]struct{}
+	transfers sync.WaitGroup
+}
+
+// New returns a Server for the given root directory.
+func New(logger log.Logger, root string) *Server {
+	return &Server{
+		Root:    root,
+		Logger:  logger,
+		Timeout: defaultTimeout,
+		Retries: defaultRetries,
+	}
+}
+
+// ListenAndServe listens on the UDP address addr and serves requests until
+// the listener fails.
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.Logger.Info("component", "tftp", "addr", conn.LocalAddr(), "dir", s.Root, "msg", "Listening for incoming TFTP requests")
+	return s.Serve(conn)
+}
+
+// Serve reads requests from conn. Every transfer runs in its own goroutine
+// on a new ephemeral port, as the protocol requires.
+func (s *Server) Serve(conn net.PacketConn) error {
+	if !s.track(conn) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(conn)
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+
+		s.transfers.Add(1)
+		go func() {
+			defer s.transfers.Done()
+			s.handle(conn.LocalAddr(), packet, addr)
+		}()
+	}
+}
+
+// Shutdown stops accepting requests and waits for the transfers in
+// progress to finish, or for ctx to be done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.listeners {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.transfers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) track(conn net.PacketConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.PacketConn]struct{})
+	}
+	s.listeners[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.PacketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.listeners, conn)
+	conn.Close()
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// ClientType guesses the firmware of a PXE client from the file it
+// requests.
+func ClientType(filename string) string {
+	name := strings.ToLower(path.Base(filename))
+	switch {
+	case strings.HasSuffix(name, ".efi"):
+		return "uefi"
+	case strings.HasSuffix(name, ".kpxe"), strings.HasSuffix(name, ".pxe"), strings.HasSuffix(name, ".0"):
+		return "bios"
+	default:
+		return "unknown"
+	}
+}
+
+type request struct {
+	opcode   uint16
+	filename string
+	mode     string
+	options  map[string]string
+}
+
+func parseRequest(packet []byte) (*request, error) {
+	if len(packet) < 2 {
+		return nil, errors.New("short packet")
+	}
+	req := &request{opcode: binary.BigEndian.Uint16(packet), options: make(map[string]string)}
+
+	fields := bytes.Split(packet[2:], []byte{0})
+	// A well-formed request ends with a NUL, leaving an empty last field.
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return nil, errors.New("malformed request")
+	}
+	fields = fields[:len(fields)-1]
+
+	req.filename = string(fields[0])
+	req.mode = strings.ToLower(string(fields[1]))
+	for i := 2; i+1 < len(fields); i += 2 {
+		req.options[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+	return req, nil
+}
+
+func (s *Server) handle(local net.Addr, packet []byte, addr net.Addr) {
+	// Answer from a new port on the same address the request came in.
+	host, _, _ := net.SplitHostPort(local.String())
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		s.Logger.Error("component", "tftp", "msg", "Failed to open transfer socket", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	req, err := parseRequest(packet)
+	if err != nil {
+		s.Logger.Info("component", "tftp", "msg", "Invalid request", "src", addr, "err", err)
+		sendError(conn, addr, errIllegalOp, err.Error())
+		return
+	}
+
+	switch req.opcode {
+	case opRRQ:
+		s.read(conn, addr, req)
+	case opWRQ:
+		s.Logger.Info("component", "tftp", "msg", "Write request refused", "src", addr, "file", req.filename)
+		sendError(conn, addr, errAccess, "read-only server")
+	default:
+		sendError(conn, addr, errIllegalOp, "unexpected opcode")
+	}
+}
+
+// resolve maps a requested file name to a path inside Root, refusing any
+// attempt to escape it.
+func (s *Server) resolve(filename string) string {
+	clean := path.Clean("/" + strings.ReplaceAll(filename, "\\", "/"))
+	return filepath.Join(s.Root, filepath.FromSlash(clean))
+}
+
+func (s *Server) read(conn net.PacketConn, addr net.Addr, req *request) {
+	logger := s.Logger
+	client := ClientType(req.filename)
+
+	if req.mode != "octet" && req.mode != "netascii" {
+		sendError(conn, addr, errIllegalOp, "unsupported mode "+req.mode)
+		return
+	}
+
+	fh, err := os.Open(s.resolve(req.filename))
+	if err == nil {
+		var info os.FileInfo
+		if info, err = fh.Stat(); err == nil && info.IsDir() {
+			fh.Close()
+			err = os.ErrNotExist
+		}
+	}
+	if err != nil {
+		logger.Info("component", "tftp", "msg", "File not found", "src", addr, "file", req.filename, "client", client)
+		sendError(conn, addr, errNotFound, "file not found")
+		return
+	}
+	defer fh.Close()
+
+	info, _ := fh.Stat()
+	var src io.Reader = fh
+	size := info.Size()
+	if req.mode == "netascii" {
+		if size, err = netasciiSize(fh); err == nil {
+			_, err = fh.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			sendError(conn, addr, errNotDefined, "read error")
+			logger.Error("component", "tftp", "msg", "Failed to read file", "file", req.filename, "err", err)
+			return
+		}
+		src = newNetasciiReader(fh)
+	}
+
+	blockSize, timeout, oack, err := s.negotiate(req.options, size)
+	if err != nil {
+		sendError(conn, addr, errOptionRefused, err.Error())
+		return
+	}
+
+	logger.Info("component", "tftp", "msg", "Sending file", "src", addr, "file", req.filename, "client", client, "mode", req.mode, "size", size, "blksize", blockSize)
+	start := time.Now()
+
+	if len(oack) > 0 {
+		if err := s.exchange(conn, addr, oack, 0, timeout); err != nil {
+			logger.Info("component", "tftp", "msg", "Transfer aborted", "src", addr, "file", req.filename, "err", err)
+			return
+		}
+	}
+
+	data := make([]byte, blockSize)
+	for block := uint16(1); ; block++ {
+		n, err := io.ReadFull(src, data)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			sendError(conn, addr, errNotDefined, "read error")
+			logger.Error("component", "tftp", "msg", "Failed to read file", "file", req.filename, "err", err)
+			return
+		}
+
+		packet := make([]byte, 4+n)
+		binary.BigEndian.PutUint16(packet, opDATA)
+		binary.BigEndian.PutUint16(packet[2:], block)
+		copy(packet[4:], data[:n])
+		if err := s.exchange(conn, addr, packet, block, timeout); err != nil {
+			logger.Info("component", "tftp", "msg", "Transfer aborted", "src", addr, "file", req.filename, "err", err)
+			return
+		}
+
+		if n < blockSize {
+			break
+		}
+	}
+
+	logger.Debug("component", "tftp", "msg", "File sent", "src", addr, "file", req.filename, "duration", time.Since(start))
+}
+
+// netasciiReader converts a file to netascii (RFC 764), the text mode of
+// TFTP: LF becomes CR LF and CR becomes CR NUL.
+type netasciiReader struct {
+	r *bufio.Reader
+	// next is the second byte of the last conversion, when it didn't fit.
+	next    byte
+	pending bool
+}
+
+func newNetasciiReader(r io.Reader) *netasciiReader {
+	return &netasciiReader{r: bufio.NewReader(r)}
+}
+
+func (n *netasciiReader) Read(p []byte) (int, error) {
+	i := 0
+	for i < len(p) {
+		if n.pending {
+			p[i] = n.next
+			n.pending = false
+			i++
+			continue
+		}
+		c, err := n.r.ReadByte()
+		if err != nil {
+			if i > 0 {
+				return i, nil
+			}
+			return 0, err
+		}
+		switch c {
+		case '\n':
+			p[i], n.next, n.pending = '\r', '\n', true
+		case '\r':
+			p[i], n.next, n.pending = '\r', 0, true
+		default:
+			p[i] = c
+		}
+		i++
+	}
+	return i, nil
+}
+
+// netasciiSize returns the size of the netascii conversion of r, for the
+// tsize option.
+func netasciiSize(r io.Reader) (int64, error) {
+	var size int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		size += int64(n) + int64(bytes.Count(buf[:n], []byte{'\n'})+bytes.Count(buf[:n], []byte{'\r'}))
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// negotiate applies the options requested by the client and returns the
+// OACK packet to send, if any option was accepted.
+func (s *Server) negotiate(options map[string]string, size int64) (blockSize int, timeout time.Duration, oack []byte, err error) {
+	blockSize = defaultBlockSize
+	timeout = s.Timeout
+	accepted := make([]string, 0)
+
+	if v, ok := options["blksize"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minBlockSize {
+			return 0, 0, nil, fmt.Errorf("invalid blksize %q", v)
+		}
+		if n > maxBlockSize {
+			n = maxBlockSize
+		}
+		blockSize = n
+		accepted = append(accepted, "blksize", strconv.Itoa(n))
+	}
+	if v, ok := options["timeout"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 255 {
+			return 0, 0, nil, fmt.Errorf("invalid timeout %q", v)
+		}
+		timeout = time.Duration(n) * time.Second
+		accepted = append(accepted, "timeout", v)
+	}
+	if _, ok := options["tsize"]; ok {
+		accepted = append(accepted, "tsize", strconv.FormatInt(size, 10))
+	}
+
+	if len(accepted) == 0 {
+		return blockSize, timeout, nil, nil
+	}
+
+	oack = make([]byte, 2, 64)
+	binary.BigEndian.PutUint16(oack, opOACK)
+	for _, field := range accepted {
+		oack = append(oack, field...)
+		oack = append(oack, 0)
+	}
+	return blockSize, timeout, oack, nil
+}
+
+// exchange sends a packet and waits for the ACK of the given block,
+// retransmitting it on timeout.
+func (s *Server) exchange(conn net.PacketConn, addr net.Addr, packet []byte, block uint16, timeout time.Duration) error {
+	buf := make([]byte, maxPacketSize)
+
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		if _, err := conn.WriteTo(packet, addr); err != nil {
+			return err
+		}
+
+		deadline := time.Now().Add(timeout)
+		for {
+			conn.SetReadDeadline(deadline)
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return err
+			}
+			if from.String() != addr.String() || n < 4 {
+				continue
+			}
+
+			switch binary.BigEndian.Uint16(buf) {
+			case opACK:
+				if binary.BigEndian.Uint16(buf[2:]) == block {
+					return nil
+				}
+				// Duplicated ACKs of previous blocks are ignored.
+			case opERROR:
+				return fmt.Errorf("client error: %s", strings.TrimRight(string(buf[4:n]), "\x00"))
+			}
+		}
+	}
+
+	return errors.New("timed out waiting for ACK")
+}
+
+func sendError(conn net.PacketConn, addr net.Addr, code uint16, message string) {
+	packet := make([]byte, 4, 5+len(message))
+	binary.BigEndian.PutUint16(packet, opERROR)
+	binary.BigEndian.PutUint16(packet[2:], code)
+	packet = append(packet, message...)
+	packet = append(packet, 0)
+	conn.WriteTo(packet, addr)
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 ThousandEyes Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Didstopia/shoelaces/internal/log"
+)
+
+func startServer(t *testing.T, root string) net.Addr {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := New(log.MakeLogger(ioutil.Discard), root)
+	go s.Serve(conn)
+	return conn.LocalAddr()
+}
+
+func rrq(filename string, options ...string) []byte {
+	return rrqMode(filename, "octet", options...)
+}
+
+func rrqMode(filename, mode string, options ...string) []byte {
+	packet := []byte{0, byte(opRRQ)}
+	for _, field := range append([]string{filename, mode}, options...) {
+		packet = append(packet, field...)
+		packet = append(packet, 0)
+	}
+	return packet
+}
+
+// fetch downloads a file acknowledging every block, and returns its
+// contents along with the OACK options, if any.
+func fetch(t *testing.T, server net.Addr, packet []byte) ([]byte, string, uint16) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.WriteTo(packet, server); err != nil {
+		t.Fatal(err)
+	}
+
+	var content bytes.Buffer
+	var oack string
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack := []byte{0, byte(opACK), 0, 0}
+		switch binary.BigEndian.Uint16(buf) {
+		case opERROR:
+			return nil, "", binary.BigEndian.Uint16(buf[2:])
+		case opOACK:
+			oack = string(buf[2:n])
+		case opDATA:
+			copy(ack[2:], buf[2:4])
+			content.Write(buf[4:n])
+		}
+		conn.WriteTo(ack, from)
+		if binary.BigEndian.Uint16(buf) == opDATA && n-4 < blockSizeFromOACK(oack) {
+			return content.Bytes(), oack, 0
+		}
+	}
+}
+
+func blockSizeFromOACK(oack string) int {
+	fields := bytes.Split([]byte(oack), []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		if string(fields[i]) == "blksize" {
+			n := 0
+			for _, c := range fields[i+1] {
+				n = n*10 + int(c-'0')
+			}
+			return n
+		}
+	}
+	return defaultBlockSize
+}
+
+func TestServeFile(t *testing.T) {
+	root := t.TempDir()
+	content := bytes.Repeat([]byte("ipxe"), 700)
+	if err := ioutil.WriteFile(filepath.Join(root, "undionly.kpxe"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, root)
+
+	got, _, code := fetch(t, server, rrq("undionly.kpxe"))
+	if code != 0 || !bytes.Equal(got, content) {
+		t.Errorf("Expected %d bytes\nGot: %d bytes, error code %d", len(content), len(got), code)
+	}
+
+	got, oack, code := fetch(t, server, rrq("/undionly.kpxe", "blksize", "1024", "tsize", "0"))
+	if code != 0 || !bytes.Equal(got, content) {
+		t.Errorf("Expected %d bytes\nGot: %d bytes, error code %d", len(content), len(got), code)
+	}
+	if oack != "blksize\x001024\x00tsize\x002800\x00" {
+		t.Errorf("Unexpected OACK: %q", oack)
+	}
+}
+
+func TestServeNetascii(t *testing.T) {
+	root := t.TempDir()
+	content := []byte("#!ipxe\nchain boot.ipxe\r\n" + string(bytes.Repeat([]byte("x\n"), 300)))
+	if err := ioutil.WriteFile(filepath.Join(root, "boot.ipxe"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, root)
+
+	expected := []byte("#!ipxe\r\nchain boot.ipxe\r\x00\r\n" + string(bytes.Repeat([]byte("x\r\n"), 300)))
+	got, oack, code := fetch(t, server, rrqMode("boot.ipxe", "NETASCII", "tsize", "0"))
+	if code != 0 || !bytes.Equal(got, expected) {
+		t.Errorf("Expected %q\nGot: %q, error code %d", expected, got, code)
+	}
+	if oack != fmt.Sprintf("tsize\x00%d\x00", len(expected)) {
+		t.Errorf("Unexpected OACK: %q", oack)
+	}
+
+	if _, _, code := fetch(t, server, rrqMode("boot.ipxe", "mail")); code != errIllegalOp {
+		t.Errorf("Expected error code %d for the mail mode\nGot: %d", errIllegalOp, code)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	root := t.TempDir()
+	secret := filepath.Join(filepath.Dir(root), "secret")
+	ioutil.WriteFile(secret, []byte("secret"), 0644)
+	defer os.Remove(secret)
+	server := startServer(t, root)
+
+	if _, _, code := fetch(t, server, rrq("missing.efi")); code != errNotFound {
+		t.Errorf("Expected error code %d\nGot: %d", errNotFound, code)
+	}
+	if _, _, code := fetch(t, server, rrq("../secret")); code != errNotFound {
+		t.Errorf("Expected error code %d for a path outside root\nGot: %d", errNotFound, code)
+	}
+
+	wrq := rrq("upload")
+	wrq[1] = byte(opWRQ)
+	if _, _, code := fetch(t, server, wrq); code != errAccess {
+		t.Errorf("Expected error code %d\nGot: %d", errAccess, code)
+	}
+}
+
+func TestClientType(t *testing.T) {
+	cases := map[string]string{
+		"undionly.kpxe":  "bios",
+		"/ipxe/ipxe.efi": "uefi",
+		"pxelinux.0":     "bios",
+		"boot.ipxe":      "unknown",
+	}
+	for filename, expected := range cases {
+		if got := ClientType(filename); got != expected {
+			t.Errorf("%s: expected %s\nGot: %s", filename, expected, got)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(log.MakeLogger(ioutil.Discard), t.TempDir())
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(conn) }()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Errorf("Expected ErrServerClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve didn't return after Shutdown")
+	}
+}
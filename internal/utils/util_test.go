@@ -15,6 +15,8 @@
 package utils
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -37,3 +39,29 @@ func TestMacDashToColon(t *testing.T) {
 	testNormMac("ff-ff-ff-ff-ff-ff", "ff:ff:ff:ff:ff:ff")
 	testNormMac("ff.ff.ff.ff.ff.ff", "ff.ff.ff.ff.ff.ff")
 }
+
+func TestWriteJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	var missing map[string]int
+	if err := ReadJSON(path, &missing); err != nil || missing != nil {
+		t.Errorf("Expected a missing file to be left alone, got %v: %v", missing, err)
+	}
+
+	if err := WriteJSON(path, map[string]int{"retries": 3}); err != nil {
+		t.Fatal(err)
+	}
+	var read map[string]int
+	if err := ReadJSON(path, &read); err != nil || read["retries"] != 3 {
+		t.Errorf("Expected the written value, got %v: %v", read, err)
+	}
+
+	// Only the file itself is left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected a single file, got %d", len(entries))
+	}
+}
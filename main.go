@@ -15,13 +15,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Didstopia/shoelaces/internal/environment"
 	"github.com/Didstopia/shoelaces/internal/handlers"
+	"github.com/Didstopia/shoelaces/internal/proxy"
 	"github.com/Didstopia/shoelaces/internal/router"
+	"github.com/Didstopia/shoelaces/internal/tftp"
 	// cp "github.com/otiai10/copy"
 )
 
@@ -33,20 +39,124 @@ func main() {
 	// Print the version and build information on startup
 	fmt.Println("Shoelaces " + version + " (" + build + ")")
 
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "shoelaces:", err)
+		os.Exit(1)
+	}
+}
+
+// run starts all the servers and blocks until one of them fails or a
+// SIGINT or SIGTERM is received. Then, it gives the requests in progress
+// a drain period to finish before returning.
+func run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Prepare the environment
-	env := environment.New()
+	env, err := environment.New(ctx)
+	if err != nil {
+		return err
+	}
 	// prepareEnvironment(env)
 
 	// Create the application, including the web server, request routers and handlers etc.
 	app := handlers.MiddlewareChain(env).Then(router.ShoelacesRouter(env))
 
-	// TODO: Here we would need to control our own context and pass it to everything,
-	//       so that we have full control over the shutdown process and can do it gracefully!
-	// Start the web server and wait for it to exit
-	env.Logger.Info("component", "main", "transport", "http", "addr", env.BindAddr, "msg", "Listening for incoming HTTP requests")
-	env.Logger.Error("component", "main", "err", http.ListenAndServe(env.BindAddr, app))
+	// Start the servers and wait for any of them to exit
+	proxyDHCPAddrs := env.ProxyDHCPListenAddrs()
+	errs := make(chan error, 3+len(proxyDHCPAddrs))
+	httpServers := make([]*http.Server, 0, 2)
+
+	if env.Certificate == nil || env.TLSBindAddr != "" {
+		l, err := listen(env, env.BindAddr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Addr: env.BindAddr, Handler: app}
+		httpServers = append(httpServers, srv)
+		go func() {
+			env.Logger.Info("component", "main", "transport", "http", "addr", env.BindAddr, "msg", "Listening for incoming HTTP requests")
+			errs <- srv.Serve(l)
+		}()
+	}
+	if env.Certificate != nil {
+		addr := env.TLSBindAddr
+		if addr == "" {
+			addr = env.BindAddr
+		}
+		l, err := listen(env, addr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Addr: addr, Handler: app, TLSConfig: env.TLSConfig()}
+		httpServers = append(httpServers, srv)
+		go func() {
+			env.Logger.Info("component", "main", "transport", "https", "addr", addr, "msg", "Listening for incoming HTTPS requests")
+			errs <- srv.ServeTLS(l, "", "")
+		}()
+	}
+
+	var tftpServer *tftp.Server
+	if env.TFTPAddr != "" {
+		tftpServer = tftp.New(env.Logger, env.TFTPDir)
+		go func() {
+			errs <- tftpServer.ListenAndServe(env.TFTPAddr)
+		}()
+	}
+	if env.ProxyDHCP != nil {
+		for _, addr := range proxyDHCPAddrs {
+			go func(addr string) {
+				errs <- env.ProxyDHCP.ListenAndServe(addr)
+			}(addr)
+		}
+	}
+
+	var runErr error
+	select {
+	case runErr = <-errs:
+		env.Logger.Error("component", "main", "msg", "Server failed, shutting down", "err", runErr)
+	case <-ctx.Done():
+		env.Logger.Info("component", "main", "msg", "Shutting down", "timeout", env.ShutdownTimeout)
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), env.ShutdownTimeout)
+	defer cancel()
+
+	for _, srv := range httpServers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			env.Logger.Error("component", "main", "msg", "Failed to drain HTTP requests", "addr", srv.Addr, "err", err)
+			srv.Close()
+		}
+	}
+	if tftpServer != nil {
+		if err := tftpServer.Shutdown(shutdownCtx); err != nil {
+			env.Logger.Error("component", "main", "msg", "Failed to drain TFTP transfers", "err", err)
+		}
+	}
+	if env.ProxyDHCP != nil {
+		env.ProxyDHCP.Shutdown(shutdownCtx)
+	}
+
+	if err := env.Close(); err != nil {
+		env.Logger.Error("component", "main", "msg", "Failed to save state", "err", err)
+	}
+	env.Logger.Info("component", "main", "msg", "Stopped")
+
+	return runErr
+}
 
-	os.Exit(1)
+// listen opens a TCP listener on addr, understanding the PROXY protocol
+// from the trusted proxies when it's enabled.
+func listen(env *environment.Environment, addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if env.ProxyProtocol {
+		l = proxy.NewListener(l, env.Proxies)
+	}
+	return l, nil
 }
 
 // FIXME: Abandoned this for now, as this should run BEFORE environment.New(),
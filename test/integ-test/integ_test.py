@@ -165,6 +165,8 @@ def test_events(shoelaces_instance):
     # assert our date actually parses
     assert dateutil.parser.parse(res['06:66:de:ad:be:ef'][0]['date'])
     del res['06:66:de:ad:be:ef'][0]['date']
+    # assert the event carries the ID of the request that caused it
+    assert res['06:66:de:ad:be:ef'][0]['requestId']
     # compare to the expected result sans the date as it would be different
     assert sorted(res['06:66:de:ad:be:ef'][0]) == sorted({'eventType': '0',
                                                           'message': '0',
@@ -176,7 +178,8 @@ def test_events(shoelaces_instance):
                                                                      'cloudconfig': 'virtual',
                                                                      'hostname': '06-66-de-ad-be-ef',
                                                                      'version': '666.0'},
-                                                          'script': 'coreos.ipxe'})
+                                                          'script': 'coreos.ipxe',
+                                                          'requestId': ''})
 
 
 POLL_PAIRS = [(None, "poll.txt"),
@@ -209,5 +212,15 @@ def test_template_variables_list(shoelaces_instance, script, env, vars):
     assert sorted(req.json()) == sorted(vars)
 
 
+@pytest.mark.parametrize(("script", "env", "vars"), TPL_VARS_PAIRS)
+def test_script_params(shoelaces_instance, script, env, vars):
+    url = "{}/api/v1/scripts/{}/params".format(API_URL, script)
+    req = requests.get(url, params={"environment": env})
+    req.raise_for_status()
+    params = req.json()
+    assert sorted(p['name'] for p in params) == sorted(vars)
+    assert all('type' in p and 'required' in p for p in params)
+
+
 if __name__ == "__main__":
     pytest.main(args=['-v'], plugins=None)
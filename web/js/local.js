@@ -18,9 +18,20 @@
 
 $(document).ready(function () {
     $('#systems').hide()
-    updateHostnames();
-    updateEventHistory();
+    connectStream();
     $('#target').on('change', scriptSelection);
+    $('#mode').on('change', modeSelection);
+    $('#systems').on('submit', submitTarget);
+    if ($('#machines').length) {
+        updateMachines();
+        $('#machine-script').on('change', function () { machineScriptSelection({}); });
+        $('#machine-form').on('submit', submitMachine);
+        $('#machine-form').on('reset', function () {
+            // Hidden inputs keep their value on reset
+            $(this).find('input[name="id"]').val('');
+            $('.machine-params').empty();
+        });
+    }
 
     window.setTimeout(function () {
         $('.alert').fadeTo(1000, 0).slideUp(1000, function () {
@@ -29,39 +40,91 @@ $(document).ready(function () {
     }, 3000);
 });
 
-window.setInterval(updateHostnames, 5000);
-window.setInterval(updateEventHistory, 5000);
+// Servers waiting for a target, by MAC address
+var waitingServers = {};
 
-function updateHostnames() {
-    $.getJSON('/ajax/servers', function (systems) {
-        var macs = $('#mac');
-        var selection = $('select[name="mac"]').find('option:selected').text();
-        macs.empty();
-
-        if (systems.length == 0) {
-            $('#systems').fadeOut(500);
-            $('#loading').fadeIn(500);
-        } else {
-            $('#loading').hide(500);
-            $('#systems').removeClass('hide');
-            $('#systems').fadeIn(500);
-
-            $.each(systems, function () {
-                var system_str = this.Mac + ' - ' + this.IP;
-                if (this.Hostname != '') {
-                    system_str += ' - ' + this.Hostname;
-                }
-                macs.append('<option class="text-primary-custom" value="' + this.Mac + '">' + system_str  +  '</option>');
-            });
+// connectStream receives the changes pushed by Shoelaces. The browser
+// reconnects on its own when the connection drops, and the whole state is
+// fetched again then, since changes may have been missed in between.
+// Browsers without server-sent events poll instead.
+function connectStream() {
+    if (!window.EventSource) {
+        updateHostnames();
+        updateEventHistory();
+        window.setInterval(updateHostnames, 5000);
+        window.setInterval(updateEventHistory, 5000);
+        return;
+    }
 
-            $('#mac option').filter(function () {
-                //may want to use $.trim in here
-                return $(this).text() == selection;
-            }).prop('selected', true);
+    var source = new EventSource('/api/v1/stream');
+    source.addEventListener('open', function () {
+        // The stream starts with the servers waiting right now
+        waitingServers = {};
+        showServers();
+        updateEventHistory();
+    });
+    source.addEventListener('server-added', function (e) {
+        var srv = JSON.parse(e.data);
+        waitingServers[srv.Mac] = srv;
+        showServers();
+    });
+    source.addEventListener('server-removed', function (e) {
+        delete waitingServers[JSON.parse(e.data).Mac];
+        showServers();
+    });
+    source.addEventListener('event', function (e) {
+        addEvent(JSON.parse(e.data));
+    });
+    source.addEventListener('reload', function (e) {
+        var reload = JSON.parse(e.data);
+        addEvent(reload);
+        if (reload.params.status == 'failure') {
+            showMessage('danger', reload.message);
+        } else if ($('#mappings').length) {
+            window.location.reload();
+        } else {
+            showMessage('info', reload.message + ' Refresh the page to use the new scripts.');
         }
     });
 }
 
+function updateHostnames() {
+    $.getJSON('/api/v1/servers', function (systems) {
+        waitingServers = {};
+        $.each(systems, function () {
+            waitingServers[this.Mac] = this;
+        });
+        showServers();
+    });
+}
+
+function showServers() {
+    var macs = $('#mac');
+    var selection = $('select[name="mac"]').val();
+    var systems = $.map(waitingServers, function (srv) { return srv; }).sort(function (a, b) {
+        return a.Mac < b.Mac ? -1 : 1;
+    });
+    macs.empty();
+
+    if (systems.length == 0) {
+        $('#systems').fadeOut(500);
+        $('#loading').fadeIn(500);
+    } else {
+        $('#loading').hide(500);
+        $('#systems').removeClass('hide');
+        $('#systems').fadeIn(500);
+
+        $.each(systems, function () {
+            var system_str = this.Mac + ' - ' + this.IP;
+            if (this.Hostname != '') {
+                system_str += ' - ' + this.Hostname;
+            }
+            macs.append($('<option class="text-primary-custom"></option>').val(this.Mac).text(system_str));
+        });
+        macs.val(selection);
+    }
+}
+
 function scriptSelection() {
     var paramsElems = $('.params-container');
     var option = $('select[name="target"]').find('option:selected');
@@ -71,47 +134,338 @@ function scriptSelection() {
     if (!script || script.length === 0) {
         paramsElems.empty();
     } else {
-        $.get('/ajax/script/params', {
-            'script': script,
+        $.get('/api/v1/scripts/' + encodeURIComponent(script) + '/params', {
             'environment': env
         }, function (params) {
             paramsElems.empty();
             $.each(params, function () {
-                paramsElems.append('<div class="col">' +
-                                   '  <input type="text" class="form-control" id="' + this + '"name="' + this + '" placeholder="' + this + '" required/>' +
-                                   '</div>');
+                paramsElems.append($('<div class="col"></div>').append(paramInput(this, this.default || '', this.required)));
             });
             paramsElems.append('<input type="hidden" name="environment" value="' + env + '"/>');
         });
     }
 }
 
-function updateEventHistory() {
-    var eventLogContainer = $('.event-log');
-    $.get('/ajax/events', function (events) {
-        if (!events) {
-            return;
+// Hosts booting from the local disk don't need a script
+function modeSelection() {
+    var localBoot = $('#mode').val() == 'local-boot';
+    $('#target').prop('required', !localBoot).prop('disabled', localBoot);
+    if (localBoot) {
+        $('#target').val('');
+        $('.params-container').empty();
+    }
+}
+
+// paramInput returns the form field of a template parameter: a list for
+// the ones with allowed values and booleans, and a text, number or
+// password input otherwise.
+function paramInput(param, value, required) {
+    var input;
+    var choices = param.allowed || (param.type == 'bool' ? ['true', 'false'] : null);
+    if (choices) {
+        input = $('<select class="form-control param"></select>');
+        if (!required || !param.default) {
+            input.append($('<option></option>').val('').text(param.name + (required ? '' : ' (' + (param.default || 'optional') + ')')));
         }
-        eventLogContainer.empty();
-        for (var mac in events) {
-            var title = mac;
-            if (events[mac][0].host != '') {
-                var host = events[mac][0].server.Hostname;
-                if (host == '') host = events[mac][0].server.IP;
-                title += ' (' + host + ')';
+        $.each(choices, function () {
+            input.append($('<option></option>').val(this).text(param.name + ': ' + this));
+        });
+    } else {
+        var type = param.secret ? 'password' : (param.type == 'int' ? 'number' : 'text');
+        input = $('<input class="form-control param"/>').attr('type', type).attr('placeholder', param.name);
+    }
+    input.attr('name', param.name).attr('title', param.description || param.name).prop('required', required).val(value);
+    return input;
+}
+
+function submitTarget(e) {
+    e.preventDefault();
+
+    var form = $(this);
+    var mac = form.find('select[name="mac"]').val();
+    var body = {
+        'script': form.find('select[name="target"]').val(),
+        'environment': form.find('input[name="environment"]').val() || '',
+        'mode': form.find('select[name="mode"]').val(),
+        'params': {}
+    };
+    form.find('.params-container .param').each(function () {
+        body.params[this.name] = this.value;
+    });
+
+    $.ajax({
+        url: '/api/v1/servers/' + encodeURIComponent(mac) + '/target',
+        method: 'PUT',
+        contentType: 'application/json',
+        data: JSON.stringify(body)
+    }).done(function () {
+        showMessage('success', (body.script ? 'Target ' + body.script : 'Local boot') + ' set for ' + mac + '.');
+        form[0].reset();
+        modeSelection();
+    }).fail(function (xhr) {
+        var message = xhr.responseJSON ? xhr.responseJSON.error.message : xhr.statusText;
+        showMessage('danger', message);
+    });
+}
+
+function escapeHTML(text) {
+    return $('<span>').text(text).html();
+}
+
+function updateMachines() {
+    $.getJSON('/api/v1/machines', function (machines) {
+        var rows = $('#machines tbody');
+        rows.empty();
+        $.each(machines, function () {
+            var machine = this;
+            var ids = [machine.mac, machine.uuid, machine.serial].filter(function (id) { return id; });
+            var labels = $.map(machine.labels || {}, function (value, key) { return key + '=' + value; });
+            var script = machine.script ? machine.script : '<i>mappings</i>';
+            if (machine.script && machine.environment) {
+                script += ' [' + machine.environment + ']';
             }
-            var elem = eventLogContainer.append('<div class="card" id="' + mac + '"><h5 class="card-header text-primary-custom">' + title + '</h5><div class="card-body"><ul class="list-group list-group-flush">');
-
-            $.each(events[mac], function () {
-                var date = (new Date(this.date)).toLocaleString();
-                var params = "";
-                for (var p in this.params) {
-                    params += p + ':' + this.params[p] + ' ';
-                }
-                elem.append('<li class="list-group-item"><b>' + date + '</b>: ' + this.message + '</li>');
-            });
+            var row = $('<tr>' +
+                        '<td>' + escapeHTML(machine.name) + '</td>' +
+                        '<td>' + $.map(ids, escapeHTML).join('<br />') + '</td>' +
+                        '<td>' + escapeHTML(labels.join(', ')) + '</td>' +
+                        '<td>' + (machine.script ? escapeHTML(script) : script) + '</td>' +
+                        '<td>' + escapeHTML(machine.mode || 'always') + '</td>' +
+                        '<td class="text-right">' +
+                        '  <button class="btn btn-sm btn-secondary edit">Edit</button>' +
+                        '  <button class="btn btn-sm btn-danger delete">Delete</button>' +
+                        '</td></tr>');
+            row.find('.edit').on('click', function () { editMachine(machine); });
+            row.find('.delete').on('click', function () { deleteMachine(machine); });
+            rows.append(row);
+        });
+    });
+}
+
+function editMachine(machine) {
+    var form = $('#machine-form');
+    form.find('input[name="id"]').val(machine.id);
+    form.find('input[name="name"]').val(machine.name);
+    form.find('input[name="mac"]').val(machine.mac || '');
+    form.find('input[name="uuid"]').val(machine.uuid || '');
+    form.find('input[name="serial"]').val(machine.serial || '');
+    form.find('input[name="labels"]').val($.map(machine.labels || {}, function (value, key) {
+        return key + '=' + value;
+    }).join(', '));
+
+    var select = $('#machine-script');
+    select.find('option').prop('selected', false);
+    select.find('option').filter(function () {
+        return $(this).val() == (machine.script || '') && ($(this).data('env') || '') == (machine.environment || '');
+    }).prop('selected', true);
+    $('#machine-mode').val(machine.mode || 'always');
+    machineScriptSelection(machine.params || {});
+}
+
+function machineScriptSelection(values) {
+    var paramsElems = $('.machine-params');
+    var option = $('#machine-script').find('option:selected');
+    var script = $(option).data('script');
+
+    paramsElems.empty();
+    if (!script) {
+        return;
+    }
+    $.get('/api/v1/scripts/' + encodeURIComponent(script) + '/params', {
+        'environment': $(option).data('env')
+    }, function (params) {
+        $.each(params, function () {
+            // Missing parameters get their default when rendering
+            var value = values[this.name] !== undefined ? String(values[this.name]) : '';
+            paramsElems.append($('<div class="col"></div>').append(paramInput(this, value, false)));
+        });
+    });
+}
 
-            eventLogContainer.append('</ul></div></div>');
+function submitMachine(e) {
+    e.preventDefault();
+
+    var form = $(this);
+    var option = $('#machine-script').find('option:selected');
+    var id = form.find('input[name="id"]').val();
+    var body = {
+        'name': form.find('input[name="name"]').val(),
+        'mac': form.find('input[name="mac"]').val(),
+        'uuid': form.find('input[name="uuid"]').val(),
+        'serial': form.find('input[name="serial"]').val(),
+        'script': option.val(),
+        'environment': option.val() ? (option.data('env') || '') : '',
+        'mode': $('#machine-mode').val(),
+        'labels': {},
+        'params': {}
+    };
+    $.each(form.find('input[name="labels"]').val().split(','), function () {
+        var label = $.trim(this);
+        if (label) {
+            var i = label.indexOf('=');
+            body.labels[i < 0 ? label : label.slice(0, i)] = i < 0 ? '' : label.slice(i + 1);
+        }
+    });
+    form.find('.machine-params .param').each(function () {
+        if (this.value !== '') {
+            body.params[this.name] = this.value;
         }
     });
+
+    $.ajax({
+        url: '/api/v1/machines' + (id ? '/' + encodeURIComponent(id) : ''),
+        method: id ? 'PUT' : 'POST',
+        contentType: 'application/json',
+        data: JSON.stringify(body)
+    }).done(function (machine) {
+        showMessage('success', 'Machine ' + (machine.name || machine.id) + ' saved.');
+        form[0].reset();
+        updateMachines();
+    }).fail(function (xhr) {
+        var message = xhr.responseJSON ? xhr.responseJSON.error.message : xhr.statusText;
+        showMessage('danger', message);
+    });
+}
+
+function deleteMachine(machine) {
+    if (!window.confirm('Delete ' + (machine.name || machine.id) + ' from the inventory?')) {
+        return;
+    }
+    $.ajax({
+        url: '/api/v1/machines/' + encodeURIComponent(machine.id),
+        method: 'DELETE'
+    }).done(function () {
+        showMessage('success', 'Machine ' + (machine.name || machine.id) + ' deleted.');
+        updateMachines();
+    }).fail(function (xhr) {
+        var message = xhr.responseJSON ? xhr.responseJSON.error.message : xhr.statusText;
+        showMessage('danger', message);
+    });
+}
+
+function showMessage(kind, message) {
+    var alert = $('<div class="alert" role="alert"></div>').addClass('alert-' + kind).text(message);
+    $('#messages').append(alert);
+    window.setTimeout(function () {
+        alert.fadeTo(1000, 0).slideUp(1000, function () {
+            $(this).remove();
+        });
+    }, 3000);
+}
+
+function groupEventsByMac(eventList) {
+    var events = {};
+    $.each(eventList, function () {
+        var mac = this.server.Mac;
+        if (!events[mac]) {
+            events[mac] = [];
+        }
+        events[mac].push(this);
+    });
+    return events;
+}
+
+// Event types, as numbered by the API
+var HOST_BOOT = 2;
+
+// Provisioning statuses shown for each phase reported by installers
+var reportStatuses = {
+    'started': {'text': 'Installing', 'class': 'badge-info'},
+    'progress': {'text': 'Installing', 'class': 'badge-info'},
+    'success': {'text': 'Installed', 'class': 'badge-success'},
+    'failure': {'text': 'Failed', 'class': 'badge-danger'}
+};
+
+// provisioningStatus returns the status of a host according to its last
+// boot or report, or null if it never reported anything.
+function provisioningStatus(events) {
+    var status = null;
+    $.each(events, function () {
+        var phase = this.params && this.params.phase;
+        if (phase && reportStatuses[phase]) {
+            status = reportStatuses[phase];
+        } else if (this.eventType == HOST_BOOT && status) {
+            status = {'text': 'Booting', 'class': 'badge-secondary'};
+        }
+    });
+    return status;
+}
+
+// Events shown in the history, sorted by date
+var eventHistory = [];
+
+function updateEventHistory() {
+    if (!$('.event-log').length) {
+        return;
+    }
+    $.get('/api/v1/events', function (eventList) {
+        eventHistory = eventList || [];
+        showEventHistory();
+    });
+}
+
+// addEvent adds an event pushed by the stream to the history, unless it
+// was already fetched along with the whole history.
+function addEvent(e) {
+    if (!$('.event-log').length) {
+        return;
+    }
+    var duplicate = eventHistory.some(function (other) {
+        return other.date == e.date && other.eventType == e.eventType && other.server.Mac == e.server.Mac;
+    });
+    if (!duplicate) {
+        eventHistory.push(e);
+        showEventHistory();
+    }
+}
+
+function showEventHistory() {
+    var eventLogContainer = $('.event-log');
+    if (!eventLogContainer.length) {
+        return;
+    }
+    var events = groupEventsByMac(eventHistory);
+    // Logs being read stay open when the history is refreshed
+    var openLogs = {};
+    eventLogContainer.find('details[open]').each(function () {
+        openLogs[$(this).data('key')] = true;
+    });
+    eventLogContainer.empty();
+    for (var mac in events) {
+        var title = mac;
+        if (mac == '') {
+            // Configuration reloads aren't related to any host.
+            title = 'Configuration';
+        } else {
+            var host = events[mac][0].server.Hostname;
+            if (host == '') host = events[mac][0].server.IP;
+            title += ' (' + host + ')';
+        }
+        var header = $('<h5 class="card-header text-primary-custom"></h5>').text(title);
+        var status = provisioningStatus(events[mac]);
+        if (status) {
+            header.append(' <span class="badge ' + status['class'] + '">' + status.text + '</span>');
+        }
+        var list = $('<ul class="list-group list-group-flush"></ul>');
+        eventLogContainer.append($('<div class="card"></div>').attr('id', mac)
+                                 .append(header)
+                                 .append($('<div class="card-body"></div>').append(list)));
+
+        $.each(events[mac], function () {
+            var date = (new Date(this.date)).toLocaleString();
+            var itemClass = 'list-group-item';
+            if (this.params && (this.params.status == 'failure' || this.params.phase == 'failure')) {
+                itemClass += ' text-danger';
+            }
+            var item = $('<li class="' + itemClass + '"><b>' + date + '</b>: </li>');
+            item.append($('<span>').text(this.message));
+            if (this.params && this.params.log) {
+                var key = mac + ' ' + this.date;
+                item.append($('<details><summary>Installer log</summary></details>')
+                            .attr('data-key', key)
+                            .prop('open', !!openLogs[key])
+                            .append($('<pre></pre>').text(this.params.log)));
+            }
+            list.append(item);
+        });
+    }
 }